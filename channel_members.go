@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// migrateBatchSize 搬移時每次 BulkWrite 的筆數
+const migrateBatchSize = 1000
+
+// SubscriptionSourceOrg 由 channel sync 管理的訂閱 (org 樹與 rule channel)
+const SubscriptionSourceOrg = "org"
+
+// Subscription 參考 Rocket.Chat 的 subscriptions，一個 user 在一個 channel 一筆
+// 取代 channel 裡的 members 陣列，避免大 channel 接近 16MB 上限、每次更新都重寫整個陣列
+type Subscription struct {
+	Id        string    `bson:"_id" json:"id"` // {rid}:{uid}
+	ChannelId string    `bson:"rid" json:"rid"`
+	UserId    string    `bson:"uid" json:"uid"`
+	Source    string    `bson:"source" json:"source"`
+	Muted     bool      `bson:"muted" json:"muted"`
+	SyncedAt  time.Time `bson:"synced_at" json:"syncedAt"`
+}
+
+// 只比對 sync 範圍內 division 底下的 channel，例如 ^(A|B)(/|$)
+func divisionPrefixRegex(divisions []string) string {
+	quoted := make([]string, 0, len(divisions))
+	for _, d := range divisions {
+		quoted = append(quoted, regexp.QuoteMeta(d))
+	}
+	return "^(" + strings.Join(quoted, "|") + ")(/|$)"
+}
+
+// EnsureSubscriptionIndexes 建立「channel 的成員」與「user 的 channel」兩個方向的查詢索引
+func EnsureSubscriptionIndexes(ctx context.Context, subs *mongo.Collection) error {
+	_, err := subs.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "rid", Value: 1}, {Key: "uid", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "uid", Value: 1}, {Key: "rid", Value: 1}}},
+		{Keys: bson.D{{Key: "source", Value: 1}, {Key: "synced_at", Value: 1}}},
+	})
+	return err
+}
+
+// ListChannelMembers 分頁列出 channel 的直屬成員，afterUserId 為上一頁最後一個 uid
+func ListChannelMembers(ctx context.Context, subs *mongo.Collection, channelId, afterUserId string, limit int64) ([]string, error) {
+	filter := bson.M{"rid": channelId}
+	if afterUserId != "" {
+		filter["uid"] = bson.M{"$gt": afterUserId}
+	}
+	opts := options.Find().
+		SetSort(bson.D{{Key: "uid", Value: 1}}).
+		SetProjection(bson.D{{Key: "uid", Value: 1}}).
+		SetLimit(limit)
+
+	cur, err := subs.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	var rows []Subscription
+	if err := cur.All(ctx, &rows); err != nil {
+		return nil, err
+	}
+	members := make([]string, 0, len(rows))
+	for _, r := range rows {
+		members = append(members, r.UserId)
+	}
+	return members, nil
+}
+
+// CountChannelMembers 直屬成員數
+func CountChannelMembers(ctx context.Context, subs *mongo.Collection, channelId string) (int64, error) {
+	return subs.CountDocuments(ctx, bson.M{"rid": channelId})
+}
+
+// ListUserChannels 某個 user 直接訂閱的 channel
+func ListUserChannels(ctx context.Context, subs *mongo.Collection, userId string) ([]string, error) {
+	cur, err := subs.Find(ctx, bson.M{"uid": userId}, options.Find().SetProjection(bson.D{{Key: "rid", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	var rows []Subscription
+	if err := cur.All(ctx, &rows); err != nil {
+		return nil, err
+	}
+	channels := make([]string, 0, len(rows))
+	for _, r := range rows {
+		channels = append(channels, r.ChannelId)
+	}
+	return channels, nil
+}
+
+// SharesChannel 兩個 user 是否直接訂閱同一個 channel
+func SharesChannel(ctx context.Context, subs *mongo.Collection, userId, otherId string) (bool, error) {
+	channels, err := ListUserChannels(ctx, subs, userId)
+	if err != nil || len(channels) == 0 {
+		return false, err
+	}
+	n, err := subs.CountDocuments(ctx, bson.M{"uid": otherId, "rid": bson.M{"$in": channels}}, options.Count().SetLimit(1))
+	return n > 0, err
+}
+
+// GetAudience 回傳 channel 實際的收訊對象 (含 rollup 的子孫 channel)
+func GetAudience(ctx context.Context, channels, subs *mongo.Collection, channelId string) ([]string, error) {
+	ids, err := AudienceChannelIds(ctx, channels, channelId)
+	if err != nil {
+		return nil, err
+	}
+
+	values, err := subs.Distinct(ctx, "uid", bson.M{"rid": bson.M{"$in": ids}})
+	if err != nil {
+		return nil, err
+	}
+	audience := make([]string, 0, len(values))
+	for _, v := range values {
+		if uid, ok := v.(string); ok {
+			audience = append(audience, uid)
+		}
+	}
+	return audience, nil
+}
+
+// legacyChannel 搬到 subscriptions 之前帶 members 陣列的 channel
+// 樹狀 channel 的 _id 是 string；mongo 筆記裡的平面資料 (channels 的 section、channels_d 的 department) 是 ObjectId
+type legacyChannel struct {
+	Id           interface{} `bson:"_id"`
+	DivisionId   string      `bson:"division_id"`
+	DepartmentId string      `bson:"department_id"`
+	SectionId    string      `bson:"section_id"`
+	Members      []string    `bson:"members"`
+}
+
+// treeId 平面資料依 division/department/section 換成樹狀 channel id，規則和 employees 相同
+func (c legacyChannel) treeId() string {
+	if id, ok := c.Id.(string); ok {
+		return id
+	}
+	return employeeChannelId(Employee{DivisionId: c.DivisionId, DepartmentId: c.DepartmentId, SectionId: c.SectionId})
+}
+
+// legacySubscriptions 合併舊資料的成員，回傳 channelId -> userId set
+// 舊的 department channel 包含底下所有 section 的人，樹狀結構只留直屬成員 (要看整個 department 用 rollup)，
+// 所以同一個人如果也在子孫 channel 裡，就不直接訂閱上層，結果和 sync 由 employees 算出來的一致
+func legacySubscriptions(docs []legacyChannel) map[string]map[string]bool {
+	channelsOf := make(map[string]map[string]bool)
+	for _, d := range docs {
+		rid := d.treeId()
+		for _, uid := range d.Members {
+			if channelsOf[uid] == nil {
+				channelsOf[uid] = make(map[string]bool)
+			}
+			channelsOf[uid][rid] = true
+		}
+	}
+
+	members := make(map[string]map[string]bool)
+	for uid, rids := range channelsOf {
+		for rid := range rids {
+			if hasDescendantIn(rid, rids) {
+				continue
+			}
+			if members[rid] == nil {
+				members[rid] = make(map[string]bool)
+			}
+			members[rid][uid] = true
+		}
+	}
+	return members
+}
+
+func hasDescendantIn(channelId string, ids map[string]bool) bool {
+	for id := range ids {
+		if strings.HasPrefix(id, channelId+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// MigrateMembersToSubscriptions 把舊的 members 陣列搬到 subscriptions，回傳新增的 subscription 數
+// 來源為 channels (樹狀 channel 與舊的 section 平面資料) 和 channels_d (舊的 department 平面資料)，都換成樹狀 channel id
+// 用 $setOnInsert 寫入，已存在的 subscription (例如已經 mute) 不覆蓋；全部寫完才移除 members 陣列，中途失敗可以重跑
+func MigrateMembersToSubscriptions(ctx context.Context, channels, departments, subs *mongo.Collection) (int64, error) {
+	sources := []*mongo.Collection{channels, departments}
+	withMembers := bson.M{"members.0": bson.M{"$exists": true}}
+
+	var docs []legacyChannel
+	migrated := make([]bson.A, len(sources)) // 每個 collection 讀到的 _id，寫完後只清這些
+	for i, coll := range sources {
+		cur, err := coll.Find(ctx, withMembers)
+		if err != nil {
+			return 0, err
+		}
+		var rows []legacyChannel
+		if err := cur.All(ctx, &rows); err != nil {
+			return 0, err
+		}
+		for _, r := range rows {
+			migrated[i] = append(migrated[i], r.Id)
+		}
+		docs = append(docs, rows...)
+	}
+
+	now := time.Now()
+	var writes []mongo.WriteModel
+	for rid, members := range legacySubscriptions(docs) {
+		for uid := range members {
+			writes = append(writes, mongo.NewUpdateOneModel().
+				SetFilter(bson.M{"_id": rid + ":" + uid}).
+				SetUpdate(bson.M{"$setOnInsert": bson.M{
+					"rid":       rid,
+					"uid":       uid,
+					"source":    SubscriptionSourceOrg,
+					"muted":     false,
+					"synced_at": now,
+				}}).
+				SetUpsert(true))
+		}
+	}
+
+	var inserted int64
+	for len(writes) > 0 {
+		n := min(len(writes), migrateBatchSize)
+		res, err := subs.BulkWrite(ctx, writes[:n], options.BulkWrite().SetOrdered(false))
+		if err != nil {
+			return inserted, err
+		}
+		inserted += res.UpsertedCount
+		writes = writes[n:]
+	}
+
+	for i, coll := range sources {
+		if len(migrated[i]) == 0 {
+			continue
+		}
+		if _, err := coll.UpdateMany(ctx, bson.M{"_id": bson.M{"$in": migrated[i]}}, bson.M{"$unset": bson.M{"members": ""}}); err != nil {
+			return inserted, err
+		}
+	}
+	return inserted, nil
+}
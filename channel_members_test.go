@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// testMongoDatabase 需要 MONGO_URI，每個測試用自己的 database，結束時刪掉
+func testMongoDatabase(t *testing.T) *mongo.Database {
+	uri := os.Getenv("MONGO_URI")
+	if uri == "" {
+		t.Skip("MONGO_URI not set")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	require.NoError(t, err)
+	require.NoError(t, client.Ping(ctx, nil))
+
+	db := client.Database(fmt.Sprintf("channel_test_%d", time.Now().UnixNano()))
+	t.Cleanup(func() {
+		db.Drop(context.Background())
+		client.Disconnect(context.Background())
+	})
+	return db
+}
+
+// 和 mongo 筆記相同格式的舊資料
+func legacyFixture() (sections, departments []interface{}) {
+	sections = []interface{}{
+		bson.M{"_id": primitive.NewObjectID(), "type": "section", "division_id": "B", "department_id": "DB_18", "section_id": "SB_18_4",
+			"members": bson.A{"U3794", "U3784"}},
+		// section_id == department_id，直屬 department
+		bson.M{"_id": primitive.NewObjectID(), "type": "section", "division_id": "B", "department_id": "DB_18", "section_id": "DB_18",
+			"members": bson.A{"U3700"}},
+		bson.M{"_id": primitive.NewObjectID(), "type": "section", "division_id": "A", "department_id": "DA_22", "section_id": "SA_22_1",
+			"members": bson.A{"U911"}},
+	}
+	departments = []interface{}{
+		bson.M{"_id": primitive.NewObjectID(), "type": "department", "division_id": "B", "department_id": "DB_18",
+			"members": bson.A{"U3794", "U3784", "U3700"}},
+		bson.M{"_id": primitive.NewObjectID(), "type": "department", "division_id": "A", "department_id": "DA_22",
+			"members": bson.A{"U911", "U912"}},
+	}
+	return sections, departments
+}
+
+func TestLegacySubscriptions(t *testing.T) {
+	docs := []legacyChannel{
+		{Id: primitive.NewObjectID(), DivisionId: "B", DepartmentId: "DB_18", SectionId: "SB_18_4", Members: []string{"U3794", "U3784"}},
+		{Id: primitive.NewObjectID(), DivisionId: "B", DepartmentId: "DB_18", SectionId: "DB_18", Members: []string{"U3700"}},
+		{Id: primitive.NewObjectID(), DivisionId: "B", DepartmentId: "DB_18", Members: []string{"U3794", "U3784", "U3700"}},
+		{Id: "A/DA_22", Members: []string{"U912"}},
+	}
+
+	got := legacySubscriptions(docs)
+	require.Equal(t, map[string]map[string]bool{
+		"B/DB_18/SB_18_4": {"U3794": true, "U3784": true},
+		"B/DB_18":         {"U3700": true}, // 在 section 的人不重複訂閱 department
+		"A/DA_22":         {"U912": true},
+	}, got)
+}
+
+func TestMigrateMembersToSubscriptions(t *testing.T) {
+	ctx := context.Background()
+	db := testMongoDatabase(t)
+	channels, departments, subs := db.Collection("channels"), db.Collection("channels_d"), db.Collection("subscriptions")
+	require.NoError(t, EnsureSubscriptionIndexes(ctx, subs))
+
+	sections, depts := legacyFixture()
+	_, err := channels.InsertMany(ctx, sections)
+	require.NoError(t, err)
+	_, err = departments.InsertMany(ctx, depts)
+	require.NoError(t, err)
+	// 已經存在的 subscription 不覆蓋
+	_, err = subs.InsertOne(ctx, Subscription{Id: "A/DA_22:U912", ChannelId: "A/DA_22", UserId: "U912", Source: SubscriptionSourceOrg, Muted: true})
+	require.NoError(t, err)
+
+	inserted, err := MigrateMembersToSubscriptions(ctx, channels, departments, subs)
+	require.NoError(t, err)
+	require.EqualValues(t, 4, inserted)
+
+	members := func(channelId string) []string {
+		m, err := ListChannelMembers(ctx, subs, channelId, "", 100)
+		require.NoError(t, err)
+		return m
+	}
+	require.Equal(t, []string{"U3784", "U3794"}, members("B/DB_18/SB_18_4"))
+	require.Equal(t, []string{"U3700"}, members("B/DB_18"))
+	require.Equal(t, []string{"U911"}, members("A/DA_22/SA_22_1"))
+	require.Equal(t, []string{"U912"}, members("A/DA_22"))
+
+	var muted Subscription
+	require.NoError(t, subs.FindOne(ctx, bson.M{"_id": "A/DA_22:U912"}).Decode(&muted))
+	require.True(t, muted.Muted)
+
+	// 舊資料的 members 陣列已清掉，其他欄位保留
+	for _, coll := range []*mongo.Collection{channels, departments} {
+		n, err := coll.CountDocuments(ctx, bson.M{"members": bson.M{"$exists": true}})
+		require.NoError(t, err)
+		require.Zero(t, n)
+	}
+	n, err := departments.CountDocuments(ctx, bson.M{"department_id": "DB_18"})
+	require.NoError(t, err)
+	require.EqualValues(t, 1, n)
+
+	// 重跑不會新增
+	inserted, err = MigrateMembersToSubscriptions(ctx, channels, departments, subs)
+	require.NoError(t, err)
+	require.Zero(t, inserted)
+	total, err := subs.CountDocuments(ctx, bson.M{})
+	require.NoError(t, err)
+	require.EqualValues(t, 5, total)
+}
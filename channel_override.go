@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type OverrideAction string
+
+const (
+	OverrideInclude OverrideAction = "include" // 例如外包人員不在 employees 內，手動加入
+	OverrideExclude OverrideAction = "exclude" // 手動移除或使用者自行退出
+)
+
+// ChannelOverride 對自動同步成員的手動調整，sync 計算 desired state 時套用，所以不會被 sync 蓋掉
+type ChannelOverride struct {
+	Id        string         `bson:"_id" json:"id"` // {rid}:{uid}
+	ChannelId string         `bson:"rid" json:"rid"`
+	UserId    string         `bson:"uid" json:"uid"`
+	Action    OverrideAction `bson:"action" json:"action"`
+	Reason    string         `bson:"reason,omitempty" json:"reason,omitempty"`
+	CreatedBy string         `bson:"created_by" json:"createdBy"`
+	CreatedAt time.Time      `bson:"created_at" json:"createdAt"`
+}
+
+// ChannelPolicy 每種 channel type 的規則，存在 channel_policies，_id 為 type
+type ChannelPolicy struct {
+	Type       ChannelType `bson:"_id" json:"type"`
+	AllowLeave bool        `bson:"allow_leave" json:"allowLeave"`
+}
+
+// 組織 channel 預設不能退出 (只能靜音)，rule channel 可以
+var DefaultChannelPolicies = map[ChannelType]ChannelPolicy{
+	ChannelTypeDivision:   {Type: ChannelTypeDivision, AllowLeave: false},
+	ChannelTypeDepartment: {Type: ChannelTypeDepartment, AllowLeave: false},
+	ChannelTypeSection:    {Type: ChannelTypeSection, AllowLeave: false},
+	ChannelTypeRule:       {Type: ChannelTypeRule, AllowLeave: true},
+}
+
+var ErrLeaveNotAllowed = errors.New("leaving this channel is not allowed, mute it instead")
+
+// ApplyChannelOverrides 把手動調整套進 desired state
+// include 只對仍存在的 channel 生效，不會讓已封存的 channel 復活
+func ApplyChannelOverrides(desired ChannelState, overrides []ChannelOverride) {
+	for _, o := range overrides {
+		if _, ok := desired.Channels[o.ChannelId]; !ok {
+			continue
+		}
+		switch o.Action {
+		case OverrideInclude:
+			desired.addMember(o.ChannelId, o.UserId)
+		case OverrideExclude:
+			delete(desired.Members[o.ChannelId], o.UserId)
+		}
+	}
+}
+
+func LoadChannelOverrides(ctx context.Context, coll *mongo.Collection) ([]ChannelOverride, error) {
+	cur, err := coll.Find(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	var overrides []ChannelOverride
+	if err := cur.All(ctx, &overrides); err != nil {
+		return nil, err
+	}
+	return overrides, nil
+}
+
+// SetChannelOverride 新增或覆寫某人在某 channel 的 override，下次 sync 生效
+func SetChannelOverride(ctx context.Context, coll *mongo.Collection, o ChannelOverride) error {
+	o.Id = o.ChannelId + ":" + o.UserId
+	if o.CreatedAt.IsZero() {
+		o.CreatedAt = time.Now()
+	}
+	_, err := coll.ReplaceOne(ctx, bson.M{"_id": o.Id}, o, options.Replace().SetUpsert(true))
+	return err
+}
+
+// ClearChannelOverride 移除 override，下次 sync 回到依組織資料決定
+func ClearChannelOverride(ctx context.Context, coll *mongo.Collection, channelId, userId string) error {
+	_, err := coll.DeleteOne(ctx, bson.M{"_id": channelId + ":" + userId})
+	return err
+}
+
+// GetChannelPolicy 讀 channel_policies，沒設定時用 DefaultChannelPolicies
+func GetChannelPolicy(ctx context.Context, coll *mongo.Collection, channelType ChannelType) (ChannelPolicy, error) {
+	var policy ChannelPolicy
+	err := coll.FindOne(ctx, bson.M{"_id": channelType}).Decode(&policy)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return DefaultChannelPolicies[channelType], nil
+	}
+	return policy, err
+}
+
+func SetChannelPolicy(ctx context.Context, coll *mongo.Collection, policy ChannelPolicy) error {
+	_, err := coll.ReplaceOne(ctx, bson.M{"_id": policy.Type}, policy, options.Replace().SetUpsert(true))
+	return err
+}
+
+// LeaveChannel 使用者自行退出：依 policy 檢查，允許的話寫 exclude override 並馬上移除 subscription
+// 不允許退出的 channel 回 ErrLeaveNotAllowed，由前端改提示靜音
+func LeaveChannel(ctx context.Context, channels, subs, overrides, policies *mongo.Collection, channelId, userId string) error {
+	var c Channel
+	if err := channels.FindOne(ctx, bson.M{"_id": channelId}).Decode(&c); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return ErrChannelNotFound
+		}
+		return err
+	}
+
+	policy, err := GetChannelPolicy(ctx, policies, c.Type)
+	if err != nil {
+		return err
+	}
+	if !policy.AllowLeave {
+		return ErrLeaveNotAllowed
+	}
+
+	if err := SetChannelOverride(ctx, overrides, ChannelOverride{
+		ChannelId: channelId,
+		UserId:    userId,
+		Action:    OverrideExclude,
+		Reason:    "left",
+		CreatedBy: userId,
+	}); err != nil {
+		return err
+	}
+	_, err = subs.DeleteOne(ctx, bson.M{"rid": channelId, "uid": userId})
+	return err
+}
+
+// MuteChannel 靜音只改 subscription 上的旗標，sync 更新 subscription 時不會動到這個欄位
+func MuteChannel(ctx context.Context, subs *mongo.Collection, channelId, userId string, muted bool) error {
+	res, err := subs.UpdateOne(ctx, bson.M{"rid": channelId, "uid": userId}, bson.M{"$set": bson.M{"muted": muted}})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return errors.New("subscription not found")
+	}
+	return nil
+}
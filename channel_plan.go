@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ChannelPlan channel sync 的變更計畫，plan 產生後可以存成 JSON 給人 review，再用 apply 套用
+type ChannelPlan struct {
+	GeneratedAt      time.Time          `json:"generatedAt"`
+	Divisions        []string           `json:"divisions"`
+	BaseFingerprint  string             `json:"baseFingerprint"` // 產生 plan 時 DB 狀態的 hash，apply 前比對
+	NewChannels      []Channel          `json:"newChannels"`
+	ArchivedChannels []string           `json:"archivedChannels"`
+	OwnerChanges     []OwnerChange      `json:"ownerChanges"`
+	MemberChanges    []MembershipChange `json:"memberChanges"`
+}
+
+type OwnerChange struct {
+	ChannelId string `json:"channelId"`
+	From      string `json:"from"`
+	To        string `json:"to"`
+}
+
+type MembershipChange struct {
+	ChannelId string   `json:"channelId"`
+	Joins     []string `json:"joins,omitempty"`
+	Leaves    []string `json:"leaves,omitempty"`
+}
+
+func (p ChannelPlan) IsEmpty() bool {
+	return len(p.NewChannels) == 0 && len(p.ArchivedChannels) == 0 &&
+		len(p.OwnerChanges) == 0 && len(p.MemberChanges) == 0
+}
+
+// ComputeChannelPlan 比對 desired 與 current，只算差異不寫 DB
+// 已封存的 channel 若又出現在 desired 裡，視為新 channel 重新啟用
+func ComputeChannelPlan(desired, current ChannelState) ChannelPlan {
+	plan := ChannelPlan{
+		GeneratedAt:      time.Now(),
+		BaseFingerprint:  current.Fingerprint(),
+		NewChannels:      []Channel{},
+		ArchivedChannels: []string{},
+		OwnerChanges:     []OwnerChange{},
+		MemberChanges:    []MembershipChange{},
+	}
+
+	for _, id := range sortedChannelIds(desired.Channels) {
+		want := desired.Channels[id]
+		have, ok := current.Channels[id]
+		if !ok || have.Archived {
+			plan.NewChannels = append(plan.NewChannels, want)
+			continue
+		}
+		if have.Owner != want.Owner {
+			plan.OwnerChanges = append(plan.OwnerChanges, OwnerChange{ChannelId: id, From: have.Owner, To: want.Owner})
+		}
+	}
+
+	for _, id := range sortedChannelIds(current.Channels) {
+		if _, ok := desired.Channels[id]; !ok && !current.Channels[id].Archived {
+			plan.ArchivedChannels = append(plan.ArchivedChannels, id)
+		}
+	}
+
+	ids := make(map[string]bool)
+	for id := range desired.Members {
+		ids[id] = true
+	}
+	for id := range current.Members {
+		ids[id] = true
+	}
+	for _, id := range sortedKeys(ids) {
+		change := MembershipChange{ChannelId: id}
+		for _, uid := range sortedKeys(desired.Members[id]) {
+			if !current.Members[id][uid] {
+				change.Joins = append(change.Joins, uid)
+			}
+		}
+		for _, uid := range sortedKeys(current.Members[id]) {
+			if !desired.Members[id][uid] {
+				change.Leaves = append(change.Leaves, uid)
+			}
+		}
+		if len(change.Joins) > 0 || len(change.Leaves) > 0 {
+			plan.MemberChanges = append(plan.MemberChanges, change)
+		}
+	}
+	return plan
+}
+
+// Fingerprint 對 channel owner/封存狀態與成員做 hash，用來判斷 plan 產生後 DB 是否被改過
+func (s ChannelState) Fingerprint() string {
+	h := sha256.New()
+	for _, id := range sortedChannelIds(s.Channels) {
+		c := s.Channels[id]
+		fmt.Fprintf(h, "c|%s|%s|%t\n", id, c.Owner, c.Archived)
+	}
+	for _, id := range sortedKeys(mapKeys(s.Members)) {
+		for _, uid := range sortedKeys(s.Members[id]) {
+			fmt.Fprintf(h, "m|%s|%s\n", id, uid)
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// LoadChannelState 讀出 DB 內目前 sync 範圍 (指定 division 與 rule channel) 的 channel 與 org 來源的 subscription
+func LoadChannelState(ctx context.Context, channels, subs *mongo.Collection, divisions []string) (ChannelState, error) {
+	state := NewChannelState()
+	inScope := bson.M{"$in": bson.A{
+		primitive.Regex{Pattern: divisionPrefixRegex(divisions)},
+		primitive.Regex{Pattern: "^" + regexp.QuoteMeta(RuleChannelPrefix)},
+	}}
+
+	cur, err := channels.Find(ctx, bson.M{"_id": inScope})
+	if err != nil {
+		return state, err
+	}
+	var rows []Channel
+	if err := cur.All(ctx, &rows); err != nil {
+		return state, err
+	}
+	for _, c := range rows {
+		state.Channels[c.Id] = c
+	}
+
+	cur, err = subs.Find(ctx,
+		bson.M{"rid": inScope, "source": SubscriptionSourceOrg},
+		options.Find().SetProjection(bson.D{{Key: "rid", Value: 1}, {Key: "uid", Value: 1}}),
+	)
+	if err != nil {
+		return state, err
+	}
+	defer cur.Close(ctx)
+	for cur.Next(ctx) {
+		var sub Subscription
+		if err := cur.Decode(&sub); err != nil {
+			return state, err
+		}
+		state.addMember(sub.ChannelId, sub.UserId)
+	}
+	return state, cur.Err()
+}
+
+// PlanChannelSync 讀 employees、rules、overrides 與目前 DB 狀態，產生 plan
+func PlanChannelSync(ctx context.Context, employees, channels, subs, rules, overrides *mongo.Collection, divisions []string) (ChannelPlan, error) {
+	rows, err := LoadEmployees(ctx, employees, divisions)
+	if err != nil {
+		return ChannelPlan{}, err
+	}
+	ruleRows, err := LoadChannelRules(ctx, rules)
+	if err != nil {
+		return ChannelPlan{}, err
+	}
+	overrideRows, err := LoadChannelOverrides(ctx, overrides)
+	if err != nil {
+		return ChannelPlan{}, err
+	}
+	current, err := LoadChannelState(ctx, channels, subs, divisions)
+	if err != nil {
+		return ChannelPlan{}, err
+	}
+
+	desired := BuildChannelTree(rows)
+	if err := ApplyChannelRules(desired, rows, ruleRows); err != nil {
+		return ChannelPlan{}, err
+	}
+	ApplyChannelOverrides(desired, overrideRows)
+	plan := ComputeChannelPlan(desired, current)
+	plan.Divisions = divisions
+	return plan, nil
+}
+
+var ErrPlanOutdated = errors.New("channel state changed since plan was generated, re-run plan or use -force")
+
+// ApplyChannelPlan 套用 plan，force=false 時先確認 DB 狀態和產生 plan 時一致
+func ApplyChannelPlan(ctx context.Context, channels, subs *mongo.Collection, plan ChannelPlan, force bool) error {
+	if !force {
+		current, err := LoadChannelState(ctx, channels, subs, plan.Divisions)
+		if err != nil {
+			return err
+		}
+		if current.Fingerprint() != plan.BaseFingerprint {
+			return ErrPlanOutdated
+		}
+	}
+
+	var channelWrites []mongo.WriteModel
+	for _, c := range plan.NewChannels {
+		channelWrites = append(channelWrites, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"_id": c.Id}).
+			SetUpdate(bson.M{
+				"$set": bson.M{
+					"type":          c.Type,
+					"division_id":   c.DivisionId,
+					"department_id": c.DepartmentId,
+					"section_id":    c.SectionId,
+					"parent_id":     c.ParentId,
+					"ancestors":     c.Ancestors,
+					"rule_id":       c.RuleId,
+					"owner":         c.Owner,
+					"archived":      false,
+				},
+				"$setOnInsert": bson.M{"rollup": false},
+			}).
+			SetUpsert(true))
+	}
+	for _, id := range plan.ArchivedChannels {
+		channelWrites = append(channelWrites, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"_id": id}).
+			SetUpdate(bson.M{"$set": bson.M{"archived": true}}))
+	}
+	for _, oc := range plan.OwnerChanges {
+		channelWrites = append(channelWrites, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"_id": oc.ChannelId}).
+			SetUpdate(bson.M{"$set": bson.M{"owner": oc.To}}))
+	}
+	if len(channelWrites) > 0 {
+		if _, err := channels.BulkWrite(ctx, channelWrites, options.BulkWrite().SetOrdered(false)); err != nil {
+			return err
+		}
+	}
+
+	now := time.Now()
+	var subWrites []mongo.WriteModel
+	for _, mc := range plan.MemberChanges {
+		for _, uid := range mc.Joins {
+			subWrites = append(subWrites, mongo.NewUpdateOneModel().
+				SetFilter(bson.M{"_id": mc.ChannelId + ":" + uid}).
+				SetUpdate(bson.M{"$set": bson.M{
+					"rid":       mc.ChannelId,
+					"uid":       uid,
+					"source":    SubscriptionSourceOrg,
+					"synced_at": now,
+				}}).
+				SetUpsert(true))
+		}
+		if len(mc.Leaves) > 0 {
+			subWrites = append(subWrites, mongo.NewDeleteManyModel().
+				SetFilter(bson.M{"rid": mc.ChannelId, "uid": bson.M{"$in": mc.Leaves}, "source": SubscriptionSourceOrg}))
+		}
+	}
+	if len(subWrites) > 0 {
+		if _, err := subs.BulkWrite(ctx, subWrites, options.BulkWrite().SetOrdered(false)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PrintPlan 以文字格式輸出 plan
+func PrintPlan(w io.Writer, plan ChannelPlan) {
+	for _, c := range plan.NewChannels {
+		fmt.Fprintf(w, "+ channel %s (%s) owner=%s\n", c.Id, c.Type, c.Owner)
+	}
+	for _, id := range plan.ArchivedChannels {
+		fmt.Fprintf(w, "- archive %s\n", id)
+	}
+	for _, oc := range plan.OwnerChanges {
+		fmt.Fprintf(w, "~ owner %s: %s -> %s\n", oc.ChannelId, oc.From, oc.To)
+	}
+
+	joins, leaves := 0, 0
+	for _, mc := range plan.MemberChanges {
+		fmt.Fprintf(w, "~ members %s: +%d -%d\n", mc.ChannelId, len(mc.Joins), len(mc.Leaves))
+		for _, uid := range mc.Joins {
+			fmt.Fprintf(w, "    + %s\n", uid)
+		}
+		for _, uid := range mc.Leaves {
+			fmt.Fprintf(w, "    - %s\n", uid)
+		}
+		joins += len(mc.Joins)
+		leaves += len(mc.Leaves)
+	}
+
+	if plan.IsEmpty() {
+		fmt.Fprintln(w, "No changes. Channels are up-to-date.")
+		return
+	}
+	fmt.Fprintf(w, "\nPlan: %d to create, %d to archive, %d owner changes, %d joins, %d leaves\n",
+		len(plan.NewChannels), len(plan.ArchivedChannels), len(plan.OwnerChanges), joins, leaves)
+}
+
+func sortedChannelIds(m map[string]Channel) []string {
+	ids := make([]string, 0, len(m))
+	for id := range m {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func mapKeys(m map[string]map[string]bool) map[string]bool {
+	keys := make(map[string]bool, len(m))
+	for k := range m {
+		keys[k] = true
+	}
+	return keys
+}
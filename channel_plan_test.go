@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestComputeChannelPlan(t *testing.T) {
+	desired := BuildChannelTree(testEmployees())
+
+	current := NewChannelState()
+	for id, c := range desired.Channels {
+		current.Channels[id] = c
+	}
+	for id, members := range desired.Members {
+		for uid := range members {
+			current.addMember(id, uid)
+		}
+	}
+
+	require.True(t, ComputeChannelPlan(desired, current).IsEmpty())
+
+	// 舊 section 要封存、SA 少了 UZ 多了 UX、SB owner 不同、SC 還沒建立
+	current.Channels["DDA/DA/SX"] = Channel{Id: "DDA/DA/SX", Type: ChannelTypeSection}
+	current.addMember("DDA/DA/SX", "UX")
+	delete(current.Members["DDA/DA/SA"], "UZ")
+	current.addMember("DDA/DA/SA", "UX")
+	sb := current.Channels["DDA/DA/SB"]
+	sb.Owner = "UW"
+	current.Channels["DDA/DA/SB"] = sb
+	delete(current.Channels, "DDA/DB/SC")
+
+	plan := ComputeChannelPlan(desired, current)
+
+	require.Len(t, plan.NewChannels, 1)
+	require.Equal(t, "DDA/DB/SC", plan.NewChannels[0].Id)
+	require.Equal(t, []string{"DDA/DA/SX"}, plan.ArchivedChannels)
+	require.Equal(t, []OwnerChange{{ChannelId: "DDA/DA/SB", From: "UW", To: "UA"}}, plan.OwnerChanges)
+	require.Equal(t, []MembershipChange{
+		{ChannelId: "DDA/DA/SA", Joins: []string{"UZ"}, Leaves: []string{"UX"}},
+		{ChannelId: "DDA/DA/SX", Leaves: []string{"UX"}},
+	}, plan.MemberChanges)
+	require.Equal(t, current.Fingerprint(), plan.BaseFingerprint)
+
+	var buf bytes.Buffer
+	PrintPlan(&buf, plan)
+	require.Contains(t, buf.String(), "+ channel DDA/DB/SC (section) owner=UD")
+	require.Contains(t, buf.String(), "Plan: 1 to create, 1 to archive, 1 owner changes, 1 joins, 2 leaves")
+}
+
+func TestComputeChannelPlan_Overrides(t *testing.T) {
+	employees := testEmployees()
+	desired := BuildChannelTree(employees)
+	ApplyChannelOverrides(desired, []ChannelOverride{
+		{ChannelId: "DDA/DA/SA", UserId: "CX", Action: OverrideInclude},
+		{ChannelId: "DDA/DA/SA", UserId: "UZ", Action: OverrideExclude},
+		// 已不存在的 channel 不會被 include 建回來
+		{ChannelId: "DDA/DA/SX", UserId: "CX", Action: OverrideInclude},
+	})
+
+	current := BuildChannelTree(employees)
+	plan := ComputeChannelPlan(desired, current)
+
+	require.Empty(t, plan.NewChannels)
+	require.Equal(t, []MembershipChange{
+		{ChannelId: "DDA/DA/SA", Joins: []string{"CX"}, Leaves: []string{"UZ"}},
+	}, plan.MemberChanges)
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	ChannelTypeRule   ChannelType = "rule"
+	RuleChannelPrefix             = "rule/"
+)
+
+// ChannelRule 自訂的動態 channel，成員由 filter 決定，每次 sync 重新計算
+// filter 存成 JSON 字串 (Mongo 舊版不允許 $ 開頭的欄位名稱)，語法類似 Mongo query:
+//
+//	{"function_id": "FA", "is_manager": true}
+//	{"division_id": "A", "supervisor": "UB"}
+//	{"$or": [{"section_id": {"$in": ["SA", "SB"]}}, {"channel_owner": "UB"}]}
+//
+// 可用欄位見 employeeFields
+type ChannelRule struct {
+	Id     string `bson:"_id" json:"id"`
+	Name   string `bson:"name" json:"name"`
+	Filter string `bson:"filter" json:"filter"`
+	Owner  string `bson:"owner" json:"owner"`
+}
+
+func ruleChannelId(ruleId string) string {
+	return RuleChannelPrefix + ruleId
+}
+
+// employeeFields 給 rule 比對用的員工欄位，除了 employees 原始欄位外，還有由 channel 樹算出來的主管資料
+//
+//	level          直屬的層級 division / department / section
+//	home_channel   直屬的 channel id
+//	channel_owner  直屬 channel 的 owner (解析出來的主管)
+//	is_manager     是否為任一 org channel 的 owner
+//	owns           擔任 owner 的 channel id 清單
+func employeeFields(e Employee, tree ChannelState, owned map[string][]string) map[string]interface{} {
+	home := employeeChannelId(e)
+	owns := owned[e.AccountId]
+	if owns == nil {
+		owns = []string{}
+	}
+	return map[string]interface{}{
+		"account_id":    e.AccountId,
+		"division_id":   e.DivisionId,
+		"department_id": e.DepartmentId,
+		"section_id":    e.SectionId,
+		"function_id":   e.FunctionId,
+		"supervisor":    e.Supervisor,
+		"level":         string(employeeLevel(e)),
+		"home_channel":  home,
+		"channel_owner": tree.Channels[home].Owner,
+		"is_manager":    len(owns) > 0,
+		"owns":          owns,
+	}
+}
+
+// ApplyChannelRules 把 rule channel 與成員加進 desired state，tree 需先由 BuildChannelTree 算好 owner
+func ApplyChannelRules(tree ChannelState, employees []Employee, rules []ChannelRule) error {
+	owned := make(map[string][]string)
+	for _, id := range sortedChannelIds(tree.Channels) {
+		if c := tree.Channels[id]; c.Owner != "" && c.Type != ChannelTypeRule {
+			owned[c.Owner] = append(owned[c.Owner], id)
+		}
+	}
+
+	filters := make([]map[string]interface{}, len(rules))
+	for i, r := range rules {
+		f, err := ParseRuleFilter(r.Filter)
+		if err != nil {
+			return fmt.Errorf("rule %s: %w", r.Id, err)
+		}
+		filters[i] = f
+
+		id := ruleChannelId(r.Id)
+		tree.Channels[id] = Channel{Id: id, Type: ChannelTypeRule, RuleId: r.Id, Owner: r.Owner, Ancestors: []string{}}
+	}
+
+	for _, e := range employees {
+		fields := employeeFields(e, tree, owned)
+		for i, r := range rules {
+			ok, err := matchRuleFilter(filters[i], fields)
+			if err != nil {
+				return fmt.Errorf("rule %s: %w", r.Id, err)
+			}
+			if ok {
+				tree.addMember(ruleChannelId(r.Id), e.AccountId)
+			}
+		}
+	}
+	return nil
+}
+
+// ParseRuleFilter 解析並檢查 filter，有不支援的運算子或欄位會直接回錯，避免存了之後每次 sync 都失敗
+func ParseRuleFilter(raw string) (map[string]interface{}, error) {
+	var filter map[string]interface{}
+	if err := json.Unmarshal([]byte(raw), &filter); err != nil {
+		return nil, fmt.Errorf("invalid filter: %w", err)
+	}
+	if _, err := matchRuleFilter(filter, employeeFields(Employee{}, NewChannelState(), nil)); err != nil {
+		return nil, err
+	}
+	return filter, nil
+}
+
+// matchRuleFilter 支援 $and / $or / $eq / $ne / $in / $nin，陣列欄位只要任一元素符合即算符合 (同 Mongo)
+func matchRuleFilter(filter map[string]interface{}, fields map[string]interface{}) (bool, error) {
+	// 固定順序，錯誤訊息才穩定
+	keys := make([]string, 0, len(filter))
+	for k := range filter {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	// 不提前 return，才能把後面欄位的語法錯誤在 ParseRuleFilter 時就擋下來
+	result := true
+	for _, key := range keys {
+		cond := filter[key]
+		var ok bool
+		var err error
+		switch key {
+		case "$and", "$or":
+			ok, err = matchLogical(key, cond, fields)
+		default:
+			if strings.HasPrefix(key, "$") {
+				return false, fmt.Errorf("unsupported operator %s", key)
+			}
+			value, exists := fields[key]
+			if !exists {
+				return false, fmt.Errorf("unknown field %s", key)
+			}
+			ok, err = matchField(value, cond)
+		}
+		if err != nil {
+			return false, err
+		}
+		result = result && ok
+	}
+	return result, nil
+}
+
+func matchLogical(op string, cond interface{}, fields map[string]interface{}) (bool, error) {
+	list, ok := cond.([]interface{})
+	if !ok || len(list) == 0 {
+		return false, fmt.Errorf("%s expects a non-empty array", op)
+	}
+	result := op == "$and"
+	for _, item := range list {
+		sub, ok := item.(map[string]interface{})
+		if !ok {
+			return false, fmt.Errorf("%s expects an array of objects", op)
+		}
+		matched, err := matchRuleFilter(sub, fields)
+		if err != nil {
+			return false, err
+		}
+		if op == "$and" {
+			result = result && matched
+		} else {
+			result = result || matched
+		}
+	}
+	return result, nil
+}
+
+func matchField(value, cond interface{}) (bool, error) {
+	ops, ok := cond.(map[string]interface{})
+	if !ok {
+		return valueEquals(value, cond), nil
+	}
+	result := true
+	for op, arg := range ops {
+		var ok bool
+		switch op {
+		case "$eq":
+			ok = valueEquals(value, arg)
+		case "$ne":
+			ok = !valueEquals(value, arg)
+		case "$in", "$nin":
+			list, isList := arg.([]interface{})
+			if !isList {
+				return false, fmt.Errorf("%s expects an array", op)
+			}
+			for _, candidate := range list {
+				if valueEquals(value, candidate) {
+					ok = true
+					break
+				}
+			}
+			if op == "$nin" {
+				ok = !ok
+			}
+		default:
+			return false, fmt.Errorf("unsupported operator %s", op)
+		}
+		result = result && ok
+	}
+	return result, nil
+}
+
+func valueEquals(value, want interface{}) bool {
+	if list, ok := value.([]string); ok {
+		for _, v := range list {
+			if v == want {
+				return true
+			}
+		}
+		return false
+	}
+	return reflect.DeepEqual(value, want)
+}
+
+// SaveChannelRule 新增或更新 rule，存之前先檢查 filter
+func SaveChannelRule(ctx context.Context, coll *mongo.Collection, rule ChannelRule) error {
+	if _, err := ParseRuleFilter(rule.Filter); err != nil {
+		return err
+	}
+	_, err := coll.ReplaceOne(ctx, bson.M{"_id": rule.Id}, rule, options.Replace().SetUpsert(true))
+	return err
+}
+
+// DeleteChannelRule 刪掉 rule，下次 sync 時對應的 channel 會被封存
+func DeleteChannelRule(ctx context.Context, coll *mongo.Collection, ruleId string) error {
+	_, err := coll.DeleteOne(ctx, bson.M{"_id": ruleId})
+	return err
+}
+
+func LoadChannelRules(ctx context.Context, coll *mongo.Collection) ([]ChannelRule, error) {
+	cur, err := coll.Find(ctx, bson.M{}, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	var rules []ChannelRule
+	if err := cur.All(ctx, &rules); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
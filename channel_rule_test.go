@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestApplyChannelRules(t *testing.T) {
+	employees := testEmployees()
+	for i := range employees {
+		employees[i].FunctionId = "FA"
+	}
+	employees = append(employees, Employee{AccountId: "UF", DivisionId: "DDB", DepartmentId: "DDB", SectionId: "DDB", FunctionId: "FB", Supervisor: "UG"})
+
+	tree := BuildChannelTree(employees)
+	err := ApplyChannelRules(tree, employees, []ChannelRule{
+		{Id: "fa-managers", Filter: `{"function_id": "FA", "is_manager": true}`, Owner: "UC"},
+		{Id: "dda-ub", Filter: `{"division_id": "DDA", "supervisor": "UB"}`},
+		{Id: "sa-or-owned-by-ud", Filter: `{"$or": [{"section_id": {"$in": ["SA"]}}, {"channel_owner": "UD"}]}`},
+		{Id: "not-fa", Filter: `{"function_id": {"$ne": "FA"}}`},
+	})
+	require.NoError(t, err)
+
+	c := tree.Channels["rule/fa-managers"]
+	require.Equal(t, ChannelTypeRule, c.Type)
+	require.Equal(t, "fa-managers", c.RuleId)
+	require.Equal(t, "UC", c.Owner)
+
+	require.Equal(t, []string{"UA", "UB", "UD"}, sortedKeys(tree.Members["rule/fa-managers"]))
+	require.Equal(t, []string{"UA", "UD"}, sortedKeys(tree.Members["rule/dda-ub"]))
+	require.Equal(t, []string{"UA", "UD", "UE", "UZ"}, sortedKeys(tree.Members["rule/sa-or-owned-by-ud"]))
+	require.Equal(t, []string{"UF"}, sortedKeys(tree.Members["rule/not-fa"]))
+}
+
+func TestParseRuleFilter(t *testing.T) {
+	_, err := ParseRuleFilter(`{"function_id": "FA", "owns": "DDA/DA"}`)
+	require.NoError(t, err)
+
+	for _, bad := range []string{
+		`not json`,
+		`{"salary": 100}`,
+		`{"function_id": {"$regex": "F.*"}}`,
+		`{"$or": []}`,
+		`{"division_id": "A", "section_id": {"$in": "SA"}}`,
+	} {
+		_, err := ParseRuleFilter(bad)
+		require.Error(t, err, bad)
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// 使用方式 (go run channel_tree.go channel_members.go channel_plan.go channel_rule.go channel_override.go channel_sync.go <command>):
+//
+//	plan [-format text|json] [-out plan.json]   只計算變更，不寫 DB
+//	apply [-force] plan.json                     套用 review 過的 plan
+//	sync                                         plan + apply 一次做完
+//	rule-save <ruleId> <name> <owner> '<filter json>'
+//	rule-preview '<filter json>'                 列出目前符合 filter 的人
+//	rule-list
+//	rule-delete <ruleId>
+//	include <channelId> <userId> [reason]        手動加入 (例如外包)，sync 不會移除
+//	exclude <channelId> <userId> [reason]        手動移除，sync 不會加回
+//	clear-override <channelId> <userId>
+//	leave <channelId> <userId>                   依 channel type policy 決定能否退出
+//	mute|unmute <channelId> <userId>
+//	policy <type> allow-leave|deny-leave
+//	migrate-members                              channels 與 channels_d 的 members 陣列搬到 subscriptions
+//	children B/DB_18
+//	ancestors B/DB_18/SB_18_4
+//	members B/DB_18/SB_18_4 [afterUserId]
+//	user-channels U3794
+//	audience B/DB_18
+//	rollup B/DB_18 on
+func main() {
+	if len(os.Args) < 2 {
+		log.Fatal("usage: channel-sync <plan|apply|sync|rule-*|include|exclude|clear-override|leave|mute|unmute|policy|migrate-members|children|ancestors|members|user-channels|audience|rollup> [args]")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI("mongodb://localhost:27017"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer client.Disconnect(ctx)
+
+	db := client.Database("testdb")
+	employees := db.Collection("employees")
+	channels := db.Collection("channels")
+	subs := db.Collection("subscriptions")
+	rules := db.Collection("channel_rules")
+	overrides := db.Collection("channel_overrides")
+	policies := db.Collection("channel_policies")
+
+	if err := EnsureSubscriptionIndexes(ctx, subs); err != nil {
+		log.Fatal(err)
+	}
+
+	divisions := []string{"A", "B"}
+
+	cmd, args := os.Args[1], os.Args[2:]
+	switch cmd {
+	case "plan":
+		fs := flag.NewFlagSet("plan", flag.ExitOnError)
+		format := fs.String("format", "text", "output format: text or json")
+		out := fs.String("out", "", "write plan JSON to file for later apply")
+		fs.Parse(args)
+
+		plan, err := PlanChannelSync(ctx, employees, channels, subs, rules, overrides, divisions)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if *out != "" {
+			if err := writePlanFile(*out, plan); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if *format == "json" {
+			printJSON(plan)
+		} else {
+			PrintPlan(os.Stdout, plan)
+		}
+		return
+
+	case "apply":
+		fs := flag.NewFlagSet("apply", flag.ExitOnError)
+		force := fs.Bool("force", false, "apply even if channel state changed since plan")
+		fs.Parse(args)
+		if fs.NArg() < 1 {
+			log.Fatal("apply: missing plan file")
+		}
+
+		plan, err := readPlanFile(fs.Arg(0))
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := ApplyChannelPlan(ctx, channels, subs, plan, *force); err != nil {
+			log.Fatal(err)
+		}
+		PrintPlan(os.Stdout, plan)
+		return
+
+	case "sync":
+		plan, err := PlanChannelSync(ctx, employees, channels, subs, rules, overrides, divisions)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := ApplyChannelPlan(ctx, channels, subs, plan, false); err != nil {
+			log.Fatal(err)
+		}
+		PrintPlan(os.Stdout, plan)
+		return
+
+	case "migrate-members":
+		inserted, err := MigrateMembersToSubscriptions(ctx, channels, db.Collection("channels_d"), subs)
+		if err != nil {
+			log.Fatal(err)
+		}
+		printJSON(map[string]int64{"inserted": inserted})
+		return
+
+	case "rule-list":
+		list, err := LoadChannelRules(ctx, rules)
+		if err != nil {
+			log.Fatal(err)
+		}
+		printJSON(list)
+		return
+
+	case "rule-save":
+		if len(args) < 4 {
+			log.Fatal("rule-save: usage rule-save <ruleId> <name> <owner> <filter json>")
+		}
+		rule := ChannelRule{Id: args[0], Name: args[1], Owner: args[2], Filter: args[3]}
+		if err := SaveChannelRule(ctx, rules, rule); err != nil {
+			log.Fatal(err)
+		}
+		printJSON(rule)
+		return
+
+	case "rule-preview":
+		if len(args) < 1 {
+			log.Fatal("rule-preview: missing filter")
+		}
+		rows, err := LoadEmployees(ctx, employees, divisions)
+		if err != nil {
+			log.Fatal(err)
+		}
+		tree := BuildChannelTree(rows)
+		if err := ApplyChannelRules(tree, rows, []ChannelRule{{Id: "preview", Filter: args[0]}}); err != nil {
+			log.Fatal(err)
+		}
+		printJSON(sortedKeys(tree.Members[ruleChannelId("preview")]))
+		return
+	}
+
+	if len(args) < 1 {
+		log.Fatalf("%s: missing id", cmd)
+	}
+
+	var result interface{}
+	switch cmd {
+	case "include", "exclude":
+		if len(args) < 2 {
+			log.Fatalf("%s: missing userId", cmd)
+		}
+		o := ChannelOverride{ChannelId: args[0], UserId: args[1], Action: OverrideAction(cmd), CreatedBy: "admin"}
+		if len(args) > 2 {
+			o.Reason = args[2]
+		}
+		err = SetChannelOverride(ctx, overrides, o)
+		result = "ok, takes effect on next sync"
+	case "clear-override":
+		if len(args) < 2 {
+			log.Fatalf("%s: missing userId", cmd)
+		}
+		err = ClearChannelOverride(ctx, overrides, args[0], args[1])
+		result = "ok, takes effect on next sync"
+	case "leave":
+		if len(args) < 2 {
+			log.Fatalf("%s: missing userId", cmd)
+		}
+		err = LeaveChannel(ctx, channels, subs, overrides, policies, args[0], args[1])
+		result = "ok"
+	case "mute", "unmute":
+		if len(args) < 2 {
+			log.Fatalf("%s: missing userId", cmd)
+		}
+		err = MuteChannel(ctx, subs, args[0], args[1], cmd == "mute")
+		result = "ok"
+	case "policy":
+		if len(args) < 2 {
+			log.Fatalf("%s: usage policy <type> allow-leave|deny-leave", cmd)
+		}
+		err = SetChannelPolicy(ctx, policies, ChannelPolicy{Type: ChannelType(args[0]), AllowLeave: args[1] == "allow-leave"})
+		result = "ok"
+	case "rule-delete":
+		err = DeleteChannelRule(ctx, rules, args[0])
+		result = "ok"
+	case "members":
+		after := ""
+		if len(args) > 1 {
+			after = args[1]
+		}
+		result, err = ListChannelMembers(ctx, subs, args[0], after, 500)
+	case "user-channels":
+		result, err = ListUserChannels(ctx, subs, args[0])
+	case "children":
+		result, err = ListChildren(ctx, channels, args[0])
+	case "ancestors":
+		result, err = ListAncestors(ctx, channels, args[0])
+	case "audience":
+		result, err = GetAudience(ctx, channels, subs, args[0])
+	case "rollup":
+		err = SetRollup(ctx, channels, args[0], len(args) < 2 || args[1] != "off")
+		result = "ok"
+	default:
+		log.Fatalf("unknown command: %s", cmd)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	printJSON(result)
+}
+
+func printJSON(v interface{}) {
+	out, _ := json.MarshalIndent(v, "", "  ")
+	fmt.Println(string(out))
+}
+
+func writePlanFile(path string, plan ChannelPlan) error {
+	out, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, out, 0o644)
+}
+
+func readPlanFile(path string) (ChannelPlan, error) {
+	var plan ChannelPlan
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return plan, err
+	}
+	err = json.Unmarshal(data, &plan)
+	return plan, err
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sort"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+type ChannelType string
+
+const (
+	ChannelTypeDivision   ChannelType = "division"
+	ChannelTypeDepartment ChannelType = "department"
+	ChannelTypeSection    ChannelType = "section"
+)
+
+// ErrChannelNotFound channel 不存在，sync、override 和 presence 的訂閱都用這一個
+var ErrChannelNotFound = errors.New("channel not found")
+
+// Channel 單一 channels collection 內的節點
+// _id 用組織路徑表示，例如 division "B"、department "B/DB_18"、section "B/DB_18/SB_18_4"
+// 成員關係放在 subscriptions (見 channel_members.go)，上層要看到下層成員時用 rollup 計算
+type Channel struct {
+	Id           string      `bson:"_id" json:"id"`
+	Type         ChannelType `bson:"type" json:"type"`
+	DivisionId   string      `bson:"division_id" json:"divisionId"`
+	DepartmentId string      `bson:"department_id,omitempty" json:"departmentId,omitempty"`
+	SectionId    string      `bson:"section_id,omitempty" json:"sectionId,omitempty"`
+	ParentId     string      `bson:"parent_id,omitempty" json:"parentId,omitempty"`
+	Ancestors    []string    `bson:"ancestors" json:"ancestors"`
+	RuleId       string      `bson:"rule_id,omitempty" json:"ruleId,omitempty"`
+	Owner        string      `bson:"owner,omitempty" json:"owner,omitempty"`
+	Archived     bool        `bson:"archived" json:"archived"`
+	Rollup       bool        `bson:"rollup" json:"rollup"`
+}
+
+// Employee employees collection 的一筆資料
+type Employee struct {
+	AccountId    string `bson:"account_id" json:"accountId"`
+	DivisionId   string `bson:"division_id" json:"divisionId"`
+	DepartmentId string `bson:"department_id" json:"departmentId"`
+	SectionId    string `bson:"section_id" json:"sectionId"`
+	FunctionId   string `bson:"function_id" json:"functionId"`
+	Supervisor   string `bson:"supervisor" json:"supervisor"`
+}
+
+// 判斷員工實際歸屬哪一層
+// section_id == department_id 代表沒有實際的 section，直接掛在 department 底下，以此類推
+func employeeLevel(e Employee) ChannelType {
+	if e.SectionId != "" && e.SectionId != e.DepartmentId {
+		return ChannelTypeSection
+	}
+	if e.DepartmentId != "" && e.DepartmentId != e.DivisionId {
+		return ChannelTypeDepartment
+	}
+	return ChannelTypeDivision
+}
+
+// employeeChannelId 員工直屬的 channel id
+func employeeChannelId(e Employee) string {
+	switch employeeLevel(e) {
+	case ChannelTypeSection:
+		return e.DivisionId + "/" + e.DepartmentId + "/" + e.SectionId
+	case ChannelTypeDepartment:
+		return e.DivisionId + "/" + e.DepartmentId
+	}
+	return e.DivisionId
+}
+
+// ChannelState 一組 channel 與其直屬成員，desired (由 employees 算出) 和 current (DB 內) 都用這個結構
+type ChannelState struct {
+	Channels map[string]Channel         `json:"channels"`
+	Members  map[string]map[string]bool `json:"members"` // channelId -> userId set
+}
+
+func NewChannelState() ChannelState {
+	return ChannelState{
+		Channels: make(map[string]Channel),
+		Members:  make(map[string]map[string]bool),
+	}
+}
+
+func (s ChannelState) addMember(channelId, userId string) {
+	if s.Members[channelId] == nil {
+		s.Members[channelId] = make(map[string]bool)
+	}
+	s.Members[channelId][userId] = true
+}
+
+// 建立員工所在的 division / department / section 節點，回傳他直屬的 channel id
+func (s ChannelState) addEmployee(e Employee) string {
+	level := employeeLevel(e)
+
+	id := e.DivisionId
+	if _, ok := s.Channels[id]; !ok {
+		s.Channels[id] = Channel{Id: id, Type: ChannelTypeDivision, DivisionId: e.DivisionId, Ancestors: []string{}}
+	}
+	if level == ChannelTypeDivision {
+		return id
+	}
+
+	divisionId := id
+	id = divisionId + "/" + e.DepartmentId
+	if _, ok := s.Channels[id]; !ok {
+		s.Channels[id] = Channel{
+			Id:           id,
+			Type:         ChannelTypeDepartment,
+			DivisionId:   e.DivisionId,
+			DepartmentId: e.DepartmentId,
+			ParentId:     divisionId,
+			Ancestors:    []string{divisionId},
+		}
+	}
+	if level == ChannelTypeDepartment {
+		return id
+	}
+
+	departmentId := id
+	id = departmentId + "/" + e.SectionId
+	if _, ok := s.Channels[id]; !ok {
+		s.Channels[id] = Channel{
+			Id:           id,
+			Type:         ChannelTypeSection,
+			DivisionId:   e.DivisionId,
+			DepartmentId: e.DepartmentId,
+			SectionId:    e.SectionId,
+			ParentId:     departmentId,
+			Ancestors:    []string{divisionId, departmentId},
+		}
+	}
+	return id
+}
+
+// BuildChannelTree 由 employees 算出整棵 channel 樹、每個人的直屬 channel 與 channel owner
+func BuildChannelTree(employees []Employee) ChannelState {
+	state := NewChannelState()
+	home := make(map[string]string, len(employees))
+	for _, e := range employees {
+		home[e.AccountId] = state.addEmployee(e)
+		state.addMember(home[e.AccountId], e.AccountId)
+	}
+	resolveOwners(state, employees, home)
+	return state
+}
+
+// resolveOwners 由下往上 (section -> department -> division) 找每個 channel 的主管
+// 1. 直屬成員中有人管理這個 channel 底下的人，且他的主管不在直屬成員內 → 他就是 owner
+// 2. 否則統計直屬成員與子 channel owner 的 supervisor，票數最高的人是 owner (同票取 id 小的)
+func resolveOwners(state ChannelState, employees []Employee, home map[string]string) {
+	supervisorOf := make(map[string]string, len(employees))
+	for _, e := range employees {
+		supervisorOf[e.AccountId] = e.Supervisor
+	}
+
+	// channel 底下 (含子孫) 所有人的 supervisor
+	managersUnder := make(map[string]map[string]bool)
+	for _, e := range employees {
+		if e.Supervisor == "" {
+			continue
+		}
+		cid := home[e.AccountId]
+		for _, cid := range append([]string{cid}, state.Channels[cid].Ancestors...) {
+			if managersUnder[cid] == nil {
+				managersUnder[cid] = make(map[string]bool)
+			}
+			managersUnder[cid][e.Supervisor] = true
+		}
+	}
+
+	children := make(map[string][]string)
+	ids := make([]string, 0, len(state.Channels))
+	for id, c := range state.Channels {
+		ids = append(ids, id)
+		if c.ParentId != "" {
+			children[c.ParentId] = append(children[c.ParentId], id)
+		}
+	}
+	// 深的先處理，子 channel 的 owner 才會先算好
+	sort.Slice(ids, func(i, j int) bool {
+		di, dj := len(state.Channels[ids[i]].Ancestors), len(state.Channels[ids[j]].Ancestors)
+		if di != dj {
+			return di > dj
+		}
+		return ids[i] < ids[j]
+	})
+
+	for _, id := range ids {
+		direct := state.Members[id]
+
+		var heads []string
+		for uid := range direct {
+			if managersUnder[id][uid] && !direct[supervisorOf[uid]] {
+				heads = append(heads, uid)
+			}
+		}
+		if len(heads) > 0 {
+			sort.Strings(heads)
+			setOwner(state, id, heads[0])
+			continue
+		}
+
+		votes := make(map[string]int)
+		for uid := range direct {
+			if sup := supervisorOf[uid]; sup != "" {
+				votes[sup]++
+			}
+		}
+		for _, child := range children[id] {
+			if sup := supervisorOf[state.Channels[child].Owner]; sup != "" {
+				votes[sup]++
+			}
+		}
+		setOwner(state, id, majority(votes))
+	}
+}
+
+func setOwner(state ChannelState, channelId, owner string) {
+	c := state.Channels[channelId]
+	c.Owner = owner
+	state.Channels[channelId] = c
+}
+
+func majority(votes map[string]int) string {
+	winner, maxCount := "", 0
+	for k, v := range votes {
+		if v > maxCount || (v == maxCount && k < winner) {
+			winner, maxCount = k, v
+		}
+	}
+	return winner
+}
+
+// LoadEmployees 讀出指定 division 的 employees
+func LoadEmployees(ctx context.Context, coll *mongo.Collection, divisions []string) ([]Employee, error) {
+	cur, err := coll.Find(ctx, bson.M{"division_id": bson.M{"$in": divisions}})
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	var employees []Employee
+	if err := cur.All(ctx, &employees); err != nil {
+		return nil, err
+	}
+	return employees, nil
+}
+
+// ListChildren 列出直屬子 channel
+func ListChildren(ctx context.Context, coll *mongo.Collection, channelId string) ([]Channel, error) {
+	return findChannels(ctx, coll, bson.M{"parent_id": channelId})
+}
+
+// ListAncestors 依 ancestors 欄位找出上層 channel，回傳順序由近到遠 (parent, grandparent, ...)
+func ListAncestors(ctx context.Context, coll *mongo.Collection, channelId string) ([]Channel, error) {
+	c, err := findChannel(ctx, coll, channelId)
+	if err != nil || len(c.Ancestors) == 0 {
+		return nil, err
+	}
+	found, err := findChannels(ctx, coll, bson.M{"_id": bson.M{"$in": c.Ancestors}})
+	if err != nil {
+		return nil, err
+	}
+	return ancestorChain(c, found), nil
+}
+
+// AudienceChannelIds 回傳組成收訊對象的 channel id
+// rollup 關閉時只有自己；開啟時再加上所有子孫 channel (ancestors 含自己的)
+func AudienceChannelIds(ctx context.Context, coll *mongo.Collection, channelId string) ([]string, error) {
+	c, err := findChannel(ctx, coll, channelId)
+	if err != nil {
+		return nil, err
+	}
+	var descendants []Channel
+	if c.Rollup {
+		if descendants, err = findChannels(ctx, coll, bson.M{"ancestors": channelId}); err != nil {
+			return nil, err
+		}
+	}
+	return rollupChannelIds(c, descendants), nil
+}
+
+// ancestorChain 把查到的上層 channel 依 c.Ancestors (由遠到近) 反過來排，已經不存在的略過
+func ancestorChain(c Channel, found []Channel) []Channel {
+	byId := make(map[string]Channel, len(found))
+	for _, a := range found {
+		byId[a.Id] = a
+	}
+	var chain []Channel
+	for i := len(c.Ancestors) - 1; i >= 0; i-- {
+		if a, ok := byId[c.Ancestors[i]]; ok {
+			chain = append(chain, a)
+		}
+	}
+	return chain
+}
+
+// rollupChannelIds 自己排第一個，子孫依 id 排序；rollup 關閉時不看 descendants
+func rollupChannelIds(c Channel, descendants []Channel) []string {
+	ids := []string{c.Id}
+	if !c.Rollup {
+		return ids
+	}
+	for _, d := range descendants {
+		if d.Id != c.Id {
+			ids = append(ids, d.Id)
+		}
+	}
+	sort.Strings(ids[1:])
+	return ids
+}
+
+func findChannel(ctx context.Context, coll *mongo.Collection, channelId string) (Channel, error) {
+	var c Channel
+	err := coll.FindOne(ctx, bson.M{"_id": channelId}).Decode(&c)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return Channel{}, ErrChannelNotFound
+	}
+	return c, err
+}
+
+func findChannels(ctx context.Context, coll *mongo.Collection, filter bson.M) ([]Channel, error) {
+	cur, err := coll.Find(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	var channels []Channel
+	if err := cur.All(ctx, &channels); err != nil {
+		return nil, err
+	}
+	return channels, nil
+}
+
+// SetRollup 開關某個 channel 的 roll-up，sync 時不會被覆蓋
+func SetRollup(ctx context.Context, coll *mongo.Collection, channelId string, rollup bool) error {
+	res, err := coll.UpdateOne(ctx, bson.M{"_id": channelId}, bson.M{"$set": bson.M{"rollup": rollup}})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrChannelNotFound
+	}
+	return nil
+}
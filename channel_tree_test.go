@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func testEmployees() []Employee {
+	return []Employee{
+		{AccountId: "UA", DivisionId: "DDA", DepartmentId: "DA", SectionId: "SA", Supervisor: "UB"},
+		{AccountId: "UZ", DivisionId: "DDA", DepartmentId: "DA", SectionId: "SA", Supervisor: "UA"},
+		{AccountId: "UW", DivisionId: "DDA", DepartmentId: "DA", SectionId: "SB", Supervisor: "UA"},
+		{AccountId: "UB", DivisionId: "DDA", DepartmentId: "DA", SectionId: "DA", Supervisor: "UC"},
+		{AccountId: "UD", DivisionId: "DDA", DepartmentId: "DB", SectionId: "SC", Supervisor: "UB"},
+		{AccountId: "UE", DivisionId: "DDA", DepartmentId: "DB", SectionId: "SC", Supervisor: "UD"},
+	}
+}
+
+func TestBuildChannelTree(t *testing.T) {
+	state := BuildChannelTree(testEmployees())
+
+	require.ElementsMatch(t,
+		[]string{"DDA", "DDA/DA", "DDA/DB", "DDA/DA/SA", "DDA/DA/SB", "DDA/DB/SC"},
+		sortedChannelIds(state.Channels))
+
+	sc := state.Channels["DDA/DB/SC"]
+	require.Equal(t, ChannelTypeSection, sc.Type)
+	require.Equal(t, "DDA/DB", sc.ParentId)
+	require.Equal(t, []string{"DDA", "DDA/DB"}, sc.Ancestors)
+
+	// UB 的 sectId == deptId，直屬 department
+	require.Equal(t, []string{"UB"}, sortedKeys(state.Members["DDA/DA"]))
+	require.Equal(t, []string{"UA", "UZ"}, sortedKeys(state.Members["DDA/DA/SA"]))
+
+	owners := map[string]string{}
+	for id, c := range state.Channels {
+		owners[id] = c.Owner
+	}
+	require.Equal(t, "UA", owners["DDA/DA/SA"])
+	require.Equal(t, "UA", owners["DDA/DA/SB"])
+	require.Equal(t, "UD", owners["DDA/DB/SC"])
+	require.Equal(t, "UB", owners["DDA/DA"])
+	require.Equal(t, "UB", owners["DDA/DB"])
+}
+
+func TestEmployeeChannelId(t *testing.T) {
+	tests := []struct {
+		name     string
+		employee Employee
+		level    ChannelType
+		id       string
+	}{
+		{"section", Employee{DivisionId: "B", DepartmentId: "DB_18", SectionId: "SB_18_4"}, ChannelTypeSection, "B/DB_18/SB_18_4"},
+		{"no section", Employee{DivisionId: "B", DepartmentId: "DB_18", SectionId: "DB_18"}, ChannelTypeDepartment, "B/DB_18"},
+		{"empty section", Employee{DivisionId: "B", DepartmentId: "DB_18"}, ChannelTypeDepartment, "B/DB_18"},
+		{"division only", Employee{DivisionId: "B", DepartmentId: "B", SectionId: "B"}, ChannelTypeDivision, "B"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.level, employeeLevel(tt.employee))
+			require.Equal(t, tt.id, employeeChannelId(tt.employee))
+		})
+	}
+}
+
+func TestAncestorChain(t *testing.T) {
+	state := BuildChannelTree(testEmployees())
+	var all []Channel
+	for _, c := range state.Channels {
+		all = append(all, c)
+	}
+	ids := func(channels []Channel) []string {
+		var ids []string
+		for _, c := range channels {
+			ids = append(ids, c.Id)
+		}
+		return ids
+	}
+
+	// 由近到遠，和查到的順序無關
+	require.Equal(t, []string{"DDA/DA", "DDA"}, ids(ancestorChain(state.Channels["DDA/DA/SA"], all)))
+	require.Equal(t, []string{"DDA"}, ids(ancestorChain(state.Channels["DDA/DB"], all)))
+	require.Empty(t, ancestorChain(state.Channels["DDA"], all))
+	// 上層已經被刪掉的略過
+	require.Equal(t, []string{"DDA"}, ids(ancestorChain(state.Channels["DDA/DB/SC"], []Channel{state.Channels["DDA"]})))
+}
+
+func TestRollupChannelIds(t *testing.T) {
+	state := BuildChannelTree(testEmployees())
+	descendants := func(id string) []Channel {
+		var found []Channel
+		for _, c := range state.Channels {
+			for _, a := range c.Ancestors {
+				if a == id {
+					found = append(found, c)
+				}
+			}
+		}
+		return found
+	}
+
+	da := state.Channels["DDA/DA"]
+	require.Equal(t, []string{"DDA/DA"}, rollupChannelIds(da, descendants("DDA/DA")))
+	da.Rollup = true
+	require.Equal(t, []string{"DDA/DA", "DDA/DA/SA", "DDA/DA/SB"}, rollupChannelIds(da, descendants("DDA/DA")))
+
+	root := state.Channels["DDA"]
+	root.Rollup = true
+	require.Equal(t, []string{"DDA", "DDA/DA", "DDA/DA/SA", "DDA/DA/SB", "DDA/DB", "DDA/DB/SC"}, rollupChannelIds(root, descendants("DDA")))
+	// 沒有子 channel 的 section 只有自己
+	sa := state.Channels["DDA/DA/SA"]
+	sa.Rollup = true
+	require.Equal(t, []string{"DDA/DA/SA"}, rollupChannelIds(sa, descendants("DDA/DA/SA")))
+}
+
+// seedChannelTree 把 employees 算出的樹與直屬成員寫進 channels 和 subscriptions
+func seedChannelTree(t *testing.T, channels, subs *mongo.Collection, state ChannelState) {
+	ctx := context.Background()
+	var docs []interface{}
+	for _, c := range state.Channels {
+		docs = append(docs, c)
+	}
+	_, err := channels.InsertMany(ctx, docs)
+	require.NoError(t, err)
+
+	var rows []interface{}
+	for rid, members := range state.Members {
+		for uid := range members {
+			rows = append(rows, Subscription{Id: rid + ":" + uid, ChannelId: rid, UserId: uid, Source: SubscriptionSourceOrg})
+		}
+	}
+	_, err = subs.InsertMany(ctx, rows)
+	require.NoError(t, err)
+}
+
+func TestChannelTree_Navigation(t *testing.T) {
+	ctx := context.Background()
+	db := testMongoDatabase(t)
+	channels, subs := db.Collection("channels"), db.Collection("subscriptions")
+	seedChannelTree(t, channels, subs, BuildChannelTree(testEmployees()))
+
+	children, err := ListChildren(ctx, channels, "DDA/DA")
+	require.NoError(t, err)
+	var ids []string
+	for _, c := range children {
+		ids = append(ids, c.Id)
+	}
+	require.ElementsMatch(t, []string{"DDA/DA/SA", "DDA/DA/SB"}, ids)
+
+	// 由近到遠
+	ancestors, err := ListAncestors(ctx, channels, "DDA/DA/SA")
+	require.NoError(t, err)
+	require.Len(t, ancestors, 2)
+	require.Equal(t, "DDA/DA", ancestors[0].Id)
+	require.Equal(t, "DDA", ancestors[1].Id)
+	ancestors, err = ListAncestors(ctx, channels, "DDA")
+	require.NoError(t, err)
+	require.Empty(t, ancestors)
+	_, err = ListAncestors(ctx, channels, "DDA/XX")
+	require.ErrorIs(t, err, ErrChannelNotFound)
+}
+
+func TestChannelTree_Rollup(t *testing.T) {
+	ctx := context.Background()
+	db := testMongoDatabase(t)
+	channels, subs := db.Collection("channels"), db.Collection("subscriptions")
+	seedChannelTree(t, channels, subs, BuildChannelTree(testEmployees()))
+
+	// 預設只有直屬成員
+	ids, err := AudienceChannelIds(ctx, channels, "DDA/DA")
+	require.NoError(t, err)
+	require.Equal(t, []string{"DDA/DA"}, ids)
+	audience, err := GetAudience(ctx, channels, subs, "DDA/DA")
+	require.NoError(t, err)
+	require.Equal(t, []string{"UB"}, audience)
+
+	// 開啟後包含所有 section 的成員，不用複製成員
+	require.NoError(t, SetRollup(ctx, channels, "DDA/DA", true))
+	ids, err = AudienceChannelIds(ctx, channels, "DDA/DA")
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"DDA/DA", "DDA/DA/SA", "DDA/DA/SB"}, ids)
+	audience, err = GetAudience(ctx, channels, subs, "DDA/DA")
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"UB", "UA", "UZ", "UW"}, audience)
+
+	// division 的 rollup 包含所有子孫，不只下一層
+	require.NoError(t, SetRollup(ctx, channels, "DDA", true))
+	audience, err = GetAudience(ctx, channels, subs, "DDA")
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"UA", "UZ", "UW", "UB", "UD", "UE"}, audience)
+
+	// 關掉後恢復只有直屬成員，section 本身不受影響
+	require.NoError(t, SetRollup(ctx, channels, "DDA/DA", false))
+	audience, err = GetAudience(ctx, channels, subs, "DDA/DA")
+	require.NoError(t, err)
+	require.Equal(t, []string{"UB"}, audience)
+
+	require.ErrorIs(t, SetRollup(ctx, channels, "DDA/XX", true), ErrChannelNotFound)
+	_, err = AudienceChannelIds(ctx, channels, "DDA/XX")
+	require.ErrorIs(t, err, ErrChannelNotFound)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+)
+
+var ErrUnauthorized = errors.New("unauthorized")
+
+// Authenticator 在 upgrade 前驗證連線，回傳 userId
+// AuthenticateToken 給第一個 frame 才帶 token 的連線用
+type Authenticator interface {
+	Authenticate(r *http.Request) (string, error)
+	AuthenticateToken(token string) (string, error)
+}
+
+// StaticTokenAuthenticator token -> userId 對照表，開發/測試用
+type StaticTokenAuthenticator struct {
+	tokens map[string]string
+}
+
+// NewStaticTokenAuthenticatorFromEnv 從環境變數讀 token，格式 "tokenA:U1,tokenB:U2"
+func NewStaticTokenAuthenticatorFromEnv(key string) *StaticTokenAuthenticator {
+	tokens := make(map[string]string)
+	for _, pair := range strings.Split(os.Getenv(key), ",") {
+		token, userId, ok := strings.Cut(strings.TrimSpace(pair), ":")
+		if ok && token != "" && userId != "" {
+			tokens[token] = userId
+		}
+	}
+	return &StaticTokenAuthenticator{tokens: tokens}
+}
+
+// Authenticate token 可放在 Authorization: Bearer xxx 或 query ?token=xxx (瀏覽器 WebSocket 無法帶 header)
+func (a *StaticTokenAuthenticator) Authenticate(r *http.Request) (string, error) {
+	return a.AuthenticateToken(requestToken(r, []AuthMethod{AuthHeader, AuthQuery}))
+}
+
+func (a *StaticTokenAuthenticator) AuthenticateToken(token string) (string, error) {
+	userId, ok := a.tokens[token]
+	if token == "" || !ok {
+		return "", ErrUnauthorized
+	}
+	return userId, nil
+}
+
+// requestToken 依序從允許的位置取 token
+func requestToken(r *http.Request, methods []AuthMethod) string {
+	for _, m := range methods {
+		var token string
+		switch m {
+		case AuthHeader:
+			// 其他 scheme (例如 proxy 的 Basic) 不當成 token，繼續看下一個位置
+			if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+				token = bearer
+			}
+		case AuthQuery:
+			token = r.URL.Query().Get("token")
+		}
+		if token != "" {
+			return token
+		}
+	}
+	return ""
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStaticTokenAuthenticator(t *testing.T) {
+	t.Setenv("TEST_WS_TOKENS", "tokenA:U1, tokenB:U2,broken,:U3,tokenD:")
+	auth := NewStaticTokenAuthenticatorFromEnv("TEST_WS_TOKENS")
+	require.Equal(t, map[string]string{"tokenA": "U1", "tokenB": "U2"}, auth.tokens)
+
+	tests := []struct {
+		name   string
+		target string
+		header string
+		userId string
+	}{
+		{"header", "/ws", "Bearer tokenA", "U1"},
+		{"query", "/ws?token=tokenB", "", "U2"},
+		{"header wins", "/ws?token=tokenB", "Bearer tokenA", "U1"},
+		{"user id from query ignored", "/ws?token=tokenA&userId=U2", "", "U1"},
+		{"missing", "/ws?userId=U1", "", ""},
+		{"invalid", "/ws", "Bearer wrong", ""},
+		{"empty user id", "/ws", "Bearer tokenD", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", tt.target, nil)
+			if tt.header != "" {
+				r.Header.Set("Authorization", tt.header)
+			}
+			userId, err := auth.Authenticate(r)
+			if tt.userId == "" {
+				require.ErrorIs(t, err, ErrUnauthorized)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.userId, userId)
+		})
+	}
+}
+
+func TestRequestToken(t *testing.T) {
+	tests := []struct {
+		name    string
+		target  string
+		header  string
+		methods []AuthMethod
+		token   string
+	}{
+		{"header only ignores query", "/ws?token=q", "", []AuthMethod{AuthHeader}, ""},
+		{"query only ignores header", "/ws", "Bearer h", []AuthMethod{AuthQuery}, ""},
+		{"order follows methods", "/ws?token=q", "Bearer h", []AuthMethod{AuthQuery, AuthHeader}, "q"},
+		{"other scheme falls through", "/ws?token=q", "Basic dXNlcjpwYXNz", []AuthMethod{AuthHeader, AuthQuery}, "q"},
+		{"frame has nothing in request", "/ws?token=q", "Bearer h", []AuthMethod{AuthFrame}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", tt.target, nil)
+			if tt.header != "" {
+				r.Header.Set("Authorization", tt.header)
+			}
+			require.Equal(t, tt.token, requestToken(r, tt.methods))
+		})
+	}
+}
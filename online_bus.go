@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// PresenceEvent 跨節點廣播的狀態變更 (格式見 online_flow 筆記)
+// {"event": "status_change", "userId": "123", "status": "offline", "timestamp": 1695402000, "device": "mobile"}
+// View 只在節點之間使用：public 只給非聯絡人、contacts 只給聯絡人，空的給所有人，推給 client 前會拿掉
+// Custom 為變更後的自訂狀態，沒有 (或已清除、已過期) 時不帶
+type PresenceEvent struct {
+	Event     string        `json:"event"`
+	UserId    string        `json:"userId"`
+	Status    Status        `json:"status"`
+	Timestamp int64         `json:"timestamp"`
+	Device    string        `json:"device,omitempty"`
+	Custom    *CustomStatus `json:"customStatus,omitempty"`
+	View      PresenceView  `json:"view,omitempty"`
+
+	// 以下只有 EventTyping 使用，channel 由各節點自己找出本機的成員，一對一送給 To
+	ChannelId string `json:"channelId,omitempty"`
+	To        string `json:"to,omitempty"`
+	Typing    bool   `json:"typing,omitempty"`
+}
+
+const (
+	EventStatusChange = "status_change"
+
+	// presenceSubject NATS subject / Redis channel 名稱
+	presenceSubject = "presence.events"
+)
+
+// PresenceBus 節點之間傳遞狀態變更，發布的節點自己也會收到，統一由 Subscribe 的 handler 轉發給本機 client
+type PresenceBus interface {
+	Publish(ctx context.Context, e PresenceEvent) error
+	Subscribe(handler func(PresenceEvent)) (unsubscribe func(), err error)
+	Close() error
+}
+
+func newStatusChangeEvent(p Presence) PresenceEvent {
+	ts := p.Since
+	if p.Status == StatusOffline {
+		ts = p.LastSeen
+	}
+	return PresenceEvent{Event: EventStatusChange, UserId: p.UserId, Status: p.Status, Timestamp: ts, Device: p.Device, Custom: p.Custom}
+}
+
+// LocalPresenceBus 單機用，Publish 直接同步呼叫 handler，handler 不能 block
+type LocalPresenceBus struct {
+	mu       sync.RWMutex
+	nextId   int
+	handlers map[int]func(PresenceEvent)
+}
+
+func NewLocalPresenceBus() *LocalPresenceBus {
+	return &LocalPresenceBus{handlers: make(map[int]func(PresenceEvent))}
+}
+
+func (b *LocalPresenceBus) Publish(ctx context.Context, e PresenceEvent) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, handler := range b.handlers {
+		handler(e)
+	}
+	return nil
+}
+
+func (b *LocalPresenceBus) Subscribe(handler func(PresenceEvent)) (func(), error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	id := b.nextId
+	b.nextId++
+	b.handlers[id] = handler
+	return func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		delete(b.handlers, id)
+	}, nil
+}
+
+func (b *LocalPresenceBus) Close() error {
+	return nil
+}
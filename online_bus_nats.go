@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+
+	"github.com/nats-io/nats.go"
+)
+
+// NatsPresenceBus 每個節點都訂閱同一個 subject (不用 queue group)，每台都要收到全部事件
+type NatsPresenceBus struct {
+	nc *nats.Conn
+}
+
+func NewNatsPresenceBus(url string) (*NatsPresenceBus, error) {
+	nc, err := nats.Connect(url)
+	if err != nil {
+		return nil, err
+	}
+	return &NatsPresenceBus{nc: nc}, nil
+}
+
+func (b *NatsPresenceBus) Publish(ctx context.Context, e PresenceEvent) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return b.nc.Publish(presenceSubject, data)
+}
+
+func (b *NatsPresenceBus) Subscribe(handler func(PresenceEvent)) (func(), error) {
+	sub, err := b.nc.Subscribe(presenceSubject, func(m *nats.Msg) {
+		var e PresenceEvent
+		if err := json.Unmarshal(m.Data, &e); err != nil {
+			log.Println("Invalid presence event:", err)
+			return
+		}
+		handler(e)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return func() { sub.Unsubscribe() }, nil
+}
+
+// Close 先 Drain，讓已送出的事件處理完
+func (b *NatsPresenceBus) Close() error {
+	return b.nc.Drain()
+}
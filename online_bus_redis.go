@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisPresenceBus 用 Redis Pub/Sub，和 RedisPresenceStore 可以共用同一個 client
+type RedisPresenceBus struct {
+	rdb *redis.Client
+}
+
+func NewRedisPresenceBus(rdb *redis.Client) *RedisPresenceBus {
+	return &RedisPresenceBus{rdb: rdb}
+}
+
+func (b *RedisPresenceBus) Publish(ctx context.Context, e PresenceEvent) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return b.rdb.Publish(ctx, presenceSubject, data).Err()
+}
+
+// Subscribe 等訂閱確認後才回傳，之後 Publish 的事件保證收得到
+func (b *RedisPresenceBus) Subscribe(handler func(PresenceEvent)) (func(), error) {
+	ctx := context.Background()
+	ps := b.rdb.Subscribe(ctx, presenceSubject)
+	if _, err := ps.Receive(ctx); err != nil {
+		ps.Close()
+		return nil, err
+	}
+
+	go func() {
+		for msg := range ps.Channel() {
+			var e PresenceEvent
+			if err := json.Unmarshal([]byte(msg.Payload), &e); err != nil {
+				log.Println("Invalid presence event:", err)
+				continue
+			}
+			handler(e)
+		}
+	}()
+	return func() { ps.Close() }, nil
+}
+
+// Close client 由外部建立，這裡不關
+func (b *RedisPresenceBus) Close() error {
+	return nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPresenceBus(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+
+	buses := map[string]PresenceBus{
+		"local": NewLocalPresenceBus(),
+		"redis": NewRedisPresenceBus(rdb),
+	}
+	for name, bus := range buses {
+		t.Run(name, func(t *testing.T) {
+			events := make(chan PresenceEvent, 1)
+			unsubscribe, err := bus.Subscribe(func(e PresenceEvent) { events <- e })
+			require.NoError(t, err)
+
+			e := PresenceEvent{Event: EventStatusChange, UserId: "123", Status: StatusOffline, Timestamp: 1695402000, Device: "mobile"}
+			require.NoError(t, bus.Publish(context.Background(), e))
+			select {
+			case got := <-events:
+				require.Equal(t, e, got)
+			case <-time.After(time.Second):
+				t.Fatal("event not received")
+			}
+
+			unsubscribe()
+			require.NoError(t, bus.Publish(context.Background(), e))
+			select {
+			case <-events:
+				t.Fatal("received after unsubscribe")
+			case <-time.After(50 * time.Millisecond):
+			}
+		})
+	}
+}
+
+// 兩台 WS server 共用 Redis store 和 Redis Pub/Sub，A 連 node1、B 連 node2
+func TestPresenceBus_CrossNode(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+	store := NewRedisPresenceStore(rdb, DefaultStoreConfig())
+	bus := NewRedisPresenceBus(rdb)
+
+	cfg := testConnConfig()
+	_, url1 := newTestNode(t, cfg, store, bus)
+	_, url2 := newTestNode(t, cfg, store, bus)
+
+	b := dialAs(t, url2, "tokenB")
+	readEvent := func() PresenceEvent {
+		b.SetReadDeadline(time.Now().Add(time.Second))
+		var frame PresenceBatchFrame
+		require.NoError(t, b.ReadJSON(&frame))
+		require.Len(t, frame.Presence, 1)
+		return frame.Presence[0]
+	}
+
+	// B 先訂閱 A，會收到目前狀態
+	require.NoError(t, b.WriteJSON(ClientFrame{Subscribe: []string{"UA"}}))
+	require.Equal(t, StatusOffline, readEvent().Status)
+
+	a := dialAs(t, url1, "tokenA")
+	e := readEvent()
+	require.Equal(t, EventStatusChange, e.Event)
+	require.Equal(t, "UA", e.UserId)
+	require.Equal(t, StatusOnline, e.Status)
+	require.Equal(t, "web", e.Device)
+
+	a.Close()
+	e = readEvent()
+	require.Equal(t, "UA", e.UserId)
+	require.Equal(t, StatusOffline, e.Status)
+	require.NotZero(t, e.Timestamp)
+}
@@ -1,44 +1,58 @@
 package main
 
 import (
+	"bufio"
+	"context"
 	"log"
-	"time"
-
-	"github.com/gorilla/websocket"
+	"os"
+	"os/signal"
+	"strings"
 )
 
+// 執行: WS_TOKEN=tokenA go run online_client.go online_wsclient.go
+// WS_URL 預設 ws://localhost:8080/ws，server 重啟或斷線會自動重連
 func main() {
-	c, _, err := websocket.DefaultDialer.Dial("ws://localhost:8080/ws", nil)
-	if err != nil {
-		log.Fatal("dial error:", err)
+	url := os.Getenv("WS_URL")
+	if url == "" {
+		url = "ws://localhost:8080/ws"
 	}
-	defer c.Close()
-
-	// 設定 pong handler
-	c.SetPongHandler(func(appData string) error {
-		log.Println("received pong from server:", appData)
-		return nil
+	cfg := DefaultWSClientConfig(url, StaticToken(os.Getenv("WS_TOKEN")))
+	cfg.Device = "cli"
+	client := NewWSClient(cfg, func(e WSEvent) {
+		switch e.Type {
+		case WSMessage:
+			log.Printf("recv: %s", e.Data)
+		case WSConnected:
+			log.Println("connected")
+		default:
+			log.Printf("%s: %v", e.Type, e.Err)
+		}
 	})
 
-	// 定期發送 ping
+	// stdin 每一行當成要切換的狀態，例如輸入 busy；空行只回報有活動 (閒置轉 brb 後會轉回 online)
+	// "+U1 U2" 訂閱、"-U1" 取消訂閱，重連後會自動重新訂閱
 	go func() {
-		ticker := time.NewTicker(10 * time.Second)
-		defer ticker.Stop()
-		for range ticker.C {
-			if err := c.WriteMessage(websocket.PingMessage, []byte("ping")); err != nil {
-				log.Println("Ping error:", err)
-				return
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			var err error
+			switch {
+			case line == "":
+				err = client.Activity()
+			case strings.HasPrefix(line, "+"):
+				err = client.Subscribe(strings.Fields(line[1:])...)
+			case strings.HasPrefix(line, "-"):
+				err = client.Unsubscribe(strings.Fields(line[1:])...)
+			default:
+				err = client.SetStatus(line)
+			}
+			if err != nil {
+				log.Println("Send error:", err)
 			}
 		}
 	}()
 
-	// 讀取 server 訊息
-	for {
-		_, message, err := c.ReadMessage()
-		if err != nil {
-			log.Println("Read error:", err)
-			break
-		}
-		log.Printf("recv: %s", message)
-	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	client.Run(ctx)
 }
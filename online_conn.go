@@ -0,0 +1,257 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ConnConfig ping/pong、寫入逾時、send buffer 與訂閱設定
+// 每 PingInterval 送一次 ping，PongWait 內沒收到 pong 就視為斷線，PingInterval 必須小於 PongWait
+// PresenceDebounce 內同一個 user 的多次變更只送最後一次，並合併成一個 frame
+// IdleTimeout 內沒有 activity frame 就自動轉 brb，0 表示不偵測閒置
+// 關機時在 DrainWindow 內分批關閉連線，期間斷線的裝置延後 OfflineDelay 才轉 offline (0 表示立即)
+// SSE / long-poll 的 session 保留最近 StreamBuffer 則訊息供重連接續，沒有 reader 超過 StreamTimeout 結束，long-poll 最多等 PollTimeout
+// TypingTTL 內沒有新的 typing frame 自動結束輸入中，TypingThrottle 為同一個 room 停止後多久才能再開始
+// 存取限制：AllowedOrigins 為空時只允許同源；TrustedProxies 為空時不信任 X-Forwarded-For，per-IP 限制用 RemoteAddr；AuthMethods 為接受 token 的位置，含 frame 時等第一個 frame 最多 AuthTimeout
+// MaxConnsPerUser / MaxConnsPerIP、MessageRate (每秒) / MessageBurst、MaxMessageSize (bytes) 為 0 表示不限制
+type ConnConfig struct {
+	PingInterval     time.Duration
+	PongWait         time.Duration
+	WriteWait        time.Duration
+	SendBuffer       int
+	SlowConsumer     SlowConsumerPolicy
+	MaxSubscriptions int
+	PresenceDebounce time.Duration
+	IdleTimeout      time.Duration
+	TypingTTL        time.Duration
+	TypingThrottle   time.Duration
+
+	DrainWindow  time.Duration
+	OfflineDelay time.Duration
+
+	StreamBuffer  int
+	StreamTimeout time.Duration
+	PollTimeout   time.Duration
+
+	AllowedOrigins  []string
+	TrustedProxies  []string
+	AuthMethods     []AuthMethod
+	AuthTimeout     time.Duration
+	MaxConnsPerUser int
+	MaxConnsPerIP   int
+	MessageRate     float64
+	MessageBurst    int
+	MaxMessageSize  int64
+}
+
+func DefaultConnConfig() ConnConfig {
+	return ConnConfig{
+		PingInterval:     10 * time.Second,
+		PongWait:         30 * time.Second,
+		WriteWait:        5 * time.Second,
+		SendBuffer:       64,
+		SlowConsumer:     SlowConsumerDisconnect,
+		MaxSubscriptions: 1000,
+		PresenceDebounce: 2 * time.Second,
+		IdleTimeout:      5 * time.Minute,
+		TypingTTL:        6 * time.Second,
+		TypingThrottle:   time.Second,
+		DrainWindow:      10 * time.Second,
+		OfflineDelay:     10 * time.Second,
+		StreamBuffer:     256,
+		StreamTimeout:    30 * time.Second,
+		PollTimeout:      25 * time.Second,
+		AuthMethods:      []AuthMethod{AuthHeader, AuthQuery},
+		AuthTimeout:      5 * time.Second,
+		MaxConnsPerUser:  10,
+		MaxConnsPerIP:    100,
+		MessageRate:      10,
+		MessageBurst:     20,
+		MaxMessageSize:   4096,
+	}
+}
+
+// ConnConfigFromEnv 讀 WS_PING_INTERVAL / WS_PONG_WAIT / WS_WRITE_WAIT (例如 "10s")、
+// WS_SEND_BUFFER、WS_SLOW_CONSUMER (drop / disconnect)、WS_MAX_SUBSCRIPTIONS、WS_PRESENCE_DEBOUNCE、WS_IDLE_TIMEOUT、
+// WS_TYPING_TTL、WS_TYPING_THROTTLE、WS_DRAIN_WINDOW、WS_OFFLINE_DELAY、
+// WS_STREAM_BUFFER、WS_STREAM_TIMEOUT、WS_POLL_TIMEOUT、
+// WS_ALLOWED_ORIGINS / WS_TRUSTED_PROXIES / WS_AUTH_METHODS (逗號分隔，例如 "https://app.example.com"、"10.0.0.0/8" 與 "header,frame")、WS_AUTH_TIMEOUT、
+// WS_MAX_CONNS_PER_USER、WS_MAX_CONNS_PER_IP、WS_MESSAGE_RATE、WS_MESSAGE_BURST、WS_MAX_MESSAGE_SIZE，沒設定用預設值
+func ConnConfigFromEnv() (ConnConfig, error) {
+	cfg := DefaultConnConfig()
+	for key, target := range map[string]*time.Duration{
+		"WS_PING_INTERVAL":     &cfg.PingInterval,
+		"WS_PONG_WAIT":         &cfg.PongWait,
+		"WS_WRITE_WAIT":        &cfg.WriteWait,
+		"WS_PRESENCE_DEBOUNCE": &cfg.PresenceDebounce,
+		"WS_IDLE_TIMEOUT":      &cfg.IdleTimeout,
+		"WS_TYPING_TTL":        &cfg.TypingTTL,
+		"WS_TYPING_THROTTLE":   &cfg.TypingThrottle,
+		"WS_DRAIN_WINDOW":      &cfg.DrainWindow,
+		"WS_OFFLINE_DELAY":     &cfg.OfflineDelay,
+		"WS_STREAM_TIMEOUT":    &cfg.StreamTimeout,
+		"WS_POLL_TIMEOUT":      &cfg.PollTimeout,
+		"WS_AUTH_TIMEOUT":      &cfg.AuthTimeout,
+	} {
+		if v := os.Getenv(key); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				return cfg, err
+			}
+			*target = d
+		}
+	}
+	for key, target := range map[string]*int{
+		"WS_SEND_BUFFER":        &cfg.SendBuffer,
+		"WS_MAX_SUBSCRIPTIONS":  &cfg.MaxSubscriptions,
+		"WS_MAX_CONNS_PER_USER": &cfg.MaxConnsPerUser,
+		"WS_MAX_CONNS_PER_IP":   &cfg.MaxConnsPerIP,
+		"WS_MESSAGE_BURST":      &cfg.MessageBurst,
+		"WS_STREAM_BUFFER":      &cfg.StreamBuffer,
+	} {
+		if v := os.Getenv(key); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return cfg, err
+			}
+			*target = n
+		}
+	}
+	if v := os.Getenv("WS_SLOW_CONSUMER"); v != "" {
+		cfg.SlowConsumer = SlowConsumerPolicy(v)
+	}
+	if v := os.Getenv("WS_MESSAGE_RATE"); v != "" {
+		rate, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.MessageRate = rate
+	}
+	if v := os.Getenv("WS_MAX_MESSAGE_SIZE"); v != "" {
+		size, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.MaxMessageSize = size
+	}
+	if v := os.Getenv("WS_ALLOWED_ORIGINS"); v != "" {
+		cfg.AllowedOrigins = splitList(v)
+	}
+	if v := os.Getenv("WS_TRUSTED_PROXIES"); v != "" {
+		cfg.TrustedProxies = splitList(v)
+	}
+	if v := os.Getenv("WS_AUTH_METHODS"); v != "" {
+		cfg.AuthMethods = nil
+		for _, m := range splitList(v) {
+			cfg.AuthMethods = append(cfg.AuthMethods, AuthMethod(m))
+		}
+	}
+	return cfg, cfg.Validate()
+}
+
+func (c ConnConfig) Validate() error {
+	if c.PingInterval <= 0 || c.PongWait <= 0 || c.WriteWait <= 0 || c.PresenceDebounce <= 0 {
+		return errors.New("ping interval, pong wait, write wait and presence debounce must be positive")
+	}
+	if c.PingInterval >= c.PongWait {
+		return errors.New("ping interval must be shorter than pong wait")
+	}
+	if c.SendBuffer <= 0 || c.MaxSubscriptions <= 0 {
+		return errors.New("send buffer and max subscriptions must be positive")
+	}
+	if c.SlowConsumer != SlowConsumerDrop && c.SlowConsumer != SlowConsumerDisconnect {
+		return errors.New("slow consumer policy must be drop or disconnect")
+	}
+	if c.IdleTimeout < 0 {
+		return errors.New("idle timeout must not be negative")
+	}
+	if c.TypingTTL <= 0 || c.TypingThrottle < 0 {
+		return errors.New("typing ttl must be positive and typing throttle must not be negative")
+	}
+	if c.DrainWindow < 0 || c.OfflineDelay < 0 {
+		return errors.New("drain window and offline delay must not be negative")
+	}
+	if c.StreamBuffer <= 0 || c.StreamTimeout <= 0 || c.PollTimeout <= 0 {
+		return errors.New("stream buffer, stream timeout and poll timeout must be positive")
+	}
+	if c.MaxConnsPerUser < 0 || c.MaxConnsPerIP < 0 || c.MessageRate < 0 || c.MaxMessageSize < 0 {
+		return errors.New("connection limits must not be negative")
+	}
+	if c.MessageRate > 0 && c.MessageBurst < 1 {
+		return errors.New("message burst must be at least 1")
+	}
+	if len(c.AuthMethods) == 0 {
+		return errors.New("at least one auth method is required")
+	}
+	for _, m := range c.AuthMethods {
+		switch m {
+		case AuthHeader, AuthQuery:
+		case AuthFrame:
+			if c.AuthTimeout <= 0 {
+				return errors.New("auth timeout must be positive")
+			}
+		default:
+			return errors.New("unknown auth method " + string(m))
+		}
+	}
+	return nil
+}
+
+func (c ConnConfig) allowsAuth(method AuthMethod) bool {
+	for _, m := range c.AuthMethods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+func splitList(v string) []string {
+	var out []string
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// setReadDeadline 設定 read deadline，每次收到 pong 就延長並呼叫 onPong (帶 pong 的內容)；ping 由 Client.writePump 送
+func setReadDeadline(conn *websocket.Conn, cfg ConnConfig, onPong func(appData string)) {
+	conn.SetReadDeadline(time.Now().Add(cfg.PongWait))
+	conn.SetPongHandler(func(appData string) error {
+		if onPong != nil {
+			onPong(appData)
+		}
+		return conn.SetReadDeadline(time.Now().Add(cfg.PongWait))
+	})
+}
+
+// closeGracefully 主動關閉：送 close frame，等 client 回 close (最多 WriteWait)，再關 TCP
+// 呼叫時不能有其他 goroutine 正在 ReadMessage
+func closeGracefully(conn *websocket.Conn, cfg ConnConfig, code int, text string) {
+	deadline := time.Now().Add(cfg.WriteWait)
+	if err := conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, text), deadline); err == nil {
+		conn.SetReadDeadline(deadline)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				break
+			}
+		}
+	}
+	conn.Close()
+}
+
+// isExpectedClose 正常關閉或逾時不需要印成錯誤
+func isExpectedClose(err error) bool {
+	if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.CloseNoStatusReceived) {
+		return true
+	}
+	var netErr interface{ Timeout() bool }
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+	"unicode/utf8"
+)
+
+// 自訂狀態，例如 {"text": "開會到三點", "emoji": "📅", "expiresAt": 1695402000}
+// 跟著 user 不分裝置，另外存一份 (Redis 用 EXPIREAT 到期自動刪除)，合併狀態時放進 presence hash，隨 status_change 事件送出
+// 只在上線時顯示，離線後重新上線如果還沒過期會再出現；被隱私設定隱藏時一起隱藏
+
+const (
+	maxCustomText  = 100 // 字元數
+	maxCustomEmoji = 32  // bytes，ZWJ 組合的 emoji 會比較長
+)
+
+var ErrInvalidCustomStatus = errors.New("invalid custom status")
+
+// CustomStatus ExpiresAt 為 unix 秒，0 表示不會過期
+type CustomStatus struct {
+	Text      string `json:"text,omitempty"`
+	Emoji     string `json:"emoji,omitempty"`
+	ExpiresAt int64  `json:"expiresAt,omitempty"`
+}
+
+// Validate text 和 emoji 都空表示清除，不用檢查 ExpiresAt
+func (c *CustomStatus) Validate(now time.Time) error {
+	if c.empty() {
+		return nil
+	}
+	if !utf8.ValidString(c.Text) || utf8.RuneCountInString(c.Text) > maxCustomText {
+		return fmt.Errorf("%w: text must be valid UTF-8 of at most %d characters", ErrInvalidCustomStatus, maxCustomText)
+	}
+	if !utf8.ValidString(c.Emoji) || len(c.Emoji) > maxCustomEmoji {
+		return fmt.Errorf("%w: emoji must be valid UTF-8 of at most %d bytes", ErrInvalidCustomStatus, maxCustomEmoji)
+	}
+	if c.ExpiresAt != 0 && c.ExpiresAt <= now.Unix() {
+		return fmt.Errorf("%w: expiresAt is in the past", ErrInvalidCustomStatus)
+	}
+	return nil
+}
+
+func (c *CustomStatus) empty() bool {
+	return c == nil || (c.Text == "" && c.Emoji == "")
+}
+
+// active 已過期或空的回傳 nil
+func (c *CustomStatus) active(now time.Time) *CustomStatus {
+	if c.empty() || (c.ExpiresAt != 0 && c.ExpiresAt <= now.Unix()) {
+		return nil
+	}
+	return c
+}
+
+// Equal 兩個都是 nil 也算相同
+func (c *CustomStatus) Equal(o *CustomStatus) bool {
+	if c == nil || o == nil {
+		return c == o
+	}
+	return *c == *o
+}
+
+// SetCustomStatus 設定或清除 (text 和 emoji 都空) 自訂狀態，合併後廣播
+// 到期時由設定的這個節點重新合併一次，把清除廣播出去
+func (s *PresenceService) SetCustomStatus(ctx context.Context, userId string, c *CustomStatus) (Presence, error) {
+	if err := c.Validate(time.Now()); err != nil {
+		return Presence{}, err
+	}
+	if c.empty() {
+		c = nil
+	}
+	if err := s.store.SetCustomStatus(ctx, userId, c); err != nil {
+		return Presence{}, err
+	}
+	s.scheduleExpiry(userId, c)
+	return s.aggregate(ctx, userId)
+}
+
+// scheduleExpiry 同一個 user 只留最後一次設定的 timer
+// 節點重啟會漏掉清除的廣播，讀取時仍會濾掉過期的 (見 withoutExpired)
+func (s *PresenceService) scheduleExpiry(userId string, c *CustomStatus) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if timer, ok := s.expiries[userId]; ok {
+		timer.Stop()
+		delete(s.expiries, userId)
+	}
+	if c == nil || c.ExpiresAt == 0 {
+		return
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(time.Until(time.Unix(c.ExpiresAt, 0)), func() {
+		s.mu.Lock()
+		if s.expiries[userId] == timer {
+			delete(s.expiries, userId)
+		}
+		s.mu.Unlock()
+		if _, err := s.aggregate(context.Background(), userId); err != nil {
+			log.Printf("Expire custom status of %s error: %v", userId, err)
+		}
+	})
+	s.expiries[userId] = timer
+}
+
+// withCustomStatus 合併後的狀態加上自訂狀態，offline 不帶
+func (s *PresenceService) withCustomStatus(ctx context.Context, p Presence) (Presence, error) {
+	if p.Status == StatusOffline {
+		return p, nil
+	}
+	c, err := s.store.CustomStatus(ctx, p.UserId)
+	if err != nil {
+		return Presence{}, err
+	}
+	p.Custom = c.active(time.Now())
+	return p, nil
+}
+
+// withoutExpired store 裡的 view 可能還留著已過期的自訂狀態 (到期的廣播還沒跑或被漏掉)
+func withoutExpired(p Presence) Presence {
+	p.Custom = p.Custom.active(time.Now())
+	return p
+}
+
+func (s *MemoryPresenceStore) SetCustomStatus(ctx context.Context, userId string, c *CustomStatus) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c == nil {
+		delete(s.custom, userId)
+		return nil
+	}
+	s.custom[userId] = *c
+	return nil
+}
+
+func (s *MemoryPresenceStore) CustomStatus(ctx context.Context, userId string) (*CustomStatus, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.custom[userId]
+	if !ok {
+		return nil, nil
+	}
+	if c.ExpiresAt != 0 && c.ExpiresAt <= s.now().Unix() {
+		delete(s.custom, userId)
+		return nil, nil
+	}
+	return &c, nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCustomStatus_Validate(t *testing.T) {
+	now := time.Unix(1695400000, 0)
+	tests := []struct {
+		name   string
+		custom *CustomStatus
+		valid  bool
+	}{
+		{"clear", &CustomStatus{}, true},
+		{"nil", nil, true},
+		{"text and emoji", &CustomStatus{Text: "開會到三點", Emoji: "📅", ExpiresAt: now.Unix() + 3600}, true},
+		{"emoji only", &CustomStatus{Emoji: "🌴"}, true},
+		{"text too long", &CustomStatus{Text: strings.Repeat("字", maxCustomText+1)}, false},
+		{"emoji too long", &CustomStatus{Emoji: strings.Repeat("🌴", 9)}, false},
+		{"invalid utf8", &CustomStatus{Text: "\xff"}, false},
+		{"expired", &CustomStatus{Text: "午餐", ExpiresAt: now.Unix()}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.custom.Validate(now)
+			if tt.valid {
+				require.NoError(t, err)
+			} else {
+				require.ErrorIs(t, err, ErrInvalidCustomStatus)
+			}
+		})
+	}
+}
+
+func TestPresenceService_CustomStatus(t *testing.T) {
+	ctx := context.Background()
+	bus := NewLocalPresenceBus()
+	var events []PresenceEvent
+	_, err := bus.Subscribe(func(e PresenceEvent) { events = append(events, e) })
+	require.NoError(t, err)
+	store := NewMemoryPresenceStore(DefaultStoreConfig())
+	service := NewPresenceService(store, store, bus)
+	require.NoError(t, store.SetContacts(ctx, "U1", []string{"U2"}))
+
+	online, err := service.Connect(ctx, "U1", "web")
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+
+	// 狀態沒變也要廣播，since 不變
+	custom := &CustomStatus{Text: "開會到三點", Emoji: "📅", ExpiresAt: time.Now().Add(time.Hour).Unix()}
+	p, err := service.SetCustomStatus(ctx, "U1", custom)
+	require.NoError(t, err)
+	require.Equal(t, custom, p.Custom)
+	require.Equal(t, online.Since, p.Since)
+	require.Len(t, events, 2)
+	require.Equal(t, StatusOnline, events[1].Status)
+	require.Equal(t, custom, events[1].Custom)
+	got, err := service.GetFor(ctx, "U3", "U1")
+	require.NoError(t, err)
+	require.Equal(t, custom, got.Custom)
+
+	// 重設相同內容不廣播
+	_, err = service.SetCustomStatus(ctx, "U1", &CustomStatus{Text: custom.Text, Emoji: custom.Emoji, ExpiresAt: custom.ExpiresAt})
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+
+	// 只給聯絡人看時，public 連自訂狀態一起隱藏
+	_, err = service.SetVisibility(ctx, "U1", VisibilityContacts)
+	require.NoError(t, err)
+	got, _ = service.GetFor(ctx, "U3", "U1")
+	require.Equal(t, Presence{UserId: "U1", Status: StatusOffline}, got)
+	got, _ = service.GetFor(ctx, "U2", "U1")
+	require.Equal(t, custom, got.Custom)
+
+	// 離線時不帶，重新上線還沒過期就恢復
+	p, err = service.Disconnect(ctx, "U1", "web")
+	require.NoError(t, err)
+	require.Nil(t, p.Custom)
+	p, err = service.Connect(ctx, "U1", "web")
+	require.NoError(t, err)
+	require.Equal(t, custom, p.Custom)
+
+	n := len(events)
+	p, err = service.SetCustomStatus(ctx, "U1", &CustomStatus{})
+	require.NoError(t, err)
+	require.Nil(t, p.Custom)
+	require.Len(t, events, n+1)
+	require.Nil(t, events[n].Custom)
+
+	_, err = service.SetCustomStatus(ctx, "U1", &CustomStatus{Text: "午餐", ExpiresAt: time.Now().Unix()})
+	require.ErrorIs(t, err, ErrInvalidCustomStatus)
+}
+
+func TestWsHandler_CustomStatus(t *testing.T) {
+	cfg := testConnConfig()
+	cfg.PongWait = 5 * time.Second
+	_, url := newTestServer(t, cfg)
+
+	a := dialAs(t, url, "tokenA")
+	b := dialAs(t, url, "tokenB")
+	require.NoError(t, b.WriteJSON(ClientFrame{Subscribe: []string{"UA"}}))
+	var snapshot PresenceBatchFrame
+	require.NoError(t, b.ReadJSON(&snapshot))
+	require.Nil(t, snapshot.Presence[0].Custom)
+
+	read := func(conn *websocket.Conn) PresenceBatchFrame {
+		conn.SetReadDeadline(time.Now().Add(4 * time.Second))
+		var frame PresenceBatchFrame
+		require.NoError(t, conn.ReadJSON(&frame))
+		return frame
+	}
+
+	// 1~2 秒後過期，到期時自動清除並通知訂閱者
+	custom := &CustomStatus{Text: "馬上回來", Emoji: "☕", ExpiresAt: time.Now().Unix() + 2}
+	require.NoError(t, a.WriteJSON(ClientFrame{CustomStatus: custom}))
+	var p Presence
+	require.NoError(t, a.ReadJSON(&p))
+	require.Equal(t, custom, p.Custom)
+
+	update := read(b)
+	require.Equal(t, custom, update.Presence[0].Custom)
+	require.Equal(t, StatusOnline, update.Presence[0].Status)
+	update = read(b)
+	require.Equal(t, "UA", update.Presence[0].UserId)
+	require.Nil(t, update.Presence[0].Custom)
+
+	require.NoError(t, a.WriteJSON(ClientFrame{CustomStatus: &CustomStatus{Text: strings.Repeat("a", maxCustomText+1)}}))
+	var errFrame ErrorFrame
+	require.NoError(t, a.ReadJSON(&errFrame))
+	require.Contains(t, errFrame.Error, ErrInvalidCustomStatus.Error())
+}
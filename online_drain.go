@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// 關機流程 (SIGTERM)：
+//  1. 標記 draining，新的 upgrade 回 503，由 load balancer 導到其他節點
+//  2. 通知所有連線換節點重連 (ReconnectFrame)，在 DrainWindow 內分批關閉，避免所有 client 同時湧向其他節點
+//  3. draining 期間斷線的裝置延後 OfflineDelay 才轉 offline，期間已在其他節點重連的不動，
+//     訂閱者就不會看到 offline -> online 的閃爍
+
+var ErrDraining = errors.New("server is shutting down, reconnect to another node")
+
+// ReconnectFrame 關機前推給 client，v1 協定的 type 為 reconnect
+type ReconnectFrame struct {
+	Reconnect bool   `json:"reconnect"`
+	Reason    string `json:"reason"`
+}
+
+// Drain 關閉所有 WebSocket 連線並等 handler 處理完下線，ctx 到期時剩下的連線直接關閉、延後下線的立即執行
+// 只處理 WebSocket，HTTP server 的 Shutdown 由呼叫端在之後處理
+func (s *PresenceServer) Drain(ctx context.Context) error {
+	if s.draining.Swap(true) {
+		return errors.New("already draining")
+	}
+	clients := s.hub.All()
+	log.Printf("draining %d connections over %s", len(clients), s.cfg.DrainWindow)
+	for _, c := range clients {
+		if err := c.SendEvent(MsgReconnect, ReconnectFrame{Reconnect: true, Reason: ErrDraining.Error()}); err != nil {
+			log.Printf("Reconnect %s (%s) error: %v", c.UserId, c.Device, err)
+		}
+	}
+
+	// 收到通知自己先重連的 client 會先離開，剩下的平均分散在 DrainWindow 內關閉
+	var step time.Duration
+	if len(clients) > 0 {
+		step = s.cfg.DrainWindow / time.Duration(len(clients))
+	}
+	for _, c := range clients {
+		if step > 0 {
+			select {
+			case <-time.After(step):
+			case <-ctx.Done():
+				step = 0
+			}
+		}
+		c.close(websocket.CloseServiceRestart, ErrDraining.Error())
+	}
+
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for s.active.Load() > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			close(s.hurry)
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// disconnect 連線結束時把裝置轉 offline，draining 時先等 OfflineDelay
+// 不論是否 draining，同一個裝置已經在其他節點重連 (connectedAt 較新) 就交給新的連線
+func (s *PresenceServer) disconnect(ctx context.Context, userId, device string, connectedAt int64) {
+	lastSeen := time.Now().Unix()
+	if s.draining.Load() && s.cfg.OfflineDelay > 0 {
+		select {
+		case <-time.After(s.cfg.OfflineDelay):
+		case <-s.hurry:
+		}
+	}
+	p, err := s.presence.disconnectAt(ctx, userId, device, connectedAt, lastSeen)
+	if errors.Is(err, ErrReconnected) {
+		log.Printf("%s reconnected elsewhere (%s)", userId, device)
+		return
+	}
+	if err != nil {
+		log.Println("Disconnect error:", err)
+		return
+	}
+	log.Printf("%s offline (%s), now %s", userId, device, p.Status)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPresenceServer_Drain(t *testing.T) {
+	cfg := testConnConfig()
+	// 等下一秒時沒在讀，不能因為 pong 逾時斷線
+	cfg.PongWait = 5 * time.Second
+	cfg.DrainWindow = 100 * time.Millisecond
+	cfg.OfflineDelay = 200 * time.Millisecond
+	store := NewMemoryPresenceStore(DefaultStoreConfig())
+	bus := NewLocalPresenceBus()
+	server1, url1 := newTestNode(t, cfg, store, bus)
+	_, url2 := newTestNode(t, cfg, store, bus)
+
+	a := dialAs(t, url1, "tokenA")
+	dialAs(t, url1, "tokenB")
+	// since 以秒為單位，換到下一秒再重連才分得出是另一次連線
+	time.Sleep(time.Until(time.Unix(time.Now().Unix()+1, 0)))
+
+	drained := make(chan error, 1)
+	go func() { drained <- server1.Drain(context.Background()) }()
+
+	// 先收到換節點的通知，之後被關閉
+	a.SetReadDeadline(time.Now().Add(time.Second))
+	var frame ReconnectFrame
+	require.NoError(t, a.ReadJSON(&frame))
+	require.True(t, frame.Reconnect)
+	requireCloseCode(t, a, websocket.CloseServiceRestart)
+
+	// 關機中不接受新連線
+	header := http.Header{"Authorization": []string{"Bearer tokenC"}}
+	_, resp, err := websocket.DefaultDialer.Dial(url1, header)
+	require.Error(t, err)
+	require.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+
+	// 延後下線期間還是在線，換到其他節點重連的不會被轉 offline
+	require.Equal(t, StatusOnline, statusOf(t, server1, "UA"))
+	require.Equal(t, StatusOnline, statusOf(t, server1, "UB"))
+	dialAs(t, url2, "tokenA")
+
+	select {
+	case err := <-drained:
+		require.NoError(t, err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("drain did not finish")
+	}
+	require.Equal(t, StatusOnline, statusOf(t, server1, "UA"))
+	require.Equal(t, StatusOffline, statusOf(t, server1, "UB"))
+}
+
+// 不是 draining 也一樣：裝置在 node2 重連後，node1 的舊連線才 pong 逾時，不能把新連線轉 offline
+func TestPresenceServer_StaleConnectionAfterReconnect(t *testing.T) {
+	cfg := testConnConfig()
+	store := NewMemoryPresenceStore(DefaultStoreConfig())
+	bus := NewLocalPresenceBus()
+	server1, url1 := newTestNode(t, cfg, store, bus)
+	server2, url2 := newTestNode(t, cfg, store, bus)
+
+	// a 之後不再讀取，不會回 pong
+	dialAs(t, url1, "tokenA")
+	time.Sleep(5 * time.Millisecond)
+	b := dialAs(t, url2, "tokenA")
+	go func() {
+		for {
+			if _, _, err := b.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	require.Eventually(t, func() bool { return server1.active.Load() == 0 }, time.Second, 5*time.Millisecond)
+	require.Equal(t, 1, server2.hub.Count())
+	devices, err := server1.presence.Devices(context.Background(), "UA")
+	require.NoError(t, err)
+	require.Len(t, devices, 1)
+	require.Equal(t, StatusOnline, devices[0].Status)
+	require.Equal(t, StatusOnline, statusOf(t, server1, "UA"))
+}
+
+func TestClient_ReconnectBeforeClose(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	accepted := make(chan *websocket.Conn, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		require.NoError(t, err)
+		accepted <- conn
+	}))
+	t.Cleanup(ts.Close)
+	url := "ws" + strings.TrimPrefix(ts.URL, "http")
+
+	// writePump 啟動時 send 和 done 都已經可讀，select 隨機挑一個，重複幾次確保通知一定先送出
+	hub := NewHub(testConnConfig())
+	for i := 0; i < 20; i++ {
+		conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+
+		c := hub.newClient(<-accepted, "UA", "web")
+		require.NoError(t, c.SendEvent(MsgReconnect, ReconnectFrame{Reconnect: true, Reason: ErrDraining.Error()}))
+		c.close(websocket.CloseServiceRestart, ErrDraining.Error())
+		go c.writePump()
+
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		var frame ReconnectFrame
+		require.NoError(t, conn.ReadJSON(&frame))
+		require.True(t, frame.Reconnect)
+		requireCloseCode(t, conn, websocket.CloseServiceRestart)
+	}
+}
+
+func TestPresenceServer_DrainTimeout(t *testing.T) {
+	cfg := testConnConfig()
+	cfg.PongWait = time.Second
+	cfg.DrainWindow = 10 * time.Millisecond
+	cfg.OfflineDelay = time.Hour
+	server, url := newTestServer(t, cfg)
+	dialTest(t, url)
+
+	// ctx 到期時延後的下線立即執行
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, server.Drain(ctx), context.DeadlineExceeded)
+	require.Eventually(t, func() bool { return statusOf(t, server, "UA") == StatusOffline }, time.Second, 10*time.Millisecond)
+}
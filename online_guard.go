@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuthMethod /ws 接受 token 的位置
+// header: Authorization: Bearer xxx；query: ?token=xxx；frame: upgrade 後第一個 frame {"token": "xxx"}
+type AuthMethod string
+
+const (
+	AuthHeader AuthMethod = "header"
+	AuthQuery  AuthMethod = "query"
+	AuthFrame  AuthMethod = "frame"
+)
+
+// AuthFrameMessage 第一個 frame 帶的 token，瀏覽器不想把 token 放在 URL (會留在 log) 時用
+type AuthFrameMessage struct {
+	Token string `json:"token"`
+}
+
+var ErrTooManyConnections = errors.New("too many connections")
+
+// newCheckOrigin allowed 為空時用 gorilla 預設的同源檢查；"*" 允許全部
+// 沒有 Origin header 的 (非瀏覽器 client) 一律允許
+func newCheckOrigin(allowed []string) func(r *http.Request) bool {
+	if len(allowed) == 0 {
+		return nil
+	}
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			return true
+		}
+		for _, a := range allowed {
+			if a == "*" || strings.EqualFold(a, origin) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// connLimiter 每個 user / IP 同時的連線數，上限 0 表示不限制
+// IP 在 upgrade 前檢查；user 在驗證後檢查 (first frame 驗證時是 upgrade 之後)
+type connLimiter struct {
+	mu      sync.Mutex
+	maxUser int
+	maxIP   int
+	users   map[string]int
+	ips     map[string]int
+}
+
+func newConnLimiter(maxUser, maxIP int) *connLimiter {
+	return &connLimiter{maxUser: maxUser, maxIP: maxIP, users: make(map[string]int), ips: make(map[string]int)}
+}
+
+// AcquireUser 成功時回傳的 release 要在連線結束時呼叫
+func (l *connLimiter) AcquireUser(userId string) (func(), error) {
+	return l.acquire(l.users, l.maxUser, userId)
+}
+
+func (l *connLimiter) AcquireIP(ip string) (func(), error) {
+	return l.acquire(l.ips, l.maxIP, ip)
+}
+
+func (l *connLimiter) acquire(counts map[string]int, max int, key string) (func(), error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if max > 0 && counts[key] >= max {
+		return nil, ErrTooManyConnections
+	}
+	counts[key]++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			if counts[key]--; counts[key] <= 0 {
+				delete(counts, key)
+			}
+		})
+	}, nil
+}
+
+// tokenBucket 每條連線的訊息速率，每秒補 rate 個，最多存 burst 個
+// 只有讀取迴圈使用，不需要鎖
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket rate 為 0 時回傳 nil，不限制
+func newTokenBucket(rate float64, burst int, now time.Time) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: now}
+}
+
+func (b *tokenBucket) Allow(now time.Time) bool {
+	if b == nil {
+		return true
+	}
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckOrigin(t *testing.T) {
+	require.Nil(t, newCheckOrigin(nil))
+
+	check := newCheckOrigin([]string{"https://app.example.com"})
+	tests := []struct {
+		origin string
+		want   bool
+	}{
+		{"", true},
+		{"https://app.example.com", true},
+		{"https://APP.example.com", true},
+		{"https://evil.example.com", false},
+		{"http://app.example.com", false},
+	}
+	for _, tt := range tests {
+		r, _ := http.NewRequest(http.MethodGet, "/ws", nil)
+		r.Header.Set("Origin", tt.origin)
+		require.Equal(t, tt.want, check(r), tt.origin)
+	}
+
+	r, _ := http.NewRequest(http.MethodGet, "/ws", nil)
+	r.Header.Set("Origin", "https://any.example.com")
+	require.True(t, newCheckOrigin([]string{"*"})(r))
+}
+
+func TestConnLimiter(t *testing.T) {
+	l := newConnLimiter(2, 0)
+	release1, err := l.AcquireUser("U1")
+	require.NoError(t, err)
+	_, err = l.AcquireUser("U1")
+	require.NoError(t, err)
+	_, err = l.AcquireUser("U1")
+	require.ErrorIs(t, err, ErrTooManyConnections)
+	_, err = l.AcquireUser("U2")
+	require.NoError(t, err)
+
+	// release 重複呼叫只算一次
+	release1()
+	release1()
+	_, err = l.AcquireUser("U1")
+	require.NoError(t, err)
+	_, err = l.AcquireUser("U1")
+	require.ErrorIs(t, err, ErrTooManyConnections)
+
+	for i := 0; i < 100; i++ {
+		_, err := l.AcquireIP("127.0.0.1")
+		require.NoError(t, err)
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Unix(1695400000, 0)
+	b := newTokenBucket(10, 2, now)
+	require.True(t, b.Allow(now))
+	require.True(t, b.Allow(now))
+	require.False(t, b.Allow(now))
+	// 每 100ms 補一個
+	require.True(t, b.Allow(now.Add(100*time.Millisecond)))
+	require.False(t, b.Allow(now.Add(100*time.Millisecond)))
+	// 最多存 burst 個
+	later := now.Add(time.Hour)
+	require.True(t, b.Allow(later))
+	require.True(t, b.Allow(later))
+	require.False(t, b.Allow(later))
+
+	var unlimited *tokenBucket
+	require.Nil(t, newTokenBucket(0, 0, now))
+	require.True(t, unlimited.Allow(now))
+}
+
+func requireCloseCode(t *testing.T, conn *websocket.Conn, code int) {
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		_, _, err := conn.ReadMessage()
+		if err != nil {
+			require.True(t, websocket.IsCloseError(err, code), err)
+			return
+		}
+	}
+}
+
+func TestWsHandler_Origin(t *testing.T) {
+	cfg := testConnConfig()
+	cfg.AllowedOrigins = []string{"https://app.example.com"}
+	_, url := newTestServer(t, cfg)
+
+	header := http.Header{"Authorization": []string{"Bearer tokenA"}, "Origin": []string{"https://evil.example.com"}}
+	_, resp, err := websocket.DefaultDialer.Dial(url, header)
+	require.Error(t, err)
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	header.Set("Origin", "https://app.example.com")
+	conn, _, err := websocket.DefaultDialer.Dial(url, header)
+	require.NoError(t, err)
+	conn.Close()
+}
+
+func TestWsHandler_AuthMethods(t *testing.T) {
+	cfg := testConnConfig()
+	cfg.AuthMethods = []AuthMethod{AuthHeader, AuthFrame}
+	server, url := newTestServer(t, cfg)
+
+	// 不接受 query，改等第一個 frame
+	conn, _, err := websocket.DefaultDialer.Dial(url+"?token=tokenA", nil)
+	require.NoError(t, err)
+	defer conn.Close()
+	requireCloseCode(t, conn, websocket.ClosePolicyViolation)
+
+	conn, _, err = websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.WriteJSON(AuthFrameMessage{Token: "tokenC"}))
+	var p Presence
+	require.NoError(t, conn.ReadJSON(&p))
+	require.Equal(t, Presence{UserId: "UC", Status: StatusOnline, Since: p.Since, Device: "web"}, p)
+	require.Equal(t, StatusOnline, statusOf(t, server, "UC"))
+
+	conn, _, err = websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.WriteJSON(AuthFrameMessage{Token: "wrong"}))
+	requireCloseCode(t, conn, websocket.ClosePolicyViolation)
+}
+
+func TestWsHandler_ConnLimits(t *testing.T) {
+	cfg := testConnConfig()
+	cfg.MaxConnsPerUser = 1
+	_, url := newTestServer(t, cfg)
+
+	conn := dialTest(t, url)
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	header := http.Header{"Authorization": []string{"Bearer tokenA"}}
+	_, resp, err := websocket.DefaultDialer.Dial(url+"?device=mobile", header)
+	require.Error(t, err)
+	require.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+
+	// 斷線後釋放
+	conn.Close()
+	require.Eventually(t, func() bool {
+		c, _, err := websocket.DefaultDialer.Dial(url+"?device=mobile", header)
+		if err != nil {
+			return false
+		}
+		c.Close()
+		return true
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestWsHandler_IPLimitIgnoresForwardedFor(t *testing.T) {
+	cfg := testConnConfig()
+	cfg.MaxConnsPerIP = 1
+	_, url := newTestServer(t, cfg)
+
+	conn := dialTest(t, url)
+	defer conn.Close()
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	// 沒設定 TrustedProxies，client 自己帶的 X-Forwarded-For 不算數
+	header := http.Header{"Authorization": []string{"Bearer tokenB"}, "X-Forwarded-For": []string{"203.0.113.7"}}
+	_, resp, err := websocket.DefaultDialer.Dial(url, header)
+	require.Error(t, err)
+	require.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+}
+
+func TestWsHandler_MessageLimits(t *testing.T) {
+	cfg := testConnConfig()
+	cfg.PongWait = time.Second
+	cfg.MessageRate = 1
+	cfg.MessageBurst = 3
+	cfg.MaxMessageSize = 64
+	_, url := newTestServer(t, cfg)
+
+	conn := dialTest(t, url)
+	for i := 0; i < 4; i++ {
+		require.NoError(t, conn.WriteJSON(ClientFrame{Activity: true}))
+	}
+	requireCloseCode(t, conn, websocket.ClosePolicyViolation)
+
+	conn = dialTest(t, url)
+	require.NoError(t, conn.WriteJSON(ClientFrame{Subscribe: []string{strings.Repeat("U", 100)}}))
+	requireCloseCode(t, conn, websocket.CloseMessageTooBig)
+}
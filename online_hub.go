@@ -0,0 +1,298 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// gorilla/websocket 同一條連線只允許一個 goroutine 寫入
+// 所以每個 client 只有 writePump 會寫 conn，其他地方一律透過 send channel 排隊
+
+var ErrSlowConsumer = errors.New("slow consumer: send buffer full")
+
+// SlowConsumerPolicy send buffer 滿了的處理方式
+type SlowConsumerPolicy string
+
+const (
+	SlowConsumerDrop       SlowConsumerPolicy = "drop"       // 丟掉這則訊息，連線保留
+	SlowConsumerDisconnect SlowConsumerPolicy = "disconnect" // 直接斷線，讓 client 重連後重新同步
+)
+
+type Client struct {
+	hub    *Hub
+	conn   *websocket.Conn
+	UserId string
+	Device string
+	// protocol upgrade 時協商的 subprotocol，空的是舊格式
+	protocol string
+
+	send      chan []byte
+	done      chan struct{}
+	closeOnce sync.Once
+	closeCode int
+	closeText string
+	// replaced 被同裝置的新連線取代，結束時不轉 offline
+	replaced atomic.Bool
+}
+
+// Hub 以 userId -> device -> client 記錄目前所有連線
+type Hub struct {
+	cfg     ConnConfig
+	metrics *PresenceMetrics
+	mu      sync.RWMutex
+	clients map[string]map[string]*Client
+}
+
+func NewHub(cfg ConnConfig) *Hub {
+	return &Hub{cfg: cfg, clients: make(map[string]map[string]*Client)}
+}
+
+func (h *Hub) newClient(conn *websocket.Conn, userId, device string) *Client {
+	c := &Client{
+		hub:    h,
+		conn:   conn,
+		UserId: userId,
+		Device: device,
+		send:   make(chan []byte, h.cfg.SendBuffer),
+		done:   make(chan struct{}),
+	}
+	if conn != nil {
+		c.protocol = conn.Subprotocol()
+	}
+	return c
+}
+
+// Register 加入連線並啟動 writePump，同一個 user 同一個 device 重複連線時踢掉舊的
+func (h *Hub) Register(conn *websocket.Conn, userId, device string) *Client {
+	c := h.newClient(conn, userId, device)
+	h.add(c)
+	go c.writePump()
+	return c
+}
+
+// RegisterStream SSE / long-poll 用的連線，沒有 conn 也不啟動 writePump，由 streamSession 讀 send channel
+func (h *Hub) RegisterStream(userId, device, protocol string) *Client {
+	c := h.newClient(nil, userId, device)
+	c.protocol = protocol
+	h.add(c)
+	return c
+}
+
+func (h *Hub) add(c *Client) {
+	h.mu.Lock()
+	devices, ok := h.clients[c.UserId]
+	if !ok {
+		devices = make(map[string]*Client)
+		h.clients[c.UserId] = devices
+	}
+	old := devices[c.Device]
+	devices[c.Device] = c
+	// 在鎖內標記，舊連線同時結束時 release 也一定看得到
+	if old != nil {
+		old.replaced.Store(true)
+	}
+	h.mu.Unlock()
+
+	if old != nil {
+		old.close(websocket.ClosePolicyViolation, "replaced by new connection")
+	}
+}
+
+// Unregister 移除連線並停止 writePump，回傳這次呼叫是否把它從 hub 移除
+// 被同裝置新連線取代的舊 client 回傳 false，也不會把新的移除
+// 已經 Unregister 過 (例如 slow consumer 斷線) 也回傳 false，要判斷是否被取代請看 replaced
+func (h *Hub) Unregister(c *Client) (removed bool) {
+	h.mu.Lock()
+	if devices, ok := h.clients[c.UserId]; ok {
+		if devices[c.Device] == c {
+			delete(devices, c.Device)
+			removed = true
+		}
+		if len(devices) == 0 {
+			delete(h.clients, c.UserId)
+		}
+	}
+	h.mu.Unlock()
+
+	c.close(websocket.CloseNormalClosure, "")
+	return removed
+}
+
+// Clients 回傳 user 目前所有裝置的連線
+func (h *Hub) Clients(userId string) []*Client {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	clients := make([]*Client, 0, len(h.clients[userId]))
+	for _, c := range h.clients[userId] {
+		clients = append(clients, c)
+	}
+	return clients
+}
+
+// All 目前所有連線
+func (h *Hub) All() []*Client {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	var clients []*Client
+	for _, devices := range h.clients {
+		for _, c := range devices {
+			clients = append(clients, c)
+		}
+	}
+	return clients
+}
+
+// Count 目前連線數
+func (h *Hub) Count() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	n := 0
+	for _, devices := range h.clients {
+		n += len(devices)
+	}
+	return n
+}
+
+// QueueDepth 所有連線 send queue 裡的訊息數，以及最長的一條
+func (h *Hub) QueueDepth() (total, max int) {
+	for _, c := range h.All() {
+		n := len(c.send)
+		total += n
+		if n > max {
+			max = n
+		}
+	}
+	return total, max
+}
+
+// SendToUser 送給 user 的所有裝置，只 marshal 一次
+func (h *Hub) SendToUser(userId string, v interface{}) error {
+	msg, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	for _, c := range h.Clients(userId) {
+		c.Send(msg)
+	}
+	return nil
+}
+
+// Broadcast 送給本機所有連線，except 的連線略過 (例如狀態變更的本人)
+func (h *Hub) Broadcast(v interface{}, except string) error {
+	msg, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	h.mu.RLock()
+	clients := make([]*Client, 0, len(h.clients))
+	for userId, devices := range h.clients {
+		if userId == except {
+			continue
+		}
+		for _, c := range devices {
+			clients = append(clients, c)
+		}
+	}
+	h.mu.RUnlock()
+
+	// Send 在 disconnect 模式下會 Unregister，要在鎖外呼叫
+	for _, c := range clients {
+		c.Send(msg)
+	}
+	return nil
+}
+
+// Send 不會 block，buffer 滿了依 SlowConsumer 設定丟棄或斷線
+func (c *Client) Send(msg []byte) error {
+	select {
+	case <-c.done:
+		return websocket.ErrCloseSent
+	default:
+	}
+
+	select {
+	case c.send <- msg:
+		return nil
+	default:
+	}
+
+	c.hub.metrics.slowConsumer(c.hub.cfg.SlowConsumer)
+	if c.hub.cfg.SlowConsumer == SlowConsumerDisconnect {
+		log.Printf("%s (%s) slow consumer, disconnecting", c.UserId, c.Device)
+		c.close(websocket.CloseTryAgainLater, "slow consumer")
+		c.hub.Unregister(c)
+	}
+	return ErrSlowConsumer
+}
+
+func (c *Client) SendJSON(v interface{}) error {
+	msg, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.Send(msg)
+}
+
+// close 只記錄第一次的原因，實際關閉由 writePump 處理
+func (c *Client) close(code int, text string) {
+	c.closeOnce.Do(func() {
+		c.closeCode = code
+		c.closeText = text
+		close(c.done)
+	})
+}
+
+// writePump 是唯一會寫 conn 的 goroutine，負責訊息、ping 與 close frame
+// 寫入失敗時關掉 conn，讓 handler 的 ReadMessage 跟著返回
+func (c *Client) writePump() {
+	ticker := time.NewTicker(c.hub.cfg.PingInterval)
+	defer func() {
+		ticker.Stop()
+		c.conn.Close()
+	}()
+
+	for {
+		select {
+		case msg := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(c.hub.cfg.WriteWait))
+			if err := c.conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+				log.Println("Write error:", err)
+				return
+			}
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(c.hub.cfg.WriteWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, pingPayload(time.Now())); err != nil {
+				log.Println("Ping error:", err)
+				return
+			}
+		case <-c.done:
+			// select 不保證先處理 send，關閉前已排入的訊息 (例如 Drain 的 ReconnectFrame) 要先送出
+			// 整段共用一個 deadline，slow consumer 塞滿的 buffer 不會拖太久
+			// 已經 close 過 (例如 client 先送 close) 時這裡會失敗，忽略即可
+			c.conn.SetWriteDeadline(time.Now().Add(c.hub.cfg.WriteWait))
+			c.flush()
+			c.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(c.closeCode, c.closeText))
+			return
+		}
+	}
+}
+
+// flush 把 send 裡已經排入的訊息寫完，寫入失敗就放棄剩下的
+func (c *Client) flush() {
+	for {
+		select {
+		case msg := <-c.send:
+			if err := c.conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+				return
+			}
+		default:
+			return
+		}
+	}
+}
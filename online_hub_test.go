@@ -0,0 +1,98 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func isClosed(c *Client) bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestHub_SlowConsumerDrop(t *testing.T) {
+	cfg := testConnConfig()
+	cfg.SlowConsumer = SlowConsumerDrop
+	hub := NewHub(cfg)
+
+	// 不啟動 writePump，buffer 不會被消化
+	c := hub.newClient(nil, "UA", "web")
+	hub.add(c)
+	for i := 0; i < cfg.SendBuffer; i++ {
+		require.NoError(t, c.Send([]byte("{}")))
+	}
+	require.ErrorIs(t, c.Send([]byte("{}")), ErrSlowConsumer)
+	require.False(t, isClosed(c))
+	require.Equal(t, 1, hub.Count())
+}
+
+func TestHub_SlowConsumerDisconnect(t *testing.T) {
+	cfg := testConnConfig()
+	hub := NewHub(cfg)
+
+	c := hub.newClient(nil, "UA", "web")
+	hub.add(c)
+	for i := 0; i < cfg.SendBuffer; i++ {
+		require.NoError(t, c.Send([]byte("{}")))
+	}
+	require.ErrorIs(t, c.Send([]byte("{}")), ErrSlowConsumer)
+	require.True(t, isClosed(c))
+	require.Equal(t, 0, hub.Count())
+}
+
+func TestHub_Registry(t *testing.T) {
+	hub := NewHub(testConnConfig())
+
+	web := hub.newClient(nil, "UA", "web")
+	mobile := hub.newClient(nil, "UA", "mobile")
+	hub.add(web)
+	hub.add(mobile)
+	require.Len(t, hub.Clients("UA"), 2)
+
+	// 同一個裝置重連，舊連線被踢掉，舊的 Unregister 不影響新的
+	web2 := hub.newClient(nil, "UA", "web")
+	hub.add(web2)
+	require.True(t, isClosed(web))
+	require.False(t, hub.Unregister(web))
+	require.ElementsMatch(t, []*Client{web2, mobile}, hub.Clients("UA"))
+
+	require.True(t, hub.Unregister(mobile))
+	require.True(t, hub.Unregister(web2))
+	require.False(t, hub.Unregister(web2))
+	require.Empty(t, hub.Clients("UA"))
+}
+
+// 多個 goroutine 同時送訊息，加上 writePump 的 ping，用 -race 檢查只有一個 writer
+func TestHub_ConcurrentSend(t *testing.T) {
+	cfg := testConnConfig()
+	cfg.SendBuffer = 256
+	server, url := newTestServer(t, cfg)
+	conn := dialTest(t, url)
+
+	const senders, perSender = 8, 20
+	var wg sync.WaitGroup
+	for i := 0; i < senders; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < perSender; j++ {
+				require.NoError(t, server.hub.SendToUser("UA", Presence{UserId: "UA", Status: StatusBusy}))
+			}
+		}()
+	}
+	wg.Wait()
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	for i := 0; i < senders*perSender; i++ {
+		var p Presence
+		require.NoError(t, conn.ReadJSON(&p))
+		require.Equal(t, StatusBusy, p.Status)
+	}
+}
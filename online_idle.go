@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// idleTracker 單一連線 (裝置) 的閒置偵測
+// 超過 timeout 沒有活動就把 online 轉成 brb，之後有活動再轉回 online
+// 只動自己設的 brb：手動設定的 busy / DND / brb 一律不改
+type idleTracker struct {
+	presence *PresenceService
+	userId   string
+	device   string
+	timeout  time.Duration
+
+	mu      sync.Mutex
+	timer   *time.Timer
+	away    bool // 目前的 brb 是自動轉的
+	stopped bool
+}
+
+// newIdleTracker timeout 為 0 時不偵測，回傳的 tracker 所有方法都不做事
+func newIdleTracker(presence *PresenceService, userId, device string, timeout time.Duration) *idleTracker {
+	t := &idleTracker{presence: presence, userId: userId, device: device, timeout: timeout}
+	if timeout > 0 {
+		t.timer = time.AfterFunc(timeout, t.idle)
+	}
+	return t
+}
+
+// Activity client 送了 activity frame，重新計時，自動 brb 中就轉回 online
+func (t *idleTracker) Activity(ctx context.Context) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.timer == nil || t.stopped {
+		return
+	}
+	t.timer.Reset(t.timeout)
+	if !t.away {
+		return
+	}
+	t.away = false
+	if _, err := t.presence.SetStatus(ctx, t.userId, t.device, StatusOnline); err != nil {
+		log.Println("Idle resume error:", err)
+	}
+}
+
+// SetStatus 手動變更狀態也算活動，之後的 brb 不再視為自動轉的
+func (t *idleTracker) SetStatus(ctx context.Context, status Status) (Presence, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.timer != nil && !t.stopped {
+		t.timer.Reset(t.timeout)
+	}
+	p, err := t.presence.SetStatus(ctx, t.userId, t.device, status)
+	if err == nil {
+		t.away = false
+	}
+	return p, err
+}
+
+func (t *idleTracker) Stop() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.stopped = true
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+}
+
+// idle 只有這個裝置目前是 online 才轉 brb
+func (t *idleTracker) idle() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.stopped || t.away {
+		return
+	}
+	ctx := context.Background()
+	devices, err := t.presence.Devices(ctx, t.userId)
+	if err != nil {
+		log.Println("Idle error:", err)
+		return
+	}
+	if d, ok := findDevice(devices, t.device); !ok || d.Status != StatusOnline {
+		return
+	}
+	if _, err := t.presence.SetStatus(ctx, t.userId, t.device, StatusBeRightBack); err != nil {
+		log.Println("Idle error:", err)
+		return
+	}
+	t.away = true
+	log.Printf("%s idle (%s)", t.userId, t.device)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIdleTracker(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryPresenceStore(DefaultStoreConfig())
+	service := NewPresenceService(store, store, NewLocalPresenceBus())
+	timeout := 30 * time.Millisecond
+
+	statusOf := func() Status {
+		p, err := service.GetFor(ctx, "U1", "U1")
+		require.NoError(t, err)
+		return p.Status
+	}
+
+	_, err := service.Connect(ctx, "U1", "web")
+	require.NoError(t, err)
+	idle := newIdleTracker(service, "U1", "web", timeout)
+	t.Cleanup(idle.Stop)
+
+	// 閒置自動轉 brb，有活動轉回 online
+	require.Eventually(t, func() bool { return statusOf() == StatusBeRightBack }, 10*timeout, 5*time.Millisecond)
+	idle.Activity(ctx)
+	require.Equal(t, StatusOnline, statusOf())
+	require.Eventually(t, func() bool { return statusOf() == StatusBeRightBack }, 10*timeout, 5*time.Millisecond)
+
+	// 手動設定的勿擾不會被閒置蓋掉，活動也不會改回 online
+	_, err = idle.SetStatus(ctx, StatusDoNotDisturb)
+	require.NoError(t, err)
+	time.Sleep(3 * timeout)
+	require.Equal(t, StatusDoNotDisturb, statusOf())
+	idle.Activity(ctx)
+	require.Equal(t, StatusDoNotDisturb, statusOf())
+
+	// 手動設定的 brb 有活動也維持
+	_, err = idle.SetStatus(ctx, StatusBeRightBack)
+	require.NoError(t, err)
+	idle.Activity(ctx)
+	require.Equal(t, StatusBeRightBack, statusOf())
+
+	// 停止後不再變更
+	_, err = idle.SetStatus(ctx, StatusOnline)
+	require.NoError(t, err)
+	idle.Stop()
+	time.Sleep(3 * timeout)
+	require.Equal(t, StatusOnline, statusOf())
+}
+
+func TestWsHandler_IdleActivity(t *testing.T) {
+	cfg := testConnConfig()
+	cfg.IdleTimeout = 100 * time.Millisecond
+	server, url := newTestServer(t, cfg)
+	conn := dialTest(t, url)
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	// activity frame 持續送就不會閒置
+	for i := 0; i < 6; i++ {
+		require.NoError(t, conn.WriteJSON(ClientFrame{Activity: true}))
+		time.Sleep(cfg.IdleTimeout / 3)
+	}
+	require.Equal(t, StatusOnline, statusOf(t, server, "UA"))
+
+	require.Eventually(t, func() bool {
+		return statusOf(t, server, "UA") == StatusBeRightBack
+	}, 5*cfg.IdleTimeout, 5*time.Millisecond)
+	require.NoError(t, conn.WriteJSON(ClientFrame{Activity: true}))
+	require.Eventually(t, func() bool {
+		return statusOf(t, server, "UA") == StatusOnline
+	}, cfg.IdleTimeout, 5*time.Millisecond)
+}
@@ -0,0 +1,526 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/redis/go-redis/v9"
+)
+
+// 壓測：開 N 個 WebSocket client 輪流連到各節點，定期切換狀態並隨機斷線重連，最後回報
+//   - 連線延遲：dial 到收到 presence.self
+//   - 狀態傳遞延遲：狀態變更 (含斷線、重連) 到訂閱者收到 presence.update，分同節點與跨節點
+//   - 各節點 /metrics 的 CPU、記憶體、goroutine 與連線數，有給 -redis 時加上 Redis 的指令數 (heartbeat 頻率對 Redis 的負載)
+//
+// 執行: go run online_loadtest.go -urls ws://node-a:8080/ws,ws://node-b:8080/ws -clients 2000 -duration 1m -redis node-r:6379
+// 每個節點要認得壓測的 token，並放寬同一個 IP 的連線數：
+//   WS_TOKENS="$(go run online_loadtest.go -clients 2000 -print-tokens)" WS_MAX_CONNS_PER_IP=0 REDIS_ADDR=node-r:6379 go run online_server.go ...
+// 傳遞延遲包含 server 的 WS_PRESENCE_DEBOUNCE
+
+type loadConfig struct {
+	urls        []string
+	clients     int
+	watch       int
+	ramp        time.Duration
+	duration    time.Duration
+	statusEvery time.Duration
+	churn       float64
+	redisAddr   string
+}
+
+var loadStatuses = []string{"busy", "be-right-back", "do-not-disturb", "online"}
+
+// loadEnvelope presence.v1 的訊息格式
+type loadEnvelope struct {
+	V       int             `json:"v"`
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+type loadUpdate struct {
+	Presence []struct {
+		UserId string `json:"userId"`
+		Status string `json:"status"`
+	} `json:"presence"`
+}
+
+// loadChange 每個 user 最後一次狀態變更，訂閱者收到相同狀態時算傳遞延遲
+type loadChange struct {
+	status string
+	at     time.Time
+	node   int
+}
+
+type loadStats struct {
+	mu          sync.Mutex
+	connect     []time.Duration
+	sameNode    []time.Duration
+	crossNode   []time.Duration
+	errors      map[string]int
+	connected   int64
+	churned     int64
+	dropped     int64
+	statusSent  int64
+	updatesRecv int64
+}
+
+func (s *loadStats) addConnect(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.connect = append(s.connect, d)
+}
+
+func (s *loadStats) addPropagation(d time.Duration, cross bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if cross {
+		s.crossNode = append(s.crossNode, d)
+	} else {
+		s.sameNode = append(s.sameNode, d)
+	}
+}
+
+func (s *loadStats) addError(reason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.errors[reason]++
+}
+
+type loadTest struct {
+	cfg     loadConfig
+	stats   *loadStats
+	changes sync.Map // userId -> loadChange
+}
+
+type loadClient struct {
+	lt      *loadTest
+	index   int
+	userId  string
+	token   string
+	url     string
+	node    int
+	peers   []string
+	status  int
+	sampled map[string]time.Time // 同一次變更只算一次
+}
+
+func loadUserId(i int) string { return "L" + strconv.Itoa(i) }
+func loadToken(i int) string  { return "load-" + strconv.Itoa(i) }
+
+func newLoadClient(lt *loadTest, i int) *loadClient {
+	n := lt.cfg.clients
+	c := &loadClient{
+		lt:      lt,
+		index:   i,
+		userId:  loadUserId(i),
+		token:   loadToken(i),
+		node:    i % len(lt.cfg.urls),
+		sampled: make(map[string]time.Time),
+	}
+	c.url = lt.cfg.urls[c.node]
+	// 訂閱後面幾個 client，有多個節點時輪流分配，相鄰的 client 會在不同節點
+	for k := 1; k <= lt.cfg.watch && k < n; k++ {
+		c.peers = append(c.peers, loadUserId((i+k)%n))
+	}
+	return c
+}
+
+func (c *loadClient) record(status string) {
+	c.lt.changes.Store(c.userId, loadChange{status: status, at: time.Now(), node: c.node})
+}
+
+func (c *loadClient) run(ctx context.Context) {
+	for ctx.Err() == nil {
+		c.record("online")
+		conn, err := c.connect(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				c.lt.stats.addError(err.Error())
+				sleepCtx(ctx, time.Second+time.Duration(rand.Int63n(int64(time.Second))))
+			}
+			continue
+		}
+		c.session(ctx, conn)
+	}
+}
+
+// connect 連上並等到 presence.self 才算完成
+func (c *loadClient) connect(ctx context.Context) (*websocket.Conn, error) {
+	start := time.Now()
+	dialer := websocket.Dialer{Subprotocols: []string{"presence.v1"}, HandshakeTimeout: 10 * time.Second}
+	u := c.url + "?device=load"
+	conn, resp, err := dialer.DialContext(ctx, u, http.Header{"Authorization": []string{"Bearer " + c.token}})
+	if err != nil {
+		if resp != nil {
+			return nil, fmt.Errorf("HTTP %d", resp.StatusCode)
+		}
+		return nil, errors.New("dial failed")
+	}
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	var env loadEnvelope
+	if err := conn.ReadJSON(&env); err != nil || env.Type != "presence.self" {
+		conn.Close()
+		return nil, errors.New("no presence.self")
+	}
+	conn.SetReadDeadline(time.Time{})
+	c.lt.stats.addConnect(time.Since(start))
+	atomic.AddInt64(&c.lt.stats.connected, 1)
+	return conn, nil
+}
+
+// session 只有這個 goroutine 寫 conn，讀取在另一個 goroutine
+func (c *loadClient) session(ctx context.Context, conn *websocket.Conn) {
+	readErr := make(chan error, 1)
+	go func() { readErr <- c.read(conn) }()
+	defer conn.Close()
+
+	if len(c.peers) > 0 {
+		c.send(conn, "presence.subscribe", map[string][]string{"userIds": c.peers})
+	}
+	statusTimer := time.NewTimer(jitter(c.lt.cfg.statusEvery))
+	defer statusTimer.Stop()
+	// 斷線間隔為指數分布，平均每秒有 churn 比例的 client 斷線
+	var churn <-chan time.Time
+	if c.lt.cfg.churn > 0 {
+		churn = time.After(time.Duration(rand.ExpFloat64() / c.lt.cfg.churn * float64(time.Second)))
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+			return
+		case <-readErr:
+			if ctx.Err() == nil {
+				atomic.AddInt64(&c.lt.stats.dropped, 1)
+			}
+			return
+		case <-statusTimer.C:
+			c.status = (c.status + 1) % len(loadStatuses)
+			c.record(loadStatuses[c.status])
+			c.send(conn, "presence.set_status", map[string]string{"status": loadStatuses[c.status]})
+			atomic.AddInt64(&c.lt.stats.statusSent, 1)
+			statusTimer.Reset(jitter(c.lt.cfg.statusEvery))
+		case <-churn:
+			atomic.AddInt64(&c.lt.stats.churned, 1)
+			c.status = len(loadStatuses) - 1
+			c.record("offline")
+			conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+			conn.Close()
+			<-readErr
+			sleepCtx(ctx, time.Duration(rand.Int63n(int64(time.Second))))
+			return
+		}
+	}
+}
+
+func (c *loadClient) send(conn *websocket.Conn, typ string, payload interface{}) {
+	b, _ := json.Marshal(payload)
+	conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if err := conn.WriteJSON(loadEnvelope{V: 1, Type: typ, Payload: b}); err != nil {
+		conn.Close()
+	}
+}
+
+func (c *loadClient) read(conn *websocket.Conn) error {
+	for {
+		var env loadEnvelope
+		if err := conn.ReadJSON(&env); err != nil {
+			return err
+		}
+		if env.Type != "presence.update" {
+			continue
+		}
+		now := time.Now()
+		atomic.AddInt64(&c.lt.stats.updatesRecv, 1)
+		var update loadUpdate
+		if err := json.Unmarshal(env.Payload, &update); err != nil {
+			continue
+		}
+		for _, p := range update.Presence {
+			v, ok := c.lt.changes.Load(p.UserId)
+			if !ok {
+				continue
+			}
+			change := v.(loadChange)
+			if change.status != p.Status || c.sampled[p.UserId].Equal(change.at) {
+				continue
+			}
+			c.sampled[p.UserId] = change.at
+			c.lt.stats.addPropagation(now.Sub(change.at), change.node != c.node)
+		}
+	}
+}
+
+func jitter(d time.Duration) time.Duration {
+	return d/2 + time.Duration(rand.Int63n(int64(d)))
+}
+
+func sleepCtx(ctx context.Context, d time.Duration) {
+	select {
+	case <-time.After(d):
+	case <-ctx.Done():
+	}
+}
+
+// nodeSample 從 /metrics 抓的數字，沒有的指標為 0
+type nodeSample map[string]float64
+
+var loadMetricNames = []string{
+	"process_cpu_seconds_total",
+	"process_resident_memory_bytes",
+	"go_goroutines",
+	"presence_connections_active",
+	"presence_ping_rtt_seconds_sum",
+	"presence_ping_rtt_seconds_count",
+	"presence_slow_consumers_total",
+}
+
+// metricsURL ws://host/ws -> http://host/metrics
+func metricsURL(wsURL string) string {
+	u, err := url.Parse(wsURL)
+	if err != nil {
+		return ""
+	}
+	u.Scheme = strings.Replace(u.Scheme, "ws", "http", 1)
+	u.Path = "/metrics"
+	u.RawQuery = ""
+	return u.String()
+}
+
+// scrapeNode 只解析用得到的指標，帶 label 的加總
+func scrapeNode(wsURL string) (nodeSample, error) {
+	resp, err := http.Get(metricsURL(wsURL))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	sample := make(nodeSample)
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		name, _, _ := strings.Cut(fields[0], "{")
+		for _, want := range loadMetricNames {
+			if name == want {
+				v, _ := strconv.ParseFloat(fields[1], 64)
+				sample[name] += v
+			}
+		}
+	}
+	return sample, scanner.Err()
+}
+
+// nodeMonitor 定期抓各節點的指標，記錄開始、結束與尖峰
+type nodeMonitor struct {
+	urls  []string
+	mu    sync.Mutex
+	first []nodeSample
+	last  []nodeSample
+	peak  []nodeSample
+}
+
+func newNodeMonitor(urls []string) *nodeMonitor {
+	return &nodeMonitor{
+		urls:  urls,
+		first: make([]nodeSample, len(urls)),
+		last:  make([]nodeSample, len(urls)),
+		peak:  make([]nodeSample, len(urls)),
+	}
+}
+
+func (m *nodeMonitor) scrape() {
+	for i, u := range m.urls {
+		sample, err := scrapeNode(u)
+		if err != nil {
+			continue
+		}
+		m.mu.Lock()
+		if m.first[i] == nil {
+			m.first[i] = sample
+			m.peak[i] = make(nodeSample)
+		}
+		m.last[i] = sample
+		for k, v := range sample {
+			if v > m.peak[i][k] {
+				m.peak[i][k] = v
+			}
+		}
+		m.mu.Unlock()
+	}
+}
+
+func (m *nodeMonitor) run(ctx context.Context, every time.Duration) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		m.scrape()
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// redisStats INFO 的 key:value
+func redisStats(ctx context.Context, rdb *redis.Client) (map[string]string, error) {
+	info, err := rdb.Info(ctx, "stats", "memory").Result()
+	if err != nil {
+		return nil, err
+	}
+	stats := make(map[string]string)
+	for _, line := range strings.Split(info, "\r\n") {
+		if k, v, ok := strings.Cut(line, ":"); ok {
+			stats[k] = v
+		}
+	}
+	return stats, nil
+}
+
+func percentiles(samples []time.Duration) string {
+	if len(samples) == 0 {
+		return "no samples"
+	}
+	sorted := append([]time.Duration(nil), samples...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	at := func(q float64) time.Duration {
+		return sorted[int(q*float64(len(sorted)-1))].Round(time.Millisecond)
+	}
+	return fmt.Sprintf("n=%d p50=%s p90=%s p99=%s max=%s", len(sorted), at(0.5), at(0.9), at(0.99), at(1))
+}
+
+func main() {
+	var cfg loadConfig
+	urls := flag.String("urls", "ws://localhost:8080/ws", "WebSocket URLs of the nodes, comma separated")
+	flag.IntVar(&cfg.clients, "clients", 1000, "number of simulated clients")
+	flag.IntVar(&cfg.watch, "watch", 5, "users each client subscribes to")
+	flag.DurationVar(&cfg.ramp, "ramp", 10*time.Second, "time to open all connections")
+	flag.DurationVar(&cfg.duration, "duration", time.Minute, "test duration after ramp up")
+	flag.DurationVar(&cfg.statusEvery, "status-every", 10*time.Second, "average interval between status changes per client")
+	flag.Float64Var(&cfg.churn, "churn", 0.01, "fraction of clients that disconnect and reconnect per second")
+	flag.StringVar(&cfg.redisAddr, "redis", "", "Redis address to report command load, e.g. localhost:6379")
+	printTokens := flag.Bool("print-tokens", false, "print WS_TOKENS for the server and exit")
+	flag.Parse()
+
+	if *printTokens {
+		pairs := make([]string, cfg.clients)
+		for i := range pairs {
+			pairs[i] = loadToken(i) + ":" + loadUserId(i)
+		}
+		fmt.Println(strings.Join(pairs, ","))
+		return
+	}
+	for _, u := range strings.Split(*urls, ",") {
+		if u = strings.TrimSpace(u); u != "" {
+			cfg.urls = append(cfg.urls, u)
+		}
+	}
+	if len(cfg.urls) == 0 || cfg.clients <= 0 || cfg.statusEvery <= 0 {
+		log.Fatal("urls, clients and status-every are required")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	var rdb *redis.Client
+	var redisBefore map[string]string
+	if cfg.redisAddr != "" {
+		rdb = redis.NewClient(&redis.Options{Addr: cfg.redisAddr})
+		defer rdb.Close()
+		var err error
+		if redisBefore, err = redisStats(ctx, rdb); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	lt := &loadTest{cfg: cfg, stats: &loadStats{errors: make(map[string]int)}}
+	monitor := newNodeMonitor(cfg.urls)
+	monitorCtx, stopMonitor := context.WithCancel(context.Background())
+	go monitor.run(monitorCtx, 5*time.Second)
+
+	log.Printf("opening %d clients to %d nodes over %s", cfg.clients, len(cfg.urls), cfg.ramp)
+	runCtx, cancel := context.WithTimeout(ctx, cfg.ramp+cfg.duration)
+	defer cancel()
+	start := time.Now()
+	var wg sync.WaitGroup
+	step := cfg.ramp / time.Duration(cfg.clients)
+	for i := 0; i < cfg.clients && runCtx.Err() == nil; i++ {
+		wg.Add(1)
+		go func(c *loadClient) {
+			defer wg.Done()
+			c.run(runCtx)
+		}(newLoadClient(lt, i))
+		sleepCtx(runCtx, step)
+	}
+	<-runCtx.Done()
+	wg.Wait()
+	elapsed := time.Since(start)
+	stopMonitor()
+	monitor.scrape()
+
+	s := lt.stats
+	fmt.Printf("\n=== %d clients, %d nodes, %s ===\n", cfg.clients, len(cfg.urls), elapsed.Round(time.Second))
+	fmt.Printf("connects      %d (churned %d, dropped by server %d)\n", s.connected, s.churned, s.dropped)
+	fmt.Printf("connect       %s\n", percentiles(s.connect))
+	fmt.Printf("status sent   %d, updates received %d\n", s.statusSent, s.updatesRecv)
+	fmt.Printf("propagation   same node  %s\n", percentiles(s.sameNode))
+	fmt.Printf("              cross node %s\n", percentiles(s.crossNode))
+	if len(s.errors) > 0 {
+		fmt.Println("connect errors")
+		for reason, n := range s.errors {
+			fmt.Printf("  %-20s %d\n", reason, n)
+		}
+	}
+
+	for i, u := range cfg.urls {
+		first, last, peak := monitor.first[i], monitor.last[i], monitor.peak[i]
+		if first == nil {
+			fmt.Printf("node %s: /metrics unavailable\n", u)
+			continue
+		}
+		cpu := last["process_cpu_seconds_total"] - first["process_cpu_seconds_total"]
+		pings := last["presence_ping_rtt_seconds_count"] - first["presence_ping_rtt_seconds_count"]
+		var rtt time.Duration
+		if pings > 0 {
+			rtt = time.Duration((last["presence_ping_rtt_seconds_sum"] - first["presence_ping_rtt_seconds_sum"]) / pings * float64(time.Second))
+		}
+		fmt.Printf("node %s: cpu %.2f cores, peak rss %.1f MiB, peak goroutines %.0f, peak connections %.0f, avg ping rtt %s, slow consumers %.0f\n",
+			u, cpu/elapsed.Seconds(), peak["process_resident_memory_bytes"]/(1<<20), peak["go_goroutines"],
+			peak["presence_connections_active"], rtt.Round(time.Microsecond),
+			last["presence_slow_consumers_total"]-first["presence_slow_consumers_total"])
+	}
+
+	if rdb != nil {
+		after, err := redisStats(context.Background(), rdb)
+		if err != nil {
+			log.Fatal(err)
+		}
+		before, _ := strconv.ParseFloat(redisBefore["total_commands_processed"], 64)
+		total, _ := strconv.ParseFloat(after["total_commands_processed"], 64)
+		fmt.Printf("redis: %.0f commands (%.0f/s), used memory %s\n", total-before, (total-before)/elapsed.Seconds(), after["used_memory_human"])
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Prometheus 指標，掛在 /metrics；每個節點各自被抓，節點用 Prometheus 的 instance label 區分
+// 方法都接受 nil receiver，沒開 metrics (例如測試) 時不用另外判斷
+
+const (
+	TransportWS   = "ws"
+	TransportSSE  = "sse"
+	TransportPoll = "poll"
+
+	// reject 的原因
+	RejectDraining     = "draining"
+	RejectUnauthorized = "unauthorized"
+	RejectTooMany      = "too_many_connections"
+	RejectUpgrade      = "upgrade_failed"
+	RejectUnavailable  = "presence_unavailable"
+)
+
+type PresenceMetrics struct {
+	reg         prometheus.Registerer
+	upgrades    *prometheus.CounterVec
+	rejects     *prometheus.CounterVec
+	pingRTT     prometheus.Histogram
+	slow        *prometheus.CounterVec
+	transitions *prometheus.CounterVec
+}
+
+func NewPresenceMetrics(reg prometheus.Registerer) *PresenceMetrics {
+	m := &PresenceMetrics{
+		reg: reg,
+		upgrades: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "presence_upgrades_total",
+			Help: "Accepted connections by transport.",
+		}, []string{"transport"}),
+		rejects: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "presence_rejects_total",
+			Help: "Rejected connections by transport and reason.",
+		}, []string{"transport", "reason"}),
+		pingRTT: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "presence_ping_rtt_seconds",
+			Help:    "Round trip time between WebSocket ping and pong.",
+			Buckets: prometheus.ExponentialBuckets(0.005, 2, 12),
+		}),
+		slow: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "presence_slow_consumers_total",
+			Help: "Messages dropped or connections closed because the send queue was full.",
+		}, []string{"policy"}),
+		transitions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "presence_transitions_total",
+			Help: "Presence status changes written by this node, by view and new status.",
+		}, []string{"view", "status"}),
+	}
+	reg.MustRegister(m.upgrades, m.rejects, m.pingRTT, m.slow, m.transitions)
+	return m
+}
+
+// watchHub 連線數與 send queue 在被抓的時候才從 hub 算
+func (m *PresenceMetrics) watchHub(h *Hub) {
+	m.reg.MustRegister(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "presence_connections_active",
+			Help: "Connections currently registered on this node, including SSE and long-poll sessions.",
+		}, func() float64 { return float64(h.Count()) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "presence_send_queue_depth",
+			Help: "Messages waiting in send queues of all connections.",
+		}, func() float64 {
+			total, _ := h.QueueDepth()
+			return float64(total)
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "presence_send_queue_max_depth",
+			Help: "Longest send queue of a single connection.",
+		}, func() float64 {
+			_, max := h.QueueDepth()
+			return float64(max)
+		}),
+	)
+}
+
+func (m *PresenceMetrics) upgrade(transport string) {
+	if m != nil {
+		m.upgrades.WithLabelValues(transport).Inc()
+	}
+}
+
+func (m *PresenceMetrics) reject(transport, reason string) {
+	if m != nil {
+		m.rejects.WithLabelValues(transport, reason).Inc()
+	}
+}
+
+func (m *PresenceMetrics) pong(rtt time.Duration) {
+	if m != nil {
+		m.pingRTT.Observe(rtt.Seconds())
+	}
+}
+
+func (m *PresenceMetrics) slowConsumer(policy SlowConsumerPolicy) {
+	if m != nil {
+		m.slow.WithLabelValues(string(policy)).Inc()
+	}
+}
+
+func (m *PresenceMetrics) transition(view PresenceView, status Status) {
+	if m != nil {
+		m.transitions.WithLabelValues(string(view), string(status)).Inc()
+	}
+}
+
+// Instrument 開始記錄指標，要在接受連線前呼叫
+func (s *PresenceServer) Instrument(m *PresenceMetrics) {
+	s.metrics = m
+	s.hub.metrics = m
+	s.presence.metrics = m
+	m.watchHub(s.hub)
+}
+
+// pingPayload ping 帶送出的時間，pong 會原樣帶回來算 RTT
+func pingPayload(now time.Time) []byte {
+	return []byte(strconv.FormatInt(now.UnixNano(), 10))
+}
+
+// pongRTT 不是 pingPayload 產生的 (例如舊版 client 自己送的 pong) 回傳 false
+func pongRTT(appData string, now time.Time) (time.Duration, bool) {
+	sent, err := strconv.ParseInt(appData, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	rtt := now.Sub(time.Unix(0, sent))
+	return rtt, rtt >= 0
+}
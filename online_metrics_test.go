@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPongRTT(t *testing.T) {
+	now := time.Unix(1695400000, 0)
+	rtt, ok := pongRTT(string(pingPayload(now)), now.Add(15*time.Millisecond))
+	require.True(t, ok)
+	require.Equal(t, 15*time.Millisecond, rtt)
+
+	_, ok = pongRTT("ping", now)
+	require.False(t, ok)
+	_, ok = pongRTT(string(pingPayload(now)), now.Add(-time.Second))
+	require.False(t, ok)
+
+	// 沒開 metrics 時不會 panic
+	var m *PresenceMetrics
+	m.upgrade(TransportWS)
+	m.pong(rtt)
+}
+
+func TestPresenceMetrics(t *testing.T) {
+	cfg := testConnConfig()
+	cfg.PongWait = time.Second
+	cfg.SendBuffer = 1
+	cfg.SlowConsumer = SlowConsumerDrop
+	server, url := newTestServer(t, cfg)
+	reg := prometheus.NewRegistry()
+	m := NewPresenceMetrics(reg)
+	server.Instrument(m)
+
+	conn := dialTest(t, url)
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	_, _, err := websocket.DefaultDialer.Dial(url, nil)
+	require.Error(t, err)
+
+	require.Equal(t, 1.0, testutil.ToFloat64(m.upgrades.WithLabelValues(TransportWS)))
+	require.Equal(t, 1.0, testutil.ToFloat64(m.rejects.WithLabelValues(TransportWS, RejectUnauthorized)))
+	require.Equal(t, 1.0, testutil.ToFloat64(m.transitions.WithLabelValues(string(ViewContacts), string(StatusOnline))))
+
+	// ping 每 20ms 一次，client 回 pong 後記錄 RTT
+	require.Eventually(t, func() bool {
+		families, err := reg.Gather()
+		require.NoError(t, err)
+		for _, f := range families {
+			if f.GetName() == "presence_ping_rtt_seconds" {
+				return f.GetMetric()[0].GetHistogram().GetSampleCount() > 0
+			}
+		}
+		return false
+	}, time.Second, 10*time.Millisecond)
+
+	// 沒有 writePump 的 client 塞滿後丟訊息
+	client := server.hub.RegisterStream("UC", "web", "")
+	require.NoError(t, client.Send([]byte("1")))
+	require.ErrorIs(t, client.Send([]byte("2")), ErrSlowConsumer)
+	require.Equal(t, 1.0, testutil.ToFloat64(m.slow.WithLabelValues(string(SlowConsumerDrop))))
+
+	rec := httptest.NewRecorder()
+	promhttp.HandlerFor(reg, promhttp.HandlerOpts{}).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := rec.Body.String()
+	require.Contains(t, body, "presence_connections_active 2")
+	require.Contains(t, body, "presence_send_queue_depth 1")
+	require.Contains(t, body, "presence_send_queue_max_depth 1")
+	require.Contains(t, body, `presence_upgrades_total{transport="ws"} 1`)
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// online_flow 最後一段的方案 B：狀態 write-behind 寫進 MongoDB，啟動時預先載入
+// 只存每個裝置的狀態，user 的合併狀態與兩份 view 載入後重新計算
+// 每個節點定期更新 presence_nodes 的 heartbeat，超過 NodeTimeout 沒更新的節點視為當機，
+// 它名下還在線的裝置由其他節點改成 offline，last_seen 用它最後一次 heartbeat
+
+// PresenceRecord presence collection 一筆，一個 user 的一個裝置
+type PresenceRecord struct {
+	Id          string    `bson:"_id"` // {uid}:{device}
+	UserId      string    `bson:"uid"`
+	Device      string    `bson:"device"`
+	Status      Status    `bson:"status"`
+	Since       int64     `bson:"since,omitempty"`
+	LastSeen    int64     `bson:"last_seen,omitempty"`
+	ConnectedAt int64     `bson:"connected_at,omitempty"` // 判斷是不是同一次連線，since 會隨狀態變更
+	Node        string    `bson:"node"`
+	UpdatedAt   time.Time `bson:"updated_at"`
+}
+
+func (r PresenceRecord) devicePresence() DevicePresence {
+	return DevicePresence{Device: r.Device, Status: r.Status, Since: r.Since, LastSeen: r.LastSeen, ConnectedAt: r.ConnectedAt}
+}
+
+type presenceNode struct {
+	Id          string    `bson:"_id"`
+	HeartbeatAt time.Time `bson:"heartbeat_at"`
+}
+
+// PersistConfig NodeId 要每台 server 不同，重啟沿用同一個 id 也可以
+type PersistConfig struct {
+	NodeId        string
+	FlushInterval time.Duration
+	NodeTimeout   time.Duration
+	SweepInterval time.Duration
+	// RecordTTL 沒更新的紀錄多久後由 TTL index 刪掉，和 last_seen 保留時間一致
+	RecordTTL time.Duration
+}
+
+func DefaultPersistConfig() PersistConfig {
+	node, _ := os.Hostname()
+	return PersistConfig{
+		NodeId:        node,
+		FlushInterval: time.Second,
+		NodeTimeout:   30 * time.Second,
+		SweepInterval: 15 * time.Second,
+		RecordTTL:     DefaultStoreConfig().LastSeenTTL,
+	}
+}
+
+// MongoPresencePersister 裝置狀態的變更先放在 pending，每 FlushInterval 批次寫入
+// 同一個裝置在一個區間內變很多次只寫最後一次，寫入失敗留到下次再寫
+type MongoPresencePersister struct {
+	records *mongo.Collection
+	nodes   *mongo.Collection
+	cfg     PersistConfig
+	now     func() time.Time
+
+	mu      sync.Mutex
+	pending map[string]PresenceRecord
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+func NewMongoPresencePersister(records, nodes *mongo.Collection, cfg PersistConfig) *MongoPresencePersister {
+	return &MongoPresencePersister{
+		records: records,
+		nodes:   nodes,
+		cfg:     cfg,
+		now:     time.Now,
+		pending: make(map[string]PresenceRecord),
+		done:    make(chan struct{}),
+	}
+}
+
+// EnsurePresenceIndexes 依節點找在線裝置 (sweep) 與過期清除
+func EnsurePresenceIndexes(ctx context.Context, records *mongo.Collection, ttl time.Duration) error {
+	_, err := records.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "node", Value: 1}, {Key: "status", Value: 1}}},
+		{Keys: bson.D{{Key: "updated_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(int32(ttl.Seconds()))},
+	})
+	return err
+}
+
+// Wrap 包住 PresenceStore，裝置狀態寫入成功後排進 pending；心跳 (RefreshDevice) 不寫 MongoDB
+func (p *MongoPresencePersister) Wrap(store PresenceStore) PresenceStore {
+	return &persistingStore{PresenceStore: store, persister: p}
+}
+
+type persistingStore struct {
+	PresenceStore
+	persister *MongoPresencePersister
+}
+
+func (s *persistingStore) SetDevice(ctx context.Context, userId string, d DevicePresence) error {
+	if err := s.PresenceStore.SetDevice(ctx, userId, d); err != nil {
+		return err
+	}
+	s.persister.enqueue(userId, d)
+	return nil
+}
+
+func (s *persistingStore) RemoveDevice(ctx context.Context, userId, device string, lastSeen int64) error {
+	if err := s.PresenceStore.RemoveDevice(ctx, userId, device, lastSeen); err != nil {
+		return err
+	}
+	s.persister.enqueue(userId, DevicePresence{Device: device, Status: StatusOffline, LastSeen: lastSeen})
+	return nil
+}
+
+func (p *MongoPresencePersister) enqueue(userId string, d DevicePresence) {
+	r := PresenceRecord{
+		Id:          userId + ":" + d.Device,
+		UserId:      userId,
+		Device:      d.Device,
+		Status:      d.Status,
+		Since:       d.Since,
+		LastSeen:    d.LastSeen,
+		ConnectedAt: d.ConnectedAt,
+		Node:        p.cfg.NodeId,
+		UpdatedAt:   p.now(),
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.pending[r.Id] = r
+}
+
+// Flush 寫入 pending 的紀錄並更新本節點 heartbeat
+// 只覆蓋 updated_at 比較舊的紀錄，別的節點寫入較新的狀態時 upsert 會撞 _id，忽略
+func (p *MongoPresencePersister) Flush(ctx context.Context) error {
+	p.mu.Lock()
+	batch := p.pending
+	p.pending = make(map[string]PresenceRecord)
+	p.mu.Unlock()
+
+	if _, err := p.nodes.UpdateByID(ctx, p.cfg.NodeId,
+		bson.M{"$set": bson.M{"heartbeat_at": p.now()}}, options.Update().SetUpsert(true)); err != nil {
+		p.requeue(batch)
+		return err
+	}
+	if len(batch) == 0 {
+		return nil
+	}
+
+	models := make([]mongo.WriteModel, 0, len(batch))
+	for _, r := range batch {
+		models = append(models, mongo.NewReplaceOneModel().
+			SetFilter(bson.M{"_id": r.Id, "updated_at": bson.M{"$lte": r.UpdatedAt}}).
+			SetReplacement(r).
+			SetUpsert(true))
+	}
+	_, err := p.records.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	var bulkErr mongo.BulkWriteException
+	if errors.As(err, &bulkErr) && bulkErr.WriteConcernError == nil && onlyDuplicateKeys(bulkErr.WriteErrors) {
+		return nil
+	}
+	if err != nil {
+		p.requeue(batch)
+	}
+	return err
+}
+
+func onlyDuplicateKeys(errs []mongo.BulkWriteError) bool {
+	for _, e := range errs {
+		if !mongo.IsDuplicateKeyError(e) {
+			return false
+		}
+	}
+	return true
+}
+
+// requeue 寫入失敗的放回 pending，期間又有新變更的以新的為準
+func (p *MongoPresencePersister) requeue(batch map[string]PresenceRecord) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for id, r := range batch {
+		if _, ok := p.pending[id]; !ok {
+			p.pending[id] = r
+		}
+	}
+}
+
+// Preload 啟動時把 MongoDB 的狀態載入 store (未包裝的)，要在接受連線前呼叫
+// 本節點上一次執行或已當機節點名下還在線的裝置，直接改成 offline
+// 其他活著的節點名下在線的裝置由該節點維持，不載入；store 裡已經有的裝置見 preloadRecord
+func (p *MongoPresencePersister) Preload(ctx context.Context, store PresenceStore, service *PresenceService) (int, error) {
+	heartbeats, err := p.heartbeats(ctx)
+	if err != nil {
+		return 0, err
+	}
+	cur, err := p.records.Find(ctx, bson.M{})
+	if err != nil {
+		return 0, err
+	}
+	defer cur.Close(ctx)
+
+	users := make(map[string]bool)
+	for cur.Next(ctx) {
+		var r PresenceRecord
+		if err := cur.Decode(&r); err != nil {
+			return 0, err
+		}
+		written, err := p.preloadRecord(ctx, store, r, heartbeats)
+		if err != nil {
+			return 0, err
+		}
+		if written {
+			users[r.UserId] = true
+		}
+	}
+	if err := cur.Err(); err != nil {
+		return 0, err
+	}
+
+	for userId := range users {
+		if _, err := service.aggregate(ctx, userId); err != nil {
+			return 0, err
+		}
+	}
+	return len(users), nil
+}
+
+// preloadRecord 載入一筆紀錄，回傳是否有寫入 store
+// MongoDB 是 write-behind，紀錄可能比 store 舊 (例如其他節點還活著、只有本節點重啟)，store 已經有這個裝置時以 store 為準，
+// 只有 store 裡還是紀錄上的同一次連線 (節點當機沒寫到 offline) 才改成 offline
+func (p *MongoPresencePersister) preloadRecord(ctx context.Context, store PresenceStore, r PresenceRecord, heartbeats map[string]time.Time) (bool, error) {
+	d, ok := p.restoreRecord(r, heartbeats)
+	if !ok {
+		return false, nil
+	}
+	devices, err := store.Devices(ctx, r.UserId)
+	if err != nil {
+		return false, err
+	}
+	if current, ok := findDevice(devices, r.Device); ok {
+		if current.Status == StatusOffline && r.Status != StatusOffline {
+			p.enqueue(r.UserId, current)
+		}
+		if current.Status == StatusOffline || current.ConnectedAt != r.ConnectedAt {
+			return false, nil
+		}
+	}
+	if d.Status == StatusOffline {
+		err = store.RemoveDevice(ctx, r.UserId, d.Device, d.LastSeen)
+		// 改成 offline 的要寫回 MongoDB
+		if r.Status != StatusOffline {
+			p.enqueue(r.UserId, d)
+		}
+	} else {
+		err = store.SetDevice(ctx, r.UserId, d)
+	}
+	return err == nil, err
+}
+
+// restoreRecord 決定一筆紀錄載入後的狀態，false 表示不載入
+func (p *MongoPresencePersister) restoreRecord(r PresenceRecord, heartbeats map[string]time.Time) (DevicePresence, bool) {
+	d := r.devicePresence()
+	if r.Status == StatusOffline {
+		return d, true
+	}
+	heartbeat, known := heartbeats[r.Node]
+	if r.Node != p.cfg.NodeId && known && p.alive(heartbeat) {
+		return DevicePresence{}, false
+	}
+	lastSeen := r.UpdatedAt
+	if known {
+		lastSeen = heartbeat
+	}
+	return DevicePresence{Device: r.Device, Status: StatusOffline, LastSeen: lastSeen.Unix()}, true
+}
+
+func (p *MongoPresencePersister) alive(heartbeat time.Time) bool {
+	return p.now().Sub(heartbeat) < p.cfg.NodeTimeout
+}
+
+func (p *MongoPresencePersister) heartbeats(ctx context.Context) (map[string]time.Time, error) {
+	cur, err := p.nodes.Find(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	var nodes []presenceNode
+	if err := cur.All(ctx, &nodes); err != nil {
+		return nil, err
+	}
+	heartbeats := make(map[string]time.Time, len(nodes))
+	for _, n := range nodes {
+		heartbeats[n.Id] = n.HeartbeatAt
+	}
+	return heartbeats, nil
+}
+
+// Sweep 把當機節點名下還在線的裝置改成 offline，處理完刪掉該節點
+// 多個節點同時 sweep 同一個當機節點也只是重複寫 offline
+func (p *MongoPresencePersister) Sweep(ctx context.Context, service *PresenceService) (int, error) {
+	heartbeats, err := p.heartbeats(ctx)
+	if err != nil {
+		return 0, err
+	}
+	swept := 0
+	for node, heartbeat := range heartbeats {
+		if node == p.cfg.NodeId || p.alive(heartbeat) {
+			continue
+		}
+		var records []PresenceRecord
+		cur, err := p.records.Find(ctx, bson.M{"node": node, "status": bson.M{"$ne": StatusOffline}})
+		if err != nil {
+			return swept, err
+		}
+		if err := cur.All(ctx, &records); err != nil {
+			return swept, err
+		}
+		for _, r := range records {
+			if err := p.reconcile(ctx, service, r, heartbeat.Unix()); err != nil {
+				return swept, err
+			}
+			swept++
+		}
+		if _, err := p.nodes.DeleteOne(ctx, bson.M{"_id": node, "heartbeat_at": heartbeat}); err != nil {
+			return swept, err
+		}
+	}
+	return swept, nil
+}
+
+// reconcile 當機節點名下的一個在線裝置
+// store 裡已經是另一次連線 (connected_at 不同) 就不動，由那次連線寫入的紀錄覆蓋 MongoDB
+func (p *MongoPresencePersister) reconcile(ctx context.Context, service *PresenceService, r PresenceRecord, lastSeen int64) error {
+	devices, err := service.Devices(ctx, r.UserId)
+	if err != nil {
+		return err
+	}
+	current, ok := findDevice(devices, r.Device)
+	switch {
+	case ok && current.Status == StatusOffline:
+		p.enqueue(r.UserId, current)
+		return nil
+	case ok && current.ConnectedAt != r.ConnectedAt:
+		return nil
+	}
+	_, err = service.disconnectAt(ctx, r.UserId, r.Device, r.ConnectedAt, lastSeen)
+	return err
+}
+
+// Start 背景定期 flush 與 sweep，service 要用 Wrap 過的 store 建立
+func (p *MongoPresencePersister) Start(service *PresenceService) {
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		flush := time.NewTicker(p.cfg.FlushInterval)
+		defer flush.Stop()
+		sweep := time.NewTicker(p.cfg.SweepInterval)
+		defer sweep.Stop()
+		for {
+			select {
+			case <-flush.C:
+				if err := p.Flush(context.Background()); err != nil {
+					log.Println("Persist error:", err)
+				}
+			case <-sweep.C:
+				n, err := p.Sweep(context.Background(), service)
+				if err != nil {
+					log.Println("Sweep error:", err)
+				}
+				if n > 0 {
+					log.Printf("swept %d devices of dead nodes", n)
+				}
+			case <-p.done:
+				return
+			}
+		}
+	}()
+}
+
+// Close 停止背景工作並寫入剩下的 pending
+func (p *MongoPresencePersister) Close(ctx context.Context) error {
+	close(p.done)
+	p.wg.Wait()
+	return p.Flush(ctx)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newTestPersister() *MongoPresencePersister {
+	cfg := DefaultPersistConfig()
+	cfg.NodeId = "ws-1"
+	p := NewMongoPresencePersister(nil, nil, cfg)
+	now := time.Unix(1695400000, 0)
+	p.now = func() time.Time { return now }
+	return p
+}
+
+func TestPersistingStore(t *testing.T) {
+	ctx := context.Background()
+	p := newTestPersister()
+	store := p.Wrap(NewMemoryPresenceStore(DefaultStoreConfig()))
+
+	// 同一個裝置只留最後一次，心跳不寫
+	require.NoError(t, store.SetDevice(ctx, "U1", DevicePresence{Device: "web", Status: StatusOnline, Since: 100}))
+	require.NoError(t, store.SetDevice(ctx, "U1", DevicePresence{Device: "web", Status: StatusBusy, Since: 110}))
+	require.NoError(t, store.SetDevice(ctx, "U1", DevicePresence{Device: "mobile", Status: StatusOnline, Since: 120}))
+	_, err := store.RefreshDevice(ctx, "U1", "web")
+	require.NoError(t, err)
+	require.NoError(t, store.RemoveDevice(ctx, "U1", "mobile", 130))
+
+	require.Equal(t, map[string]PresenceRecord{
+		"U1:web": {Id: "U1:web", UserId: "U1", Device: "web", Status: StatusBusy, Since: 110,
+			Node: "ws-1", UpdatedAt: p.now()},
+		"U1:mobile": {Id: "U1:mobile", UserId: "U1", Device: "mobile", Status: StatusOffline, LastSeen: 130,
+			Node: "ws-1", UpdatedAt: p.now()},
+	}, p.pending)
+
+	// 寫入失敗放回去時，期間的新變更優先
+	batch := p.pending
+	p.pending = make(map[string]PresenceRecord)
+	require.NoError(t, store.SetDevice(ctx, "U1", DevicePresence{Device: "web", Status: StatusOnline, Since: 140}))
+	p.requeue(batch)
+	require.Len(t, p.pending, 2)
+	require.Equal(t, StatusOnline, p.pending["U1:web"].Status)
+	require.Equal(t, StatusOffline, p.pending["U1:mobile"].Status)
+}
+
+func TestPersister_RestoreRecord(t *testing.T) {
+	p := newTestPersister()
+	alive := p.now().Add(-time.Second)
+	dead := p.now().Add(-time.Hour)
+	updated := p.now().Add(-2 * time.Hour)
+	heartbeats := map[string]time.Time{"ws-1": dead, "ws-2": alive, "ws-3": dead}
+
+	tests := []struct {
+		name   string
+		record PresenceRecord
+		want   DevicePresence
+		ok     bool
+	}{
+		{"offline keeps last seen",
+			PresenceRecord{Device: "web", Status: StatusOffline, LastSeen: 100, Node: "ws-2"},
+			DevicePresence{Device: "web", Status: StatusOffline, LastSeen: 100}, true},
+		{"online on alive node is left to that node",
+			PresenceRecord{Device: "web", Status: StatusOnline, Since: 100, Node: "ws-2"},
+			DevicePresence{}, false},
+		{"online from previous run of this node",
+			PresenceRecord{Device: "web", Status: StatusBusy, Since: 100, Node: "ws-1", UpdatedAt: updated},
+			DevicePresence{Device: "web", Status: StatusOffline, LastSeen: dead.Unix()}, true},
+		{"online on dead node",
+			PresenceRecord{Device: "web", Status: StatusOnline, Since: 100, Node: "ws-3", UpdatedAt: updated},
+			DevicePresence{Device: "web", Status: StatusOffline, LastSeen: dead.Unix()}, true},
+		{"online on unknown node uses updated at",
+			PresenceRecord{Device: "web", Status: StatusOnline, Since: 100, Node: "ws-9", UpdatedAt: updated},
+			DevicePresence{Device: "web", Status: StatusOffline, LastSeen: updated.Unix()}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := p.restoreRecord(tt.record, heartbeats)
+			require.Equal(t, tt.ok, ok)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestPersister_Reconcile(t *testing.T) {
+	ctx := context.Background()
+	p := newTestPersister()
+	store := NewMemoryPresenceStore(DefaultStoreConfig())
+	service := NewPresenceService(p.Wrap(store), store, NewLocalPresenceBus())
+
+	// 當機節點上的連線還在 store 裡：改成 offline，last_seen 用該節點最後的 heartbeat
+	// 最後一次 flush 之後狀態變過 (since 不同) 也是同一次連線
+	require.NoError(t, store.SetDevice(ctx, "U1", DevicePresence{Device: "web", Status: StatusBusy, Since: 120, ConnectedAt: 100000}))
+	require.NoError(t, p.reconcile(ctx, service, PresenceRecord{UserId: "U1", Device: "web", Status: StatusOnline, Since: 100, ConnectedAt: 100000, Node: "ws-3"}, 150))
+	p1, err := service.Get(ctx, "U1")
+	require.NoError(t, err)
+	require.Equal(t, Presence{UserId: "U1", Status: StatusOffline, LastSeen: 150}, p1)
+	require.Equal(t, StatusOffline, p.pending["U1:web"].Status)
+
+	// 已經在別的節點重新連上 (connected_at 不同)，不動
+	p.pending = make(map[string]PresenceRecord)
+	_, err = service.Connect(ctx, "U2", "web")
+	require.NoError(t, err)
+	delete(p.pending, "U2:web")
+	devices, err := service.Devices(ctx, "U2")
+	require.NoError(t, err)
+	require.NoError(t, p.reconcile(ctx, service, PresenceRecord{UserId: "U2", Device: "web", Status: StatusOnline, Since: devices[0].Since, ConnectedAt: 1, Node: "ws-3"}, 150))
+	p2, err := service.Get(ctx, "U2")
+	require.NoError(t, err)
+	require.Equal(t, StatusOnline, p2.Status)
+	require.Empty(t, p.pending)
+}
+
+func TestPersister_PreloadRecord(t *testing.T) {
+	ctx := context.Background()
+	p := newTestPersister()
+	store := NewMemoryPresenceStore(DefaultStoreConfig())
+	dead := p.now().Add(-time.Hour)
+	heartbeats := map[string]time.Time{"ws-1": dead, "ws-2": p.now(), "ws-3": dead}
+	device := func(userId string) DevicePresence {
+		devices, err := store.Devices(ctx, userId)
+		require.NoError(t, err)
+		require.Len(t, devices, 1)
+		return devices[0]
+	}
+
+	// store 沒有 (冷啟動的 Redis)：依紀錄載入
+	written, err := p.preloadRecord(ctx, store, PresenceRecord{UserId: "U1", Device: "web", Status: StatusOffline, LastSeen: 100, Node: "ws-2"}, heartbeats)
+	require.NoError(t, err)
+	require.True(t, written)
+	require.Equal(t, DevicePresence{Device: "web", Status: StatusOffline, LastSeen: 100}, device("U1"))
+
+	// 舊的 offline 紀錄不能把其他節點上正在線的裝置轉 offline
+	online := DevicePresence{Device: "web", Status: StatusOnline, Since: 200, ConnectedAt: 200000}
+	require.NoError(t, store.SetDevice(ctx, "U2", online))
+	written, err = p.preloadRecord(ctx, store, PresenceRecord{UserId: "U2", Device: "web", Status: StatusOffline, LastSeen: 100, Node: "ws-2"}, heartbeats)
+	require.NoError(t, err)
+	require.False(t, written)
+	require.Equal(t, online, device("U2"))
+
+	// 當機節點的舊連線，store 裡已經是新的連線
+	written, err = p.preloadRecord(ctx, store, PresenceRecord{UserId: "U2", Device: "web", Status: StatusOnline, ConnectedAt: 100000, Node: "ws-3"}, heartbeats)
+	require.NoError(t, err)
+	require.False(t, written)
+	require.Equal(t, online, device("U2"))
+
+	// store 裡還是當機節點的同一次連線：改成 offline 並寫回 MongoDB
+	written, err = p.preloadRecord(ctx, store, PresenceRecord{UserId: "U2", Device: "web", Status: StatusOnline, ConnectedAt: 200000, Node: "ws-3"}, heartbeats)
+	require.NoError(t, err)
+	require.True(t, written)
+	require.Equal(t, DevicePresence{Device: "web", Status: StatusOffline, LastSeen: dead.Unix()}, device("U2"))
+	require.Equal(t, StatusOffline, p.pending["U2:web"].Status)
+}
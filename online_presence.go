@@ -0,0 +1,415 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"reflect"
+	"sync"
+	"time"
+)
+
+type Status string
+
+// 5 種在線狀態 (見 online 筆記)
+const (
+	StatusOnline       Status = "online"
+	StatusOffline      Status = "offline"
+	StatusBeRightBack  Status = "be-right-back"
+	StatusBusy         Status = "busy"
+	StatusDoNotDisturb Status = "do-not-disturb"
+)
+
+func (s Status) Valid() bool {
+	switch s {
+	case StatusOnline, StatusOffline, StatusBeRightBack, StatusBusy, StatusDoNotDisturb:
+		return true
+	}
+	return false
+}
+
+var (
+	ErrInvalidStatus = errors.New("invalid status")
+	// ErrReconnected 斷線時同一個裝置已經是另一次連線，不轉 offline
+	ErrReconnected = errors.New("device reconnected")
+)
+
+// Presence 對應筆記中的 {"status": "busy", "since": 1695392100, "device": "mobile"}
+// offline 時 LastSeen 是最後下線時間；Custom 為自訂狀態，只有上線時才有
+type Presence struct {
+	UserId   string        `json:"userId"`
+	Status   Status        `json:"status"`
+	Since    int64         `json:"since,omitempty"`
+	Device   string        `json:"device,omitempty"`
+	LastSeen int64         `json:"lastSeen,omitempty"`
+	Custom   *CustomStatus `json:"customStatus,omitempty"`
+}
+
+// DevicePresence 單一裝置的狀態，offline 時只剩 LastSeen
+type DevicePresence struct {
+	Device   string `json:"device"`
+	Status   Status `json:"status"`
+	Since    int64  `json:"since,omitempty"`
+	LastSeen int64  `json:"lastSeen,omitempty"`
+	// ConnectedAt 這次連線開始的 unix 毫秒，since 會隨狀態變更，要用這個判斷裝置是否已被另一次連線取代
+	ConnectedAt int64 `json:"connectedAt,omitempty"`
+}
+
+// statusPriority 多裝置合併時優先權高的勝出：勿擾 > 忙碌 > 在線 > 馬上回來 > 離線
+var statusPriority = map[Status]int{
+	StatusOffline:      0,
+	StatusBeRightBack:  1,
+	StatusOnline:       2,
+	StatusBusy:         3,
+	StatusDoNotDisturb: 4,
+}
+
+// AggregatePresence 依各裝置狀態算出 user 對外的狀態
+// 任一裝置在線就不是 offline；同優先權取最近變更的裝置；全部 offline 時 LastSeen 取最晚的
+func AggregatePresence(userId string, devices []DevicePresence) Presence {
+	p := Presence{UserId: userId, Status: StatusOffline}
+	for _, d := range devices {
+		if d.Status == StatusOffline {
+			if d.LastSeen > p.LastSeen {
+				p.LastSeen = d.LastSeen
+			}
+			continue
+		}
+		if statusPriority[d.Status] > statusPriority[p.Status] ||
+			(d.Status == p.Status && d.Since > p.Since) {
+			p.Status, p.Since, p.Device = d.Status, d.Since, d.Device
+		}
+	}
+	if p.Status != StatusOffline {
+		p.LastSeen = 0
+	}
+	return p
+}
+
+// PresenceService 每個裝置各自記錄狀態，再合併成 user 的狀態，實際資料放在 PresenceStore
+// 合併結果依隱私設定寫成 public / contacts 兩份，有變才透過 PresenceBus 廣播給其他節點
+type PresenceService struct {
+	store   PresenceStore
+	privacy PrivacyStore
+	bus     PresenceBus
+	metrics *PresenceMetrics
+
+	// expiries 自訂狀態到期時重新合併的 timer
+	mu       sync.Mutex
+	expiries map[string]*time.Timer
+
+	// aggregating 同一個 user 的合併在本節點依序執行
+	aggregating userLocks
+}
+
+func NewPresenceService(store PresenceStore, privacy PrivacyStore, bus PresenceBus) *PresenceService {
+	return &PresenceService{store: store, privacy: privacy, bus: bus, expiries: make(map[string]*time.Timer)}
+}
+
+// userLocks 每個 user 一把鎖，沒人用就刪掉
+type userLocks struct {
+	mu    sync.Mutex
+	locks map[string]*userLock
+}
+
+type userLock struct {
+	sync.Mutex
+	refs int
+}
+
+// Lock 回傳 unlock
+func (l *userLocks) Lock(userId string) func() {
+	l.mu.Lock()
+	if l.locks == nil {
+		l.locks = make(map[string]*userLock)
+	}
+	lock, ok := l.locks[userId]
+	if !ok {
+		lock = &userLock{}
+		l.locks[userId] = lock
+	}
+	lock.refs++
+	l.mu.Unlock()
+
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if lock.refs--; lock.refs == 0 {
+			delete(l.locks, userId)
+		}
+	}
+}
+
+// Connect WebSocket 連上時把這個裝置標記 online
+func (s *PresenceService) Connect(ctx context.Context, userId, device string) (Presence, error) {
+	return s.connectAt(ctx, userId, device, time.Now())
+}
+
+// connectAt 指定連線開始的時間，斷線時用 disconnectAt 帶回來判斷裝置是否已被另一次連線取代
+func (s *PresenceService) connectAt(ctx context.Context, userId, device string, connected time.Time) (Presence, error) {
+	d := DevicePresence{Device: device, Status: StatusOnline, Since: connected.Unix(), ConnectedAt: connected.UnixMilli()}
+	if err := s.store.SetDevice(ctx, userId, d); err != nil {
+		return Presence{}, err
+	}
+	return s.aggregate(ctx, userId)
+}
+
+// Disconnect 連線關閉或 pong 逾時時把這個裝置標記 offline，只留 last_seen
+func (s *PresenceService) Disconnect(ctx context.Context, userId, device string) (Presence, error) {
+	return s.disconnectAt(ctx, userId, device, 0, time.Now().Unix())
+}
+
+// disconnectAt 指定 last_seen，節點當機時用該節點最後一次 heartbeat 的時間
+// connectedAt 不為 0 時，裝置已經是之後的另一次連線 (例如在其他節點重連後，舊連線才逾時) 就不動，回傳 ErrReconnected
+func (s *PresenceService) disconnectAt(ctx context.Context, userId, device string, connectedAt, lastSeen int64) (Presence, error) {
+	if connectedAt != 0 {
+		devices, err := s.store.Devices(ctx, userId)
+		if err != nil {
+			return Presence{}, err
+		}
+		if current, ok := findDevice(devices, device); ok && current.Status != StatusOffline && current.ConnectedAt > connectedAt {
+			return Presence{}, ErrReconnected
+		}
+	}
+	if err := s.store.RemoveDevice(ctx, userId, device, lastSeen); err != nil {
+		return Presence{}, err
+	}
+	return s.aggregate(ctx, userId)
+}
+
+// Heartbeat 收到 pong 時延長裝置與 user 的 TTL，key 已經過期 (例如 Redis 重啟) 就重新寫回
+func (s *PresenceService) Heartbeat(ctx context.Context, userId, device string) error {
+	return s.heartbeatAt(ctx, userId, device, time.Now())
+}
+
+// heartbeatAt 重新寫回時沿用原本連線開始的時間，之後斷線才不會被當成已被取代
+func (s *PresenceService) heartbeatAt(ctx context.Context, userId, device string, connected time.Time) error {
+	ok, err := s.store.RefreshDevice(ctx, userId, device)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		_, err = s.connectAt(ctx, userId, device, connected)
+		return err
+	}
+	// 兩份都不在線 (過期或被隱藏) 才重新合併，隱藏的 user 重新合併也不會寫入
+	refreshed := false
+	for _, view := range []PresenceView{ViewPublic, ViewContacts} {
+		ok, err := s.store.Refresh(ctx, view, userId)
+		if err != nil {
+			return err
+		}
+		refreshed = refreshed || ok
+	}
+	if refreshed {
+		return nil
+	}
+	_, err = s.aggregate(ctx, userId)
+	return err
+}
+
+// SetStatus client 主動切換某個裝置的狀態，offline 只能由斷線產生
+func (s *PresenceService) SetStatus(ctx context.Context, userId, device string, status Status) (Presence, error) {
+	if !status.Valid() || status == StatusOffline {
+		return Presence{}, ErrInvalidStatus
+	}
+	devices, err := s.store.Devices(ctx, userId)
+	if err != nil {
+		return Presence{}, err
+	}
+	current, ok := findDevice(devices, device)
+	if !ok || current.Status == StatusOffline {
+		return Presence{}, errors.New("user not connected")
+	}
+	if current.Status != status {
+		d := DevicePresence{Device: device, Status: status, Since: time.Now().Unix(), ConnectedAt: current.ConnectedAt}
+		if err := s.store.SetDevice(ctx, userId, d); err != nil {
+			return Presence{}, err
+		}
+	}
+	return s.aggregate(ctx, userId)
+}
+
+// SetVisibility 變更隱私設定後馬上重寫兩份狀態
+func (s *PresenceService) SetVisibility(ctx context.Context, userId string, v Visibility) (Presence, error) {
+	if !v.Valid() {
+		return Presence{}, ErrInvalidVisibility
+	}
+	if err := s.privacy.SetVisibility(ctx, userId, v); err != nil {
+		return Presence{}, err
+	}
+	return s.aggregate(ctx, userId)
+}
+
+// Get 所有人看得到的狀態，查不到就回 offline
+func (s *PresenceService) Get(ctx context.Context, userId string) (Presence, error) {
+	p, err := s.store.Get(ctx, ViewPublic, userId)
+	return withoutExpired(p), err
+}
+
+// GetFor viewer 看到的狀態：本人看真實狀態，聯絡人看 contacts，其他人看 public
+func (s *PresenceService) GetFor(ctx context.Context, viewerId, userId string) (Presence, error) {
+	if viewerId == userId {
+		devices, err := s.store.Devices(ctx, userId)
+		if err != nil {
+			return Presence{}, err
+		}
+		return s.withCustomStatus(ctx, AggregatePresence(userId, devices))
+	}
+	contact, err := s.privacy.IsContact(ctx, userId, viewerId)
+	if err != nil {
+		return Presence{}, err
+	}
+	view := ViewPublic
+	if contact {
+		view = ViewContacts
+	}
+	p, err := s.store.Get(ctx, view, userId)
+	return withoutExpired(p), err
+}
+
+// Devices 各裝置的狀態與 last seen
+func (s *PresenceService) Devices(ctx context.Context, userId string) ([]DevicePresence, error) {
+	return s.store.Devices(ctx, userId)
+}
+
+// maxAggregateRetries 合併期間裝置一直被其他節點改動時最多重試幾次
+const maxAggregateRetries = 3
+
+// aggregate 重新合併各裝置狀態，依隱私設定寫回兩份 view，回傳本人看到的真實狀態
+// 本節點用 per-user 鎖依序執行；其他節點可能同時合併，讀到的裝置已經過時的話會蓋掉對方較新的結果，
+// 所以寫完再讀一次裝置，有變就用新的裝置重新合併，最後寫入的一定是對應最新裝置的結果
+func (s *PresenceService) aggregate(ctx context.Context, userId string) (Presence, error) {
+	unlock := s.aggregating.Lock(userId)
+	defer unlock()
+	devices, err := s.store.Devices(ctx, userId)
+	if err != nil {
+		return Presence{}, err
+	}
+	for attempt := 0; ; attempt++ {
+		p, err := s.writeAggregate(ctx, userId, devices)
+		if err != nil {
+			return Presence{}, err
+		}
+		latest, err := s.store.Devices(ctx, userId)
+		if err != nil {
+			return Presence{}, err
+		}
+		if reflect.DeepEqual(latest, devices) {
+			return p, nil
+		}
+		if attempt == maxAggregateRetries {
+			log.Printf("Aggregate %s: devices still changing after %d retries", userId, attempt)
+			return p, nil
+		}
+		devices = latest
+	}
+}
+
+// writeAggregate 用讀到的裝置合併並寫回兩份 view
+// 兩份的變更相同時只廣播一次 (不分 view)，不同時各自廣播
+func (s *PresenceService) writeAggregate(ctx context.Context, userId string, devices []DevicePresence) (Presence, error) {
+	visibility, err := s.privacy.Visibility(ctx, userId)
+	if err != nil {
+		return Presence{}, err
+	}
+	p, err := s.withCustomStatus(ctx, AggregatePresence(userId, devices))
+	if err != nil {
+		return Presence{}, err
+	}
+	if p.Status == StatusOffline && p.LastSeen == 0 {
+		p.LastSeen = time.Now().Unix()
+	}
+
+	views := presenceViews(p, visibility)
+	changes := make(map[PresenceView]Presence)
+	for _, view := range []PresenceView{ViewPublic, ViewContacts} {
+		written, changed, err := s.writeView(ctx, view, views[view])
+		if err != nil {
+			return Presence{}, err
+		}
+		if changed {
+			changes[view] = written
+			s.metrics.transition(view, written.Status)
+		}
+		// 狀態沒變時沿用 store 裡原本的 since
+		if view == ViewContacts && visibility != VisibilityNobody {
+			p.Since = written.Since
+		}
+	}
+
+	public, publicChanged := changes[ViewPublic]
+	contacts, contactsChanged := changes[ViewContacts]
+	switch {
+	case publicChanged && contactsChanged && reflect.DeepEqual(public, contacts):
+		s.publish(ctx, "", public)
+	default:
+		if publicChanged {
+			s.publish(ctx, ViewPublic, public)
+		}
+		if contactsChanged {
+			s.publish(ctx, ViewContacts, contacts)
+		}
+	}
+	return p, nil
+}
+
+// writeView 寫入一份 view，回傳實際存的狀態，以及 status 或自訂狀態是否有變 (要不要廣播)
+// status 沒變時沿用原本的 since，只換主要裝置不算狀態變更
+func (s *PresenceService) writeView(ctx context.Context, view PresenceView, p Presence) (Presence, bool, error) {
+	current, err := s.store.Get(ctx, view, p.UserId)
+	if err != nil {
+		return Presence{}, false, err
+	}
+
+	if p.Status == StatusOffline {
+		if current.Status == StatusOffline {
+			// 改成隱藏時連舊的 last_seen 也要清掉
+			if p.LastSeen == 0 && current.LastSeen != 0 {
+				return p, false, s.store.Remove(ctx, view, p.UserId, 0)
+			}
+			// store 裡沒有 last_seen (例如重啟後從 MongoDB 載入) 時補寫
+			if p.LastSeen != 0 && current.LastSeen == 0 {
+				return p, false, s.store.Remove(ctx, view, p.UserId, p.LastSeen)
+			}
+			return current, false, nil
+		}
+		return p, true, s.store.Remove(ctx, view, p.UserId, p.LastSeen)
+	}
+
+	if current.Status == p.Status {
+		p.Since = current.Since
+		if !current.Custom.Equal(p.Custom) {
+			return p, true, s.store.Set(ctx, view, p)
+		}
+		if current.Device == p.Device {
+			ok, err := s.store.Refresh(ctx, view, p.UserId)
+			if err != nil || ok {
+				return current, false, err
+			}
+		}
+		return p, false, s.store.Set(ctx, view, p)
+	}
+	return p, true, s.store.Set(ctx, view, p)
+}
+
+// publish 失敗只影響其他節點的即時通知，狀態已經寫進 store，不回傳錯誤
+// view 為空表示 public 和 contacts 看到的一樣
+func (s *PresenceService) publish(ctx context.Context, view PresenceView, p Presence) {
+	e := newStatusChangeEvent(p)
+	e.View = view
+	if err := s.bus.Publish(ctx, e); err != nil {
+		log.Println("Publish error:", err)
+	}
+}
+
+func findDevice(devices []DevicePresence, device string) (DevicePresence, bool) {
+	for _, d := range devices {
+		if d.Device == device {
+			return d, true
+		}
+	}
+	return DevicePresence{}, false
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAggregatePresence(t *testing.T) {
+	tests := []struct {
+		name    string
+		devices []DevicePresence
+		want    Presence
+	}{
+		{"no devices", nil, Presence{UserId: "U1", Status: StatusOffline}},
+		{"all offline keeps latest last seen", []DevicePresence{
+			{Device: "web", Status: StatusOffline, LastSeen: 100},
+			{Device: "mobile", Status: StatusOffline, LastSeen: 200},
+		}, Presence{UserId: "U1", Status: StatusOffline, LastSeen: 200}},
+		{"any device online", []DevicePresence{
+			{Device: "web", Status: StatusOffline, LastSeen: 100},
+			{Device: "mobile", Status: StatusOnline, Since: 50},
+		}, Presence{UserId: "U1", Status: StatusOnline, Since: 50, Device: "mobile"}},
+		{"online beats be-right-back", []DevicePresence{
+			{Device: "web", Status: StatusBeRightBack, Since: 100},
+			{Device: "mobile", Status: StatusOnline, Since: 50},
+		}, Presence{UserId: "U1", Status: StatusOnline, Since: 50, Device: "mobile"}},
+		{"do-not-disturb wins", []DevicePresence{
+			{Device: "web", Status: StatusBusy, Since: 100},
+			{Device: "mobile", Status: StatusDoNotDisturb, Since: 50},
+			{Device: "desktop", Status: StatusOnline, Since: 150},
+		}, Presence{UserId: "U1", Status: StatusDoNotDisturb, Since: 50, Device: "mobile"}},
+		{"same status takes latest device", []DevicePresence{
+			{Device: "web", Status: StatusOnline, Since: 100},
+			{Device: "mobile", Status: StatusOnline, Since: 150},
+		}, Presence{UserId: "U1", Status: StatusOnline, Since: 150, Device: "mobile"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, AggregatePresence("U1", tt.devices))
+		})
+	}
+}
+
+func TestPresenceService_MultiDevice(t *testing.T) {
+	ctx := context.Background()
+	bus := NewLocalPresenceBus()
+	var events []PresenceEvent
+	_, err := bus.Subscribe(func(e PresenceEvent) { events = append(events, e) })
+	require.NoError(t, err)
+	store := NewMemoryPresenceStore(DefaultStoreConfig())
+	service := NewPresenceService(store, store, bus)
+
+	p, err := service.Connect(ctx, "U1", "web")
+	require.NoError(t, err)
+	require.Equal(t, StatusOnline, p.Status)
+	require.Len(t, events, 1)
+
+	// 第二個裝置上線，合併後還是 online，不廣播
+	_, err = service.Connect(ctx, "U1", "mobile")
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+
+	p, err = service.SetStatus(ctx, "U1", "mobile", StatusDoNotDisturb)
+	require.NoError(t, err)
+	require.Equal(t, StatusDoNotDisturb, p.Status)
+	require.Equal(t, "mobile", p.Device)
+	require.Len(t, events, 2)
+
+	// web 斷線，mobile 還是勿擾
+	p, err = service.Disconnect(ctx, "U1", "web")
+	require.NoError(t, err)
+	require.Equal(t, StatusDoNotDisturb, p.Status)
+	require.Len(t, events, 2)
+
+	devices, err := service.Devices(ctx, "U1")
+	require.NoError(t, err)
+	require.Len(t, devices, 2)
+	require.Equal(t, "mobile", devices[0].Device)
+	require.Equal(t, StatusOffline, devices[1].Status)
+	require.NotZero(t, devices[1].LastSeen)
+
+	_, err = service.SetStatus(ctx, "U1", "web", StatusBusy)
+	require.Error(t, err)
+
+	// 最後一個裝置斷線才轉 offline
+	p, err = service.Disconnect(ctx, "U1", "mobile")
+	require.NoError(t, err)
+	require.Equal(t, StatusOffline, p.Status)
+	require.Len(t, events, 3)
+	require.Equal(t, StatusOffline, events[2].Status)
+	require.Equal(t, p.LastSeen, events[2].Timestamp)
+
+	// 重複斷線不再廣播
+	_, err = service.Disconnect(ctx, "U1", "mobile")
+	require.NoError(t, err)
+	require.Len(t, events, 3)
+}
+
+// racingStore 第一次讀裝置之後先讓另一個節點跑完 (模擬兩個節點同時合併同一個 user)
+type racingStore struct {
+	*MemoryPresenceStore
+	race func()
+}
+
+func (s *racingStore) Devices(ctx context.Context, userId string) ([]DevicePresence, error) {
+	devices, err := s.MemoryPresenceStore.Devices(ctx, userId)
+	if race := s.race; race != nil {
+		s.race = nil
+		race()
+	}
+	return devices, err
+}
+
+func TestPresenceService_AggregateRace(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryPresenceStore(DefaultStoreConfig())
+	node1 := NewPresenceService(store, store, NewLocalPresenceBus())
+	racing := &racingStore{MemoryPresenceStore: store}
+	node2 := NewPresenceService(racing, store, NewLocalPresenceBus())
+
+	_, err := node1.Connect(ctx, "U1", "web")
+	require.NoError(t, err)
+
+	// node2 讀到的還是 online，寫入前 node1 已經斷線並寫好 offline，node2 不能用舊的裝置蓋回 online
+	racing.race = func() {
+		_, err := node1.Disconnect(ctx, "U1", "web")
+		require.NoError(t, err)
+	}
+	p, err := node2.aggregate(ctx, "U1")
+	require.NoError(t, err)
+	require.Equal(t, StatusOffline, p.Status)
+	for _, view := range []PresenceView{ViewPublic, ViewContacts} {
+		p, err := store.Get(ctx, view, "U1")
+		require.NoError(t, err)
+		require.Equal(t, StatusOffline, p.Status)
+	}
+	require.Empty(t, node2.aggregating.locks)
+}
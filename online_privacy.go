@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"errors"
+)
+
+// Visibility 對應筆記中的 ShowOnlineStatus，改成三種範圍
+type Visibility string
+
+const (
+	VisibilityEveryone Visibility = "everyone"
+	VisibilityContacts Visibility = "contacts"
+	VisibilityNobody   Visibility = "nobody"
+)
+
+func (v Visibility) Valid() bool {
+	switch v {
+	case VisibilityEveryone, VisibilityContacts, VisibilityNobody:
+		return true
+	}
+	return false
+}
+
+var ErrInvalidVisibility = errors.New("invalid visibility")
+
+// PrivacyStore 隱私設定與聯絡人 (friends:{userId})，沒設定過視為 everyone
+type PrivacyStore interface {
+	Visibility(ctx context.Context, userId string) (Visibility, error)
+	SetVisibility(ctx context.Context, userId string, v Visibility) error
+	// IsContact viewerId 是否在 userId 的聯絡人裡
+	IsContact(ctx context.Context, userId, viewerId string) (bool, error)
+	SetContacts(ctx context.Context, userId string, contacts []string) error
+}
+
+// presenceViews 依隱私設定算出 public 與 contacts 兩份要寫入的狀態
+// 被隱藏的一律是沒有 last_seen 的 offline，看不出最後上線時間
+func presenceViews(p Presence, v Visibility) map[PresenceView]Presence {
+	hidden := Presence{UserId: p.UserId, Status: StatusOffline}
+	switch v {
+	case VisibilityContacts:
+		return map[PresenceView]Presence{ViewPublic: hidden, ViewContacts: p}
+	case VisibilityNobody:
+		return map[PresenceView]Presence{ViewPublic: hidden, ViewContacts: hidden}
+	}
+	return map[PresenceView]Presence{ViewPublic: p, ViewContacts: p}
+}
+
+func (s *MemoryPresenceStore) Visibility(ctx context.Context, userId string) (Visibility, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if v, ok := s.settings[userId]; ok {
+		return v, nil
+	}
+	return VisibilityEveryone, nil
+}
+
+func (s *MemoryPresenceStore) SetVisibility(ctx context.Context, userId string, v Visibility) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.settings[userId] = v
+	return nil
+}
+
+func (s *MemoryPresenceStore) IsContact(ctx context.Context, userId, viewerId string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.contacts[userId][viewerId], nil
+}
+
+func (s *MemoryPresenceStore) SetContacts(ctx context.Context, userId string, contacts []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	set := make(map[string]bool, len(contacts))
+	for _, c := range contacts {
+		set[c] = true
+	}
+	s.contacts[userId] = set
+	return nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPresenceService_Visibility(t *testing.T) {
+	ctx := context.Background()
+	bus := NewLocalPresenceBus()
+	var events []PresenceEvent
+	_, err := bus.Subscribe(func(e PresenceEvent) { events = append(events, e) })
+	require.NoError(t, err)
+	store := NewMemoryPresenceStore(DefaultStoreConfig())
+	service := NewPresenceService(store, store, bus)
+	require.NoError(t, store.SetContacts(ctx, "U1", []string{"UC"}))
+
+	statusFor := func(viewerId string) Presence {
+		p, err := service.GetFor(ctx, viewerId, "U1")
+		require.NoError(t, err)
+		return p
+	}
+
+	// 只給聯絡人看：public 一直是 offline，只廣播給聯絡人
+	_, err = service.SetVisibility(ctx, "U1", VisibilityContacts)
+	require.NoError(t, err)
+	_, err = service.Connect(ctx, "U1", "web")
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	require.Equal(t, ViewContacts, events[0].View)
+	require.Equal(t, StatusOnline, statusFor("UC").Status)
+	require.Equal(t, StatusOffline, statusFor("UB").Status)
+	require.Equal(t, StatusOnline, statusFor("U1").Status)
+	n, err := store.OnlineCount(ctx)
+	require.NoError(t, err)
+	require.Equal(t, int64(0), n)
+
+	// 不給任何人看，本人仍看得到真實狀態
+	p, err := service.SetVisibility(ctx, "U1", VisibilityNobody)
+	require.NoError(t, err)
+	require.Equal(t, StatusOnline, p.Status)
+	require.Len(t, events, 2)
+	require.Equal(t, PresenceEvent{Event: EventStatusChange, UserId: "U1", Status: StatusOffline, View: ViewContacts}, events[1])
+	require.Equal(t, Presence{UserId: "U1", Status: StatusOffline}, statusFor("UC"))
+	_, err = service.SetStatus(ctx, "U1", "web", StatusBusy)
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+	require.Equal(t, StatusBusy, statusFor("U1").Status)
+
+	// 公開後兩份一樣，只廣播一次
+	_, err = service.SetVisibility(ctx, "U1", VisibilityEveryone)
+	require.NoError(t, err)
+	require.Len(t, events, 3)
+	require.Empty(t, events[2].View)
+	require.Equal(t, StatusBusy, statusFor("UB").Status)
+
+	// 下線後再隱藏，舊的 last_seen 也看不到
+	_, err = service.Disconnect(ctx, "U1", "web")
+	require.NoError(t, err)
+	require.NotZero(t, statusFor("UB").LastSeen)
+	_, err = service.SetVisibility(ctx, "U1", VisibilityNobody)
+	require.NoError(t, err)
+	require.Equal(t, Presence{UserId: "U1", Status: StatusOffline}, statusFor("UB"))
+	require.Len(t, events, 4)
+
+	_, err = service.SetVisibility(ctx, "U1", "friends")
+	require.ErrorIs(t, err, ErrInvalidVisibility)
+}
+
+// UB 是 UA 的聯絡人、UC 不是，兩人都訂閱 UA
+func TestPresenceNotifier_Visibility(t *testing.T) {
+	ctx := context.Background()
+	cfg := testConnConfig()
+	store := NewMemoryPresenceStore(DefaultStoreConfig())
+	require.NoError(t, store.SetContacts(ctx, "UA", []string{"UB"}))
+	require.NoError(t, store.SetVisibility(ctx, "UA", VisibilityContacts))
+	_, url := newTestNode(t, cfg, store, NewLocalPresenceBus())
+
+	b := dialAs(t, url, "tokenB")
+	c := dialAs(t, url, "tokenC")
+	read := func(conn interface{ ReadJSON(interface{}) error }) PresenceEvent {
+		var frame PresenceBatchFrame
+		require.NoError(t, conn.ReadJSON(&frame))
+		require.Len(t, frame.Presence, 1)
+		return frame.Presence[0]
+	}
+	b.SetReadDeadline(time.Now().Add(time.Second))
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	for _, conn := range []interface{ WriteJSON(interface{}) error }{b, c} {
+		require.NoError(t, conn.WriteJSON(ClientFrame{Subscribe: []string{"UA"}}))
+	}
+	require.Equal(t, StatusOffline, read(b).Status)
+	require.Equal(t, StatusOffline, read(c).Status)
+
+	a := dialTest(t, url)
+	e := read(b)
+	require.Equal(t, StatusOnline, e.Status)
+	require.Empty(t, e.View)
+
+	// UC 第一次收到的是公開之後的 online，之前只給聯絡人的變更沒有送給 UC
+	require.NoError(t, a.WriteJSON(ClientFrame{Visibility: VisibilityEveryone}))
+	require.Equal(t, StatusOnline, read(c).Status)
+}
+
+func TestPrivacyStore(t *testing.T) {
+	ctx := context.Background()
+	for name, newStore := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			s, _ := newStore()
+			store := s.(PrivacyStore)
+
+			v, err := store.Visibility(ctx, "U1")
+			require.NoError(t, err)
+			require.Equal(t, VisibilityEveryone, v)
+			require.NoError(t, store.SetVisibility(ctx, "U1", VisibilityNobody))
+			v, err = store.Visibility(ctx, "U1")
+			require.NoError(t, err)
+			require.Equal(t, VisibilityNobody, v)
+
+			require.NoError(t, store.SetContacts(ctx, "U1", []string{"U2", "U3"}))
+			ok, err := store.IsContact(ctx, "U1", "U2")
+			require.NoError(t, err)
+			require.True(t, ok)
+			require.NoError(t, store.SetContacts(ctx, "U1", []string{"U3"}))
+			ok, err = store.IsContact(ctx, "U1", "U2")
+			require.NoError(t, err)
+			require.False(t, ok)
+		})
+	}
+}
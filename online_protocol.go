@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// v1 協定：upgrade 時帶 Sec-WebSocket-Protocol: presence.v1，之後雙向都是 Envelope
+// 沒帶的連線維持舊格式 (ClientFrame / Presence / PresenceBatchFrame / ErrorFrame)
+//
+// client -> server {"v": 1, "type": "presence.subscribe", "id": "42", "payload": {"userIds": ["U2"]}}
+// server -> client {"v": 1, "type": "ack", "ack": "42", "payload": {"presence": [...]}}
+//                  {"v": 1, "type": "error", "ack": "42", "payload": {"code": "bad_request", "message": "..."}}
+//                  {"v": 1, "type": "presence.update", "payload": {"presence": [...]}}
+// id 由 client 自訂，回應的 ack 帶同一個 id；沒帶 id 的請求有結果時一樣回 ack (ack 為空)
+
+const (
+	ProtocolV1      = "presence.v1"
+	protocolVersion = 1
+
+	maxTextSize = 2000
+	maxUserIds  = 100
+)
+
+type Envelope struct {
+	V       int             `json:"v"`
+	Type    MessageType     `json:"type"`
+	Id      string          `json:"id,omitempty"`
+	Ack     string          `json:"ack,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+type MessageType string
+
+const (
+	// client -> server
+	MsgSetStatus     MessageType = "presence.set_status"
+	MsgSetVisibility MessageType = "presence.set_visibility"
+	MsgSetCustom     MessageType = "presence.set_custom_status"
+	MsgActivity      MessageType = "presence.activity"
+	MsgSubscribe     MessageType = "presence.subscribe"
+	MsgUnsubscribe   MessageType = "presence.unsubscribe"
+	MsgSendMessage   MessageType = "message.send"
+	MsgTyping        MessageType = "typing"
+	MsgRead          MessageType = "read"
+
+	// server -> client
+	MsgPresenceSelf   MessageType = "presence.self"   // 連上時自己的狀態
+	MsgPresenceUpdate MessageType = "presence.update" // 訂閱對象的狀態變更
+	MsgReconnect      MessageType = "reconnect"       // 節點要關機，請換一台重連
+	MsgAck            MessageType = "ack"
+	MsgError          MessageType = "error"
+)
+
+type SetStatusPayload struct {
+	Status Status `json:"status"`
+}
+
+type SetVisibilityPayload struct {
+	Visibility Visibility `json:"visibility"`
+}
+
+// SetCustomStatusPayload text 和 emoji 都空表示清除
+type SetCustomStatusPayload struct {
+	CustomStatus
+}
+
+type ActivityPayload struct{}
+
+// SubscribePayload userIds 和 channelId 擇一
+type SubscribePayload struct {
+	UserIds   []string `json:"userIds,omitempty"`
+	ChannelId string   `json:"channelId,omitempty"`
+}
+
+// SendMessagePayload 給 user (to) 或 channel 擇一
+type SendMessagePayload struct {
+	To        string `json:"to,omitempty"`
+	ChannelId string `json:"channelId,omitempty"`
+	Text      string `json:"text"`
+}
+
+type TypingPayload struct {
+	To        string `json:"to,omitempty"`
+	ChannelId string `json:"channelId,omitempty"`
+	Typing    bool   `json:"typing"`
+}
+
+type ReadPayload struct {
+	ChannelId string `json:"channelId"`
+	MessageId string `json:"messageId"`
+}
+
+type ErrorPayload struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+const (
+	ErrCodeBadRequest  = "bad_request"
+	ErrCodeUnknownType = "unknown_type"
+	ErrCodeTooLarge    = "too_large"
+	ErrCodeVersion     = "unsupported_version"
+	ErrCodeUnsupported = "unsupported"
+	ErrCodeRejected    = "rejected"
+)
+
+// ProtocolError 會原樣回給 client 的錯誤
+type ProtocolError struct {
+	Code    string
+	Message string
+}
+
+func (e *ProtocolError) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+func protocolErrorf(code, format string, args ...interface{}) *ProtocolError {
+	return &ProtocolError{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+type payloadValidator interface {
+	Validate() error
+}
+
+// messageSchemas client 可以送的 type 與對應的 payload
+var messageSchemas = map[MessageType]func() payloadValidator{
+	MsgSetStatus:     func() payloadValidator { return &SetStatusPayload{} },
+	MsgSetVisibility: func() payloadValidator { return &SetVisibilityPayload{} },
+	MsgSetCustom:     func() payloadValidator { return &SetCustomStatusPayload{} },
+	MsgActivity:      func() payloadValidator { return &ActivityPayload{} },
+	MsgSubscribe:     func() payloadValidator { return &SubscribePayload{} },
+	MsgUnsubscribe:   func() payloadValidator { return &SubscribePayload{} },
+	MsgSendMessage:   func() payloadValidator { return &SendMessagePayload{} },
+	MsgTyping:        func() payloadValidator { return &TypingPayload{} },
+	MsgRead:          func() payloadValidator { return &ReadPayload{} },
+}
+
+func (p *SetStatusPayload) Validate() error {
+	if !p.Status.Valid() || p.Status == StatusOffline {
+		return ErrInvalidStatus
+	}
+	return nil
+}
+
+func (p *SetVisibilityPayload) Validate() error {
+	if !p.Visibility.Valid() {
+		return ErrInvalidVisibility
+	}
+	return nil
+}
+
+func (p *SetCustomStatusPayload) Validate() error {
+	return p.CustomStatus.Validate(time.Now())
+}
+
+func (p *ActivityPayload) Validate() error {
+	return nil
+}
+
+func (p *SubscribePayload) Validate() error {
+	if (len(p.UserIds) == 0) == (p.ChannelId == "") {
+		return errors.New("exactly one of userIds and channelId is required")
+	}
+	if len(p.UserIds) > maxUserIds {
+		return fmt.Errorf("at most %d userIds", maxUserIds)
+	}
+	for _, userId := range p.UserIds {
+		if userId == "" {
+			return errors.New("empty userId")
+		}
+	}
+	return nil
+}
+
+func (p *SendMessagePayload) Validate() error {
+	if (p.To == "") == (p.ChannelId == "") {
+		return errors.New("exactly one of to and channelId is required")
+	}
+	if p.Text == "" || len(p.Text) > maxTextSize {
+		return fmt.Errorf("text must be 1 to %d bytes", maxTextSize)
+	}
+	return nil
+}
+
+func (p *TypingPayload) Validate() error {
+	if (p.To == "") == (p.ChannelId == "") {
+		return errors.New("exactly one of to and channelId is required")
+	}
+	return nil
+}
+
+func (p *ReadPayload) Validate() error {
+	if p.ChannelId == "" || p.MessageId == "" {
+		return errors.New("channelId and messageId are required")
+	}
+	return nil
+}
+
+// DecodeEnvelope 檢查大小 (maxSize 為 0 不限制)、版本、type 與 payload 欄位，多出來的欄位一律拒絕
+// 錯誤都是 *ProtocolError；能讀到 id 時回傳的 Envelope 會帶 id，方便回錯誤時對應
+func DecodeEnvelope(data []byte, maxSize int64) (Envelope, payloadValidator, error) {
+	var env Envelope
+	if maxSize > 0 && int64(len(data)) > maxSize {
+		return env, nil, protocolErrorf(ErrCodeTooLarge, "frame exceeds %d bytes", maxSize)
+	}
+	if err := decodeStrict(data, &env); err != nil {
+		return env, nil, protocolErrorf(ErrCodeBadRequest, "invalid envelope: %v", err)
+	}
+	if env.V != protocolVersion {
+		return env, nil, protocolErrorf(ErrCodeVersion, "version %d is not supported", env.V)
+	}
+	newPayload, ok := messageSchemas[env.Type]
+	if !ok {
+		return env, nil, protocolErrorf(ErrCodeUnknownType, "unknown type %q", env.Type)
+	}
+	payload := newPayload()
+	if len(env.Payload) > 0 {
+		if err := decodeStrict(env.Payload, payload); err != nil {
+			return env, nil, protocolErrorf(ErrCodeBadRequest, "invalid %s payload: %v", env.Type, err)
+		}
+	}
+	if err := payload.Validate(); err != nil {
+		return env, nil, protocolErrorf(ErrCodeBadRequest, "invalid %s payload: %v", env.Type, err)
+	}
+	return env, payload, nil
+}
+
+func decodeStrict(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return errors.New("trailing data")
+	}
+	return nil
+}
+
+// NewEnvelope server 送出的訊息，ack 為對應請求的 id
+func NewEnvelope(typ MessageType, ack string, payload interface{}) (Envelope, error) {
+	env := Envelope{V: protocolVersion, Type: typ, Ack: ack}
+	if payload != nil {
+		b, err := json.Marshal(payload)
+		if err != nil {
+			return env, err
+		}
+		env.Payload = b
+	}
+	return env, nil
+}
+
+// errorEnvelope 非 ProtocolError 的錯誤 (例如訂閱超過上限) 以 rejected 回傳
+func errorEnvelope(ack string, err error) Envelope {
+	var perr *ProtocolError
+	if !errors.As(err, &perr) {
+		perr = &ProtocolError{Code: ErrCodeRejected, Message: err.Error()}
+	}
+	env, _ := NewEnvelope(MsgError, ack, ErrorPayload{Code: perr.Code, Message: perr.Message})
+	return env
+}
+
+// SendEvent 依連線協定送出：v1 包成 Envelope，舊格式直接送 payload
+func (c *Client) SendEvent(typ MessageType, payload interface{}) error {
+	msg, err := c.marshalEvent(typ, payload)
+	if err != nil {
+		return err
+	}
+	return c.Send(msg)
+}
+
+func (c *Client) marshalEvent(typ MessageType, payload interface{}) ([]byte, error) {
+	if c.protocol != ProtocolV1 {
+		return json.Marshal(payload)
+	}
+	env, err := NewEnvelope(typ, "", payload)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(env)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecodeEnvelope(t *testing.T) {
+	tests := []struct {
+		name    string
+		frame   string
+		code    string
+		payload payloadValidator
+	}{
+		{"set status", `{"v":1,"type":"presence.set_status","id":"1","payload":{"status":"busy"}}`, "",
+			&SetStatusPayload{Status: StatusBusy}},
+		{"activity without payload", `{"v":1,"type":"presence.activity"}`, "", &ActivityPayload{}},
+		{"subscribe channel", `{"v":1,"type":"presence.subscribe","payload":{"channelId":"DDA/DA"}}`, "",
+			&SubscribePayload{ChannelId: "DDA/DA"}},
+		{"typing", `{"v":1,"type":"typing","payload":{"to":"U2","typing":true}}`, "",
+			&TypingPayload{To: "U2", Typing: true}},
+		{"read receipt", `{"v":1,"type":"read","payload":{"channelId":"DDA/DA","messageId":"M1"}}`, "",
+			&ReadPayload{ChannelId: "DDA/DA", MessageId: "M1"}},
+		{"not json", `hello`, ErrCodeBadRequest, nil},
+		{"trailing data", `{"v":1,"type":"presence.activity"} {}`, ErrCodeBadRequest, nil},
+		{"unknown envelope field", `{"v":1,"type":"presence.activity","extra":1}`, ErrCodeBadRequest, nil},
+		{"missing version", `{"type":"presence.activity"}`, ErrCodeVersion, nil},
+		{"future version", `{"v":2,"type":"presence.activity"}`, ErrCodeVersion, nil},
+		{"unknown type", `{"v":1,"type":"presence.delete"}`, ErrCodeUnknownType, nil},
+		{"server only type", `{"v":1,"type":"ack"}`, ErrCodeUnknownType, nil},
+		{"unknown payload field", `{"v":1,"type":"presence.set_status","payload":{"status":"busy","mood":"happy"}}`, ErrCodeBadRequest, nil},
+		{"invalid status", `{"v":1,"type":"presence.set_status","payload":{"status":"offline"}}`, ErrCodeBadRequest, nil},
+		{"subscribe both", `{"v":1,"type":"presence.subscribe","payload":{"userIds":["U2"],"channelId":"DDA/DA"}}`, ErrCodeBadRequest, nil},
+		{"message without text", `{"v":1,"type":"message.send","payload":{"to":"U2","text":""}}`, ErrCodeBadRequest, nil},
+		{"oversized", `{"v":1,"type":"message.send","payload":{"to":"U2","text":"` + strings.Repeat("a", 300) + `"}}`, ErrCodeTooLarge, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, payload, err := DecodeEnvelope([]byte(tt.frame), 256)
+			if tt.code == "" {
+				require.NoError(t, err)
+				require.Equal(t, tt.payload, payload)
+				return
+			}
+			var perr *ProtocolError
+			require.ErrorAs(t, err, &perr)
+			require.Equal(t, tt.code, perr.Code)
+			require.Nil(t, payload)
+		})
+	}
+
+	// 錯誤回應要帶請求的 id
+	env, _, err := DecodeEnvelope([]byte(`{"v":1,"type":"nope","id":"7"}`), 0)
+	require.Error(t, err)
+	require.Equal(t, "7", errorEnvelope(env.Id, err).Ack)
+}
+
+func TestWsHandler_ProtocolV1(t *testing.T) {
+	cfg := testConnConfig()
+	cfg.PongWait = time.Second
+	cfg.MaxSubscriptions = 10
+	server, url := newTestServer(t, cfg)
+	dialer := websocket.Dialer{Subprotocols: []string{ProtocolV1}}
+
+	dial := func(token string) *websocket.Conn {
+		conn, resp, err := dialer.Dial(url, http.Header{"Authorization": []string{"Bearer " + token}})
+		require.NoError(t, err)
+		require.Equal(t, ProtocolV1, resp.Header.Get("Sec-WebSocket-Protocol"))
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+	read := func(conn *websocket.Conn) Envelope {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		var env Envelope
+		require.NoError(t, conn.ReadJSON(&env))
+		return env
+	}
+	send := func(conn *websocket.Conn, typ MessageType, id string, payload interface{}) {
+		env, err := NewEnvelope(typ, "", payload)
+		require.NoError(t, err)
+		env.Id = id
+		require.NoError(t, conn.WriteJSON(env))
+	}
+
+	a := dial("tokenA")
+	env := read(a)
+	require.Equal(t, MsgPresenceSelf, env.Type)
+
+	// 請求與回應用 id 對應
+	send(a, MsgSubscribe, "sub-1", SubscribePayload{UserIds: []string{"UB"}})
+	env = read(a)
+	require.Equal(t, MsgAck, env.Type)
+	require.Equal(t, "sub-1", env.Ack)
+	var snapshot PresenceBatchFrame
+	require.NoError(t, json.Unmarshal(env.Payload, &snapshot))
+	require.Equal(t, StatusOffline, snapshot.Presence[0].Status)
+
+	// activity 沒帶 id 不回，下一個收到的是錯誤
+	send(a, MsgActivity, "", nil)
+	send(a, MsgSendMessage, "msg-1", SendMessagePayload{To: "UB", Text: "hi"})
+	env = read(a)
+	require.Equal(t, MsgError, env.Type)
+	require.Equal(t, "msg-1", env.Ack)
+	var errPayload ErrorPayload
+	require.NoError(t, json.Unmarshal(env.Payload, &errPayload))
+	require.Equal(t, ErrCodeUnsupported, errPayload.Code)
+
+	// 舊格式的 frame 在 v1 連線上不接受
+	require.NoError(t, a.WriteMessage(websocket.TextMessage, []byte(`{"status":"busy"}`)))
+	env = read(a)
+	require.Equal(t, MsgError, env.Type)
+	require.NoError(t, json.Unmarshal(env.Payload, &errPayload))
+	require.Equal(t, ErrCodeBadRequest, errPayload.Code)
+
+	// 訂閱對象的變更包成 presence.update
+	dial("tokenB")
+	env = read(a)
+	require.Equal(t, MsgPresenceUpdate, env.Type)
+	var update PresenceBatchFrame
+	require.NoError(t, json.Unmarshal(env.Payload, &update))
+	require.Equal(t, "UB", update.Presence[0].UserId)
+	require.Equal(t, StatusOnline, update.Presence[0].Status)
+	require.Equal(t, StatusOnline, statusOf(t, server, "UB"))
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// 好友 / 群組的批次查詢 (見 online_flow 筆記的 SINTER / SINTERCARD)
+// Redis 版查詢前先依到期時間清掉 hash 已過期的 user (節點當機沒跑到 Remove)，結果和 in-memory 版一致
+
+// BulkPresenceStore 批次查詢，Redis 用 set 交集，in-memory 逐一比對
+type BulkPresenceStore interface {
+	// OnlineAmong 這些 user 裡哪些在線，順序照輸入
+	OnlineAmong(ctx context.Context, view PresenceView, userIds []string) ([]string, error)
+	// OnlineFriends friends:{userId} 裡 userId 看得到在線的，和 GetFor 一樣：
+	// 對方也把 userId 列為聯絡人 (friends:{friend}) 才看 contacts view，否則看 public view
+	OnlineFriends(ctx context.Context, userId string) ([]string, error)
+	// SetGroupMembers 快取群組成員 group_members:{groupId}，ttl 後重新從來源載入
+	SetGroupMembers(ctx context.Context, groupId string, members []string, ttl time.Duration) error
+	// CountOnlineInGroup 群組在線人數 (public view)，沒有快取時 cached 為 false
+	CountOnlineInGroup(ctx context.Context, groupId string) (n int64, cached bool, err error)
+}
+
+// PresenceQuery 群組成員沒快取時從 AudienceResolver 載入 (channel 成員)
+type PresenceQuery struct {
+	store    BulkPresenceStore
+	audience AudienceResolver
+	groupTTL time.Duration
+}
+
+func NewPresenceQuery(store BulkPresenceStore, audience AudienceResolver, groupTTL time.Duration) *PresenceQuery {
+	return &PresenceQuery{store: store, audience: audience, groupTTL: groupTTL}
+}
+
+// OnlineAmong 任意名單只用 public view，看不到只對聯絡人公開的人
+func (q *PresenceQuery) OnlineAmong(ctx context.Context, userIds []string) ([]string, error) {
+	return q.store.OnlineAmong(ctx, ViewPublic, userIds)
+}
+
+// OnlineFriends 單向的好友關係看不到對方只對聯絡人公開的狀態
+func (q *PresenceQuery) OnlineFriends(ctx context.Context, userId string) ([]string, error) {
+	return q.store.OnlineFriends(ctx, userId)
+}
+
+// CountOnline channel 的在線人數
+func (q *PresenceQuery) CountOnline(ctx context.Context, channelId string) (int64, error) {
+	n, cached, err := q.store.CountOnlineInGroup(ctx, channelId)
+	if err != nil || cached {
+		return n, err
+	}
+	members, err := q.audience.Audience(ctx, channelId)
+	if err != nil {
+		return 0, err
+	}
+	if err := q.store.SetGroupMembers(ctx, channelId, members, q.groupTTL); err != nil {
+		return 0, err
+	}
+	n, _, err = q.store.CountOnlineInGroup(ctx, channelId)
+	return n, err
+}
+
+type memoryGroup struct {
+	members   map[string]bool
+	expiresAt time.Time
+}
+
+func (s *MemoryPresenceStore) OnlineAmong(ctx context.Context, view PresenceView, userIds []string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	online := []string{}
+	for _, userId := range userIds {
+		if s.onlineLocked(view, userId) {
+			online = append(online, userId)
+		}
+	}
+	return online, nil
+}
+
+func (s *MemoryPresenceStore) OnlineFriends(ctx context.Context, userId string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	online := []string{}
+	for friend := range s.contacts[userId] {
+		if s.onlineLocked(friendView(s.contacts[friend][userId]), friend) {
+			online = append(online, friend)
+		}
+	}
+	return online, nil
+}
+
+// friendView 對方有沒有把 viewer 列為聯絡人，決定 viewer 看到哪一份
+func friendView(contact bool) PresenceView {
+	if contact {
+		return ViewContacts
+	}
+	return ViewPublic
+}
+
+func (s *MemoryPresenceStore) SetGroupMembers(ctx context.Context, groupId string, members []string, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	set := make(map[string]bool, len(members))
+	for _, m := range members {
+		set[m] = true
+	}
+	s.groups[groupId] = memoryGroup{members: set, expiresAt: s.now().Add(ttl)}
+	return nil
+}
+
+// CountOnlineInGroup 從小的一邊開始比對，和 SINTERCARD 一樣是 O(min(N, M))
+func (s *MemoryPresenceStore) CountOnlineInGroup(ctx context.Context, groupId string) (int64, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	g, ok := s.groups[groupId]
+	if !ok || !s.now().Before(g.expiresAt) {
+		delete(s.groups, groupId)
+		return 0, false, nil
+	}
+
+	var n int64
+	if len(g.members) <= len(s.entries[ViewPublic]) {
+		for userId := range g.members {
+			if s.onlineLocked(ViewPublic, userId) {
+				n++
+			}
+		}
+		return n, true, nil
+	}
+	for userId := range s.entries[ViewPublic] {
+		if g.members[userId] && s.onlineLocked(ViewPublic, userId) {
+			n++
+		}
+	}
+	return n, true, nil
+}
+
+// onlineLocked 呼叫端需持有鎖
+func (s *MemoryPresenceStore) onlineLocked(view PresenceView, userId string) bool {
+	e, ok := s.lookup(view, userId)
+	return ok && e.presence.Status != StatusOffline
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBulkPresenceStore(t *testing.T) {
+	ctx := context.Background()
+
+	for name, newStore := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			s, advance := newStore()
+			store := s.(testStore)
+
+			// U1 公開在線、U2 只對聯絡人在線、U3 離線
+			require.NoError(t, store.Set(ctx, ViewPublic, Presence{UserId: "U1", Status: StatusOnline, Since: 1}))
+			require.NoError(t, store.Set(ctx, ViewContacts, Presence{UserId: "U1", Status: StatusOnline, Since: 1}))
+			require.NoError(t, store.Remove(ctx, ViewPublic, "U2", 0))
+			require.NoError(t, store.Set(ctx, ViewContacts, Presence{UserId: "U2", Status: StatusBusy, Since: 1}))
+			require.NoError(t, store.Remove(ctx, ViewPublic, "U3", 1))
+
+			online, err := store.OnlineAmong(ctx, ViewPublic, []string{"U3", "U2", "U1", "U4"})
+			require.NoError(t, err)
+			require.Equal(t, []string{"U1"}, online)
+			online, err = store.OnlineAmong(ctx, ViewContacts, []string{"U3", "U2", "U1"})
+			require.NoError(t, err)
+			require.Equal(t, []string{"U2", "U1"}, online)
+			online, err = store.OnlineAmong(ctx, ViewPublic, nil)
+			require.NoError(t, err)
+			require.Empty(t, online)
+
+			// U9 單方面把大家列為好友：U1 公開在線看得到，U2 只對聯絡人在線，要 U2 也列了 U9 才看得到
+			require.NoError(t, store.SetContacts(ctx, "U9", []string{"U1", "U2", "U3"}))
+			online, err = store.OnlineFriends(ctx, "U9")
+			require.NoError(t, err)
+			require.ElementsMatch(t, []string{"U1"}, online)
+			require.NoError(t, store.SetContacts(ctx, "U2", []string{"U9"}))
+			online, err = store.OnlineFriends(ctx, "U9")
+			require.NoError(t, err)
+			require.ElementsMatch(t, []string{"U1", "U2"}, online)
+			// U1 只把 U9 列為聯絡人時，U9 看的是 contacts view
+			require.NoError(t, store.Remove(ctx, ViewPublic, "U1", 0))
+			online, err = store.OnlineFriends(ctx, "U9")
+			require.NoError(t, err)
+			require.ElementsMatch(t, []string{"U2"}, online)
+			require.NoError(t, store.SetContacts(ctx, "U1", []string{"U9"}))
+			online, err = store.OnlineFriends(ctx, "U9")
+			require.NoError(t, err)
+			require.ElementsMatch(t, []string{"U1", "U2"}, online)
+			require.NoError(t, store.Set(ctx, ViewPublic, Presence{UserId: "U1", Status: StatusOnline, Since: 1}))
+			online, err = store.OnlineFriends(ctx, "U8")
+			require.NoError(t, err)
+			require.Empty(t, online)
+
+			_, cached, err := store.CountOnlineInGroup(ctx, "G1")
+			require.NoError(t, err)
+			require.False(t, cached)
+
+			require.NoError(t, store.SetGroupMembers(ctx, "G1", []string{"U1", "U2", "U3"}, time.Minute))
+			n, cached, err := store.CountOnlineInGroup(ctx, "G1")
+			require.NoError(t, err)
+			require.True(t, cached)
+			require.Equal(t, int64(1), n)
+
+			// 快取到期要重新載入
+			advance(time.Minute)
+			_, cached, err = store.CountOnlineInGroup(ctx, "G1")
+			require.NoError(t, err)
+			require.False(t, cached)
+		})
+	}
+}
+
+// 沒有 Remove (節點當機) 只靠 TTL 過期的 user，批次查詢也不能再算在線
+func TestBulkPresenceStore_Expired(t *testing.T) {
+	ctx := context.Background()
+	cfg := DefaultStoreConfig()
+
+	for name, newStore := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			s, advance := newStore()
+			store := s.(testStore)
+
+			for _, userId := range []string{"U1", "U2"} {
+				p := Presence{UserId: userId, Status: StatusOnline, Since: 1}
+				require.NoError(t, store.Set(ctx, ViewPublic, p))
+				require.NoError(t, store.Set(ctx, ViewContacts, p))
+			}
+			require.NoError(t, store.SetContacts(ctx, "U9", []string{"U1", "U2"}))
+			require.NoError(t, store.SetGroupMembers(ctx, "G1", []string{"U1", "U2"}, time.Hour))
+
+			// 只有 U2 有心跳
+			advance(cfg.TTL - time.Second)
+			for _, view := range []PresenceView{ViewPublic, ViewContacts} {
+				ok, err := store.Refresh(ctx, view, "U2")
+				require.NoError(t, err)
+				require.True(t, ok)
+			}
+			advance(2 * time.Second)
+
+			n, err := store.OnlineCount(ctx)
+			require.NoError(t, err)
+			require.Equal(t, int64(1), n)
+			online, err := store.OnlineAmong(ctx, ViewPublic, []string{"U1", "U2"})
+			require.NoError(t, err)
+			require.Equal(t, []string{"U2"}, online)
+			online, err = store.OnlineFriends(ctx, "U9")
+			require.NoError(t, err)
+			require.Equal(t, []string{"U2"}, online)
+			n, _, err = store.CountOnlineInGroup(ctx, "G1")
+			require.NoError(t, err)
+			require.Equal(t, int64(1), n)
+
+			// 過期的 user 心跳回 false，重新 Set 後又算在線
+			ok, err := store.Refresh(ctx, ViewPublic, "U1")
+			require.NoError(t, err)
+			require.False(t, ok)
+			require.NoError(t, store.Set(ctx, ViewPublic, Presence{UserId: "U1", Status: StatusOnline, Since: 2}))
+			n, err = store.OnlineCount(ctx)
+			require.NoError(t, err)
+			require.Equal(t, int64(2), n)
+
+			advance(cfg.TTL)
+			n, err = store.OnlineCount(ctx)
+			require.NoError(t, err)
+			require.Zero(t, n)
+		})
+	}
+}
+
+func TestPresenceQuery_CountOnline(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryPresenceStore(DefaultStoreConfig())
+	query := NewPresenceQuery(store, StaticAudienceResolver{"DDA/DA": {"UA", "UB", "UC"}}, time.Minute)
+
+	require.NoError(t, store.Set(ctx, ViewPublic, Presence{UserId: "UA", Status: StatusOnline, Since: 1}))
+	require.NoError(t, store.Set(ctx, ViewPublic, Presence{UserId: "UX", Status: StatusOnline, Since: 1}))
+
+	n, err := query.CountOnline(ctx, "DDA/DA")
+	require.NoError(t, err)
+	require.Equal(t, int64(1), n)
+
+	// 成員已快取，之後上線的直接算進去
+	require.NoError(t, store.Set(ctx, ViewPublic, Presence{UserId: "UB", Status: StatusBusy, Since: 1}))
+	n, err = query.CountOnline(ctx, "DDA/DA")
+	require.NoError(t, err)
+	require.Equal(t, int64(2), n)
+
+	_, err = query.CountOnline(ctx, "DDA/DB")
+	require.ErrorIs(t, err, ErrChannelNotFound)
+}
+
+// 10k 人的群組，約一半在線
+func BenchmarkCountOnlineInGroup(b *testing.B) {
+	ctx := context.Background()
+	const size = 10000
+	members := make([]string, size)
+	for i := range members {
+		members[i] = fmt.Sprintf("U%d", i)
+	}
+
+	stores := map[string]func() testStore{
+		"memory": func() testStore { return NewMemoryPresenceStore(DefaultStoreConfig()) },
+		"redis": func() testStore {
+			mr := miniredis.RunT(b)
+			rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+			b.Cleanup(func() { rdb.Close() })
+			return NewRedisPresenceStore(rdb, DefaultStoreConfig())
+		},
+	}
+	for name, newStore := range stores {
+		b.Run(name, func(b *testing.B) {
+			store := newStore()
+			for i := 0; i < size; i += 2 {
+				require.NoError(b, store.Set(ctx, ViewPublic, Presence{UserId: members[i], Status: StatusOnline, Since: 1}))
+			}
+			require.NoError(b, store.SetGroupMembers(ctx, "G1", members, time.Hour))
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				n, _, err := store.CountOnlineInGroup(ctx, "G1")
+				if err != nil || n != size/2 {
+					b.Fatal(n, err)
+				}
+			}
+		})
+	}
+}
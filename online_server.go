@@ -1,69 +1,672 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
+	"github.com/nats-io/nats.go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/redis/go-redis/v9"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
-var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool {
-		return true // TODO: 實際專案應限制允許的 domain
-	},
+// 執行: WS_TOKENS="tokenA:U1,tokenB:U2" go run online_server.go online_presence.go online_auth.go online_conn.go online_hub.go \
+//         online_store.go online_store_redis.go \
+//         online_bus.go online_bus_nats.go online_bus_redis.go online_subscription.go online_privacy.go \
+//         online_query.go online_idle.go online_persist.go online_guard.go online_protocol.go online_typing.go online_drain.go online_stream.go online_metrics.go online_custom_status.go \
+//         channel_tree.go channel_members.go
+// 多台 server 共用狀態時加上 REDIS_ADDR=localhost:6379，跨節點廣播用 PRESENCE_BUS=nats NATS_URL=nats://localhost:4222 或 PRESENCE_BUS=redis
+// 訂閱 channel 需要 MONGO_URI=mongodb://localhost:27017，再加上 PRESENCE_PERSIST=mongo NODE_ID=ws-1 會把狀態存進 MongoDB，重啟後載入
+
+// ClientFrame client 送的訊息，一次只做一件事，例如
+// {"status": "busy"}、{"subscribe": ["U2", "U3"]}、{"subscribeChannel": "B/DB_18"}、{"visibility": "contacts"}
+// Activity 是 client 偵測到使用者操作時送的 {"activity": true}，用來判斷閒置，不回應
+// Typing 為輸入中提示 {"typing": {"channelId": "DDA/DA", "typing": true}}，成功不回應
+// CustomStatus 為自訂狀態 {"customStatus": {"text": "開會中", "emoji": "📅", "expiresAt": 1695402000}}，{"customStatus": {}} 清除
+type ClientFrame struct {
+	Activity           bool           `json:"activity,omitempty"`
+	Status             Status         `json:"status,omitempty"`
+	Visibility         Visibility     `json:"visibility,omitempty"`
+	CustomStatus       *CustomStatus  `json:"customStatus,omitempty"`
+	Subscribe          []string       `json:"subscribe,omitempty"`
+	Unsubscribe        []string       `json:"unsubscribe,omitempty"`
+	SubscribeChannel   string         `json:"subscribeChannel,omitempty"`
+	UnsubscribeChannel string         `json:"unsubscribeChannel,omitempty"`
+	Typing             *TypingPayload `json:"typing,omitempty"`
+}
+
+type ErrorFrame struct {
+	Error string `json:"error"`
+}
+
+type PresenceServer struct {
+	presence *PresenceService
+	privacy  PrivacyStore
+	query    *PresenceQuery
+	auth     Authenticator
+	audience AudienceResolver
+	hub      *Hub
+	subs     *SubscriptionRegistry
+	notifier *PresenceNotifier
+	typers   *TypingTracker
+	streams  *streamRegistry
+	metrics  *PresenceMetrics
+	upgrader websocket.Upgrader
+	limits   *connLimiter
+	cfg      ConnConfig
+
+	// draining 關機中不再接受新連線；active 為還在執行的 wsHandler 數；hurry 關閉時延後的下線立即執行
+	draining atomic.Bool
+	active   atomic.Int64
+	hurry    chan struct{}
+
+	// typingAudiences 輸入中期間快取 channel 成員；typingQueue 由 runTyping 依序轉發給本機 client
+	typingAudiences *typingAudiences
+	typingQueue     chan PresenceEvent
+	typingStop      chan struct{}
+}
+
+func NewPresenceServer(presence *PresenceService, privacy PrivacyStore, query *PresenceQuery, auth Authenticator, audience AudienceResolver, cfg ConnConfig) *PresenceServer {
+	s := &PresenceServer{
+		presence: presence,
+		privacy:  privacy,
+		query:    query,
+		auth:     auth,
+		audience: audience,
+		hub:      NewHub(cfg),
+		subs:     NewSubscriptionRegistry(cfg.MaxSubscriptions),
+		upgrader: websocket.Upgrader{CheckOrigin: newCheckOrigin(cfg.AllowedOrigins), Subprotocols: []string{ProtocolV1}},
+		limits:   newConnLimiter(cfg.MaxConnsPerUser, cfg.MaxConnsPerIP),
+		cfg:      cfg,
+		streams:  newStreamRegistry(),
+		hurry:    make(chan struct{}),
+
+		typingQueue: make(chan PresenceEvent, typingQueueSize),
+		typingStop:  make(chan struct{}),
+	}
+	s.typingAudiences = newTypingAudiences(func(ctx context.Context, channelId string) ([]string, error) {
+		return s.audience.Audience(ctx, channelId)
+	}, 2*cfg.TypingTTL)
+	s.notifier = NewPresenceNotifier(s.subs, s.isContact, cfg.PresenceDebounce)
+	s.typers = NewTypingTracker(cfg.TypingTTL, cfg.TypingThrottle, func(e PresenceEvent) {
+		if err := presence.bus.Publish(context.Background(), e); err != nil {
+			log.Println("Publish typing error:", err)
+		}
+	})
+	go s.runTyping()
+	return s
 }
 
-func wsHandler(c *gin.Context) {
-	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+// isContact 查不到時當作不是聯絡人，寧可少送也不能洩漏
+func (s *PresenceServer) isContact(userId, viewerId string) bool {
+	ok, err := s.privacy.IsContact(context.Background(), userId, viewerId)
+	if err != nil {
+		log.Println("IsContact error:", err)
+		return false
+	}
+	return ok
+}
+
+// Close 停止推送狀態變更
+func (s *PresenceServer) Close() {
+	s.notifier.Stop()
+	close(s.typingStop)
+}
+
+func (s *PresenceServer) wsHandler(c *gin.Context) {
+	// 先計數再檢查 draining，Drain 才不會漏等剛進來的連線
+	s.active.Add(1)
+	defer s.active.Add(-1)
+	if s.draining.Load() {
+		s.metrics.reject(TransportWS, RejectDraining)
+		c.JSON(http.StatusServiceUnavailable, ErrorFrame{Error: ErrDraining.Error()})
+		return
+	}
+
+	// 先驗證再 upgrade，失敗直接回 401；允許 first frame 驗證時沒帶 token 的先 upgrade
+	userId, err := s.auth.AuthenticateToken(requestToken(c.Request, s.cfg.AuthMethods))
+	if err != nil && !s.cfg.allowsAuth(AuthFrame) {
+		s.metrics.reject(TransportWS, RejectUnauthorized)
+		c.JSON(http.StatusUnauthorized, ErrorFrame{Error: err.Error()})
+		return
+	}
+	device := c.DefaultQuery("device", "web")
+
+	releaseIP, err := s.limits.AcquireIP(c.ClientIP())
+	if err != nil {
+		s.metrics.reject(TransportWS, RejectTooMany)
+		c.JSON(http.StatusTooManyRequests, ErrorFrame{Error: err.Error()})
+		return
+	}
+	defer releaseIP()
+	if userId != "" {
+		releaseUser, err := s.limits.AcquireUser(userId)
+		if err != nil {
+			s.metrics.reject(TransportWS, RejectTooMany)
+			c.JSON(http.StatusTooManyRequests, ErrorFrame{Error: err.Error()})
+			return
+		}
+		defer releaseUser()
+	}
+
+	conn, err := s.upgrader.Upgrade(c.Writer, c.Request, nil)
 	if err != nil {
 		log.Println("Upgrade error:", err)
+		s.metrics.reject(TransportWS, RejectUpgrade)
 		return
 	}
 	defer conn.Close()
+	// 超過大小 gorilla 會回 1009 (message too big) 並讓 ReadMessage 回傳錯誤
+	conn.SetReadLimit(s.cfg.MaxMessageSize)
 
-	// 設定 pong handler
-	conn.SetPongHandler(func(appData string) error {
-		log.Println("received pong from client:", appData)
-		return nil
-	})
+	if userId == "" {
+		if userId, err = s.authenticateFrame(conn); err != nil {
+			s.metrics.reject(TransportWS, RejectUnauthorized)
+			closeGracefully(conn, s.cfg, websocket.ClosePolicyViolation, ErrUnauthorized.Error())
+			return
+		}
+		releaseUser, err := s.limits.AcquireUser(userId)
+		if err != nil {
+			s.metrics.reject(TransportWS, RejectTooMany)
+			closeGracefully(conn, s.cfg, websocket.CloseTryAgainLater, err.Error())
+			return
+		}
+		defer releaseUser()
+	}
 
-	// 啟動一個 goroutine 定期發送 ping
-	go func() {
-		ticker := time.NewTicker(10 * time.Second)
-		defer ticker.Stop()
+	// 連線期間的 store 操作不跟 request context 綁在一起，確保斷線時 offline 一定寫得進去
+	ctx := context.Background()
+	connected := time.Now()
+	p, err := s.presence.connectAt(ctx, userId, device, connected)
+	if err != nil {
+		log.Println("Connect error:", err)
+		s.metrics.reject(TransportWS, RejectUnavailable)
+		closeGracefully(conn, s.cfg, websocket.CloseInternalServerErr, "presence unavailable")
+		return
+	}
+	log.Printf("%s online (%s)", userId, device)
+	s.metrics.upgrade(TransportWS)
 
-		for range ticker.C {
-			if err := conn.WriteMessage(websocket.PingMessage, []byte("ping")); err != nil {
-				log.Println("Ping error:", err)
-				return
-			}
+	// handler 只負責讀，所有寫入都交給 client 的 writePump
+	client := s.hub.Register(conn, userId, device)
+	// Drain 取連線清單之後才註冊的，由自己關閉
+	if s.draining.Load() {
+		client.close(websocket.CloseServiceRestart, ErrDraining.Error())
+	}
+	idle := newIdleTracker(s.presence, userId, device, s.cfg.IdleTimeout)
+	// 不論是 client 關閉、pong 逾時或寫入失敗，這個裝置一定轉成 offline (被同裝置新連線取代的除外)
+	defer s.release(ctx, client, idle, connected.UnixMilli())
+
+	// 每次 pong 記錄 RTT 並延長 store 的 TTL
+	setReadDeadline(conn, s.cfg, func(appData string) {
+		if rtt, ok := pongRTT(appData, time.Now()); ok {
+			s.metrics.pong(rtt)
 		}
-	}()
+		if err := s.presence.heartbeatAt(ctx, userId, device, connected); err != nil {
+			log.Println("Heartbeat error:", err)
+		}
+	})
+	// 送不出去 (buffer 滿或已關閉) 只記 log，要斷線時 writePump 會關 conn，下一次讀取就會返回
+	if err := client.SendEvent(MsgPresenceSelf, p); err != nil {
+		log.Println("Send error:", err)
+	}
 
-	// 持續讀取 client 消息
+	// 持續讀取 client 狀態變更，超過速率直接斷線
+	bucket := newTokenBucket(s.cfg.MessageRate, s.cfg.MessageBurst, time.Now())
 	for {
 		msgType, msg, err := conn.ReadMessage()
 		if err != nil {
-			log.Println("Read error:", err)
+			if !isExpectedClose(err) {
+				log.Println("Read error:", err)
+			}
 			break
 		}
-		fmt.Printf("recv: %s\n", msg)
-
-		// 回應 echo
-		if err := conn.WriteMessage(msgType, msg); err != nil {
-			log.Println("Write error:", err)
+		if msgType != websocket.TextMessage {
+			closeGracefully(conn, s.cfg, websocket.CloseUnsupportedData, "text frames only")
+			break
+		}
+		if !bucket.Allow(time.Now()) {
+			log.Printf("%s (%s) exceeded message rate", userId, device)
+			closeGracefully(conn, s.cfg, websocket.ClosePolicyViolation, "rate limit exceeded")
 			break
 		}
+
+		reply := s.handleMessage(ctx, client, idle, msg)
+		if reply == nil {
+			continue
+		}
+		if err := client.SendJSON(reply); err != nil {
+			log.Println("Send error:", err)
+		}
+	}
+}
+
+// release 連線結束時清掉訂閱等狀態並轉 offline，被同裝置新連線取代的不轉
+func (s *PresenceServer) release(ctx context.Context, client *Client, idle *idleTracker, connectedAt int64) {
+	idle.Stop()
+	s.typers.RemoveClient(client)
+	s.subs.RemoveClient(client)
+	s.hub.Unregister(client)
+	if client.replaced.Load() {
+		return
+	}
+	s.disconnect(ctx, client.UserId, client.Device, connectedAt)
+}
+
+// handleMessage 依連線協定處理 client 送來的訊息，回傳要回給 client 的訊息，nil 表示不用回
+func (s *PresenceServer) handleMessage(ctx context.Context, client *Client, idle *idleTracker, msg []byte) interface{} {
+	if client.protocol == ProtocolV1 {
+		return s.handleEnvelope(ctx, client, idle, msg)
+	}
+	var frame ClientFrame
+	if err := json.Unmarshal(msg, &frame); err != nil {
+		return ErrorFrame{Error: "invalid frame"}
+	}
+	reply, err := s.handleFrame(ctx, client, idle, frame)
+	if err != nil {
+		return ErrorFrame{Error: err.Error()}
+	}
+	return reply
+}
+
+// authenticateFrame AuthTimeout 內要收到 {"token": "xxx"}
+func (s *PresenceServer) authenticateFrame(conn *websocket.Conn) (string, error) {
+	conn.SetReadDeadline(time.Now().Add(s.cfg.AuthTimeout))
+	var frame AuthFrameMessage
+	if err := conn.ReadJSON(&frame); err != nil {
+		return "", err
+	}
+	return s.auth.AuthenticateToken(frame.Token)
+}
+
+// handleEnvelope v1 協定，轉成舊格式的 ClientFrame 處理，結果放在 ack 的 payload
+// 沒有結果也沒帶 id 的 (例如 activity) 不回
+func (s *PresenceServer) handleEnvelope(ctx context.Context, client *Client, idle *idleTracker, msg []byte) interface{} {
+	env, payload, err := DecodeEnvelope(msg, s.cfg.MaxMessageSize)
+	if err != nil {
+		return errorEnvelope(env.Id, err)
+	}
+
+	var frame ClientFrame
+	switch p := payload.(type) {
+	case *SetStatusPayload:
+		frame.Status = p.Status
+	case *SetVisibilityPayload:
+		frame.Visibility = p.Visibility
+	case *SetCustomStatusPayload:
+		frame.CustomStatus = &p.CustomStatus
+	case *ActivityPayload:
+		frame.Activity = true
+	case *SubscribePayload:
+		if env.Type == MsgSubscribe {
+			frame.Subscribe, frame.SubscribeChannel = p.UserIds, p.ChannelId
+		} else {
+			frame.Unsubscribe, frame.UnsubscribeChannel = p.UserIds, p.ChannelId
+		}
+	case *TypingPayload:
+		frame.Typing = p
+	default:
+		// 聊天訊息與已讀由 chat service 處理，這裡只負責 presence
+		return errorEnvelope(env.Id, protocolErrorf(ErrCodeUnsupported, "%s is not supported by this server", env.Type))
+	}
+
+	result, err := s.handleFrame(ctx, client, idle, frame)
+	if err != nil {
+		return errorEnvelope(env.Id, err)
+	}
+	if result == nil && env.Id == "" {
+		return nil
+	}
+	ack, err := NewEnvelope(MsgAck, env.Id, result)
+	if err != nil {
+		return errorEnvelope(env.Id, err)
+	}
+	return ack
+}
+
+// handleFrame 回傳要回給 client 的訊息，nil 表示不用回
+func (s *PresenceServer) handleFrame(ctx context.Context, client *Client, idle *idleTracker, frame ClientFrame) (interface{}, error) {
+	switch {
+	case frame.Activity:
+		idle.Activity(ctx)
+		return nil, nil
+	case frame.Status != "":
+		return idle.SetStatus(ctx, frame.Status)
+	case frame.Visibility != "":
+		return s.presence.SetVisibility(ctx, client.UserId, frame.Visibility)
+	case frame.CustomStatus != nil:
+		return s.presence.SetCustomStatus(ctx, client.UserId, frame.CustomStatus)
+	case len(frame.Subscribe) > 0:
+		return s.subscribe(ctx, client, frame.Subscribe)
+	case len(frame.Unsubscribe) > 0:
+		s.subs.Unsubscribe(client, frame.Unsubscribe)
+		return nil, nil
+	case frame.SubscribeChannel != "":
+		members, err := s.audience.Audience(ctx, frame.SubscribeChannel)
+		if err != nil {
+			return nil, err
+		}
+		return s.subscribe(ctx, client, members)
+	case frame.UnsubscribeChannel != "":
+		members, err := s.audience.Audience(ctx, frame.UnsubscribeChannel)
+		if err != nil {
+			return nil, err
+		}
+		s.subs.Unsubscribe(client, members)
+		return nil, nil
+	case frame.Typing != nil:
+		return nil, s.typing(ctx, client, *frame.Typing)
+	}
+	return nil, errors.New("invalid frame")
+}
+
+// subscribe 訂閱成功後先回一次目前狀態，之後的變更由 notifier 推送
+// channel 只在訂閱當下展開成員，之後新加入的成員要重新訂閱
+func (s *PresenceServer) subscribe(ctx context.Context, client *Client, userIds []string) (interface{}, error) {
+	added, err := s.subs.Subscribe(client, userIds)
+	if err != nil {
+		return nil, err
+	}
+	snapshot := PresenceBatchFrame{Presence: make([]PresenceEvent, 0, len(added))}
+	for _, userId := range added {
+		p, err := s.presence.GetFor(ctx, client.UserId, userId)
+		if err != nil {
+			return nil, err
+		}
+		snapshot.Presence = append(snapshot.Presence, newStatusChangeEvent(p))
+	}
+	return snapshot, nil
+}
+
+// forward bus 收到的狀態變更交給 notifier，debounce 後推給有訂閱的本機連線
+// 輸入中不經過 debounce，直接送給本機的收件人
+func (s *PresenceServer) forward(e PresenceEvent) {
+	if e.Event == EventTyping {
+		s.enqueueTyping(e)
+		return
+	}
+	s.notifier.Enqueue(e)
+}
+
+// GET /presence/:userId
+// 有帶 token 依身分套用隱私設定，沒帶只看得到所有人可見的狀態
+func (s *PresenceServer) getPresenceHandler(c *gin.Context) {
+	viewerId, _ := s.auth.Authenticate(c.Request)
+	p, err := s.presence.GetFor(c.Request.Context(), viewerId, c.Param("userId"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorFrame{Error: err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, p)
+}
+
+// GET /presence/:userId/devices 裝置明細是真實狀態，只有本人能看
+func (s *PresenceServer) getDevicesHandler(c *gin.Context) {
+	viewerId, err := s.auth.Authenticate(c.Request)
+	if err != nil || viewerId != c.Param("userId") {
+		c.JSON(http.StatusForbidden, ErrorFrame{Error: "forbidden"})
+		return
+	}
+	devices, err := s.presence.Devices(c.Request.Context(), viewerId)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorFrame{Error: err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, devices)
+}
+
+// 一次最多查幾個 user
+const maxBulkQuery = 1000
+
+type OnlineQueryRequest struct {
+	UserIds []string `json:"userIds"`
+}
+
+type OnlineQueryResponse struct {
+	Online []string `json:"online"`
+}
+
+type OnlineCountResponse struct {
+	ChannelId string `json:"channelId"`
+	Online    int64  `json:"online"`
+}
+
+// POST /presence/online {"userIds": ["U1", "U2"]} 回傳其中在線的
+func (s *PresenceServer) queryOnlineHandler(c *gin.Context) {
+	var req OnlineQueryRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorFrame{Error: err.Error()})
+		return
 	}
+	if len(req.UserIds) > maxBulkQuery {
+		c.JSON(http.StatusBadRequest, ErrorFrame{Error: fmt.Sprintf("at most %d userIds", maxBulkQuery)})
+		return
+	}
+	online, err := s.query.OnlineAmong(c.Request.Context(), req.UserIds)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorFrame{Error: err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, OnlineQueryResponse{Online: online})
+}
+
+// GET /presence/friends 自己在線的好友，需要 token
+func (s *PresenceServer) onlineFriendsHandler(c *gin.Context) {
+	userId, err := s.auth.Authenticate(c.Request)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, ErrorFrame{Error: err.Error()})
+		return
+	}
+	online, err := s.query.OnlineFriends(c.Request.Context(), userId)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorFrame{Error: err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, OnlineQueryResponse{Online: online})
+}
+
+// GET /presence/channel-online?channelId=B/DB_18 channel id 含 /，用 query 參數
+func (s *PresenceServer) channelOnlineHandler(c *gin.Context) {
+	channelId := c.Query("channelId")
+	if channelId == "" {
+		c.JSON(http.StatusBadRequest, ErrorFrame{Error: "channelId is required"})
+		return
+	}
+	n, err := s.query.CountOnline(c.Request.Context(), channelId)
+	if errors.Is(err, ErrChannelNotFound) {
+		c.JSON(http.StatusNotFound, ErrorFrame{Error: err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorFrame{Error: err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, OnlineCountResponse{ChannelId: channelId, Online: n})
 }
 
 func main() {
+	cfg, err := ConnConfigFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	// 有設 REDIS_ADDR 才用 Redis，多台 server 共用狀態；否則單機 in-memory
+	// 狀態和隱私設定放在同一個地方
+	var store interface {
+		PresenceStore
+		PrivacyStore
+		BulkPresenceStore
+	} = NewMemoryPresenceStore(DefaultStoreConfig())
+	var rdb *redis.Client
+	if addr := os.Getenv("REDIS_ADDR"); addr != "" {
+		rdb = redis.NewClient(&redis.Options{Addr: addr})
+		store = NewRedisPresenceStore(rdb, DefaultStoreConfig())
+	}
+	bus, err := newPresenceBusFromEnv(rdb)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer bus.Close()
+
+	db, err := newMongoDatabaseFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	audience := newAudienceResolverFromEnv(db)
+
+	// 有開 MongoDB 持久化時，service 經過包裝的 store 寫入，變更會 write-behind 到 MongoDB
+	persister, err := newPersisterFromEnv(db)
+	if err != nil {
+		log.Fatal(err)
+	}
+	presenceStore := PresenceStore(store)
+	if persister != nil {
+		presenceStore = persister.Wrap(store)
+	}
+	service := NewPresenceService(presenceStore, store, bus)
+	if persister != nil {
+		if err := startPersister(persister, store, service); err != nil {
+			log.Fatal(err)
+		}
+		defer persister.Close(context.Background())
+	}
+
+	server := NewPresenceServer(service, store,
+		NewPresenceQuery(store, audience, 10*time.Minute), NewStaticTokenAuthenticatorFromEnv("WS_TOKENS"), audience, cfg)
+	defer server.Close()
+	server.Instrument(NewPresenceMetrics(prometheus.DefaultRegisterer))
+	unsubscribe, err := bus.Subscribe(server.forward)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer unsubscribe()
+
 	r := gin.Default()
-	r.GET("/ws", func(c *gin.Context) {
-		wsHandler(c)
-	})
-	r.Run(":8080")
+	// gin 預設信任所有 proxy，client 自己帶 X-Forwarded-For 就能繞過 per-IP 限制
+	if err := r.SetTrustedProxies(cfg.TrustedProxies); err != nil {
+		log.Fatal(err)
+	}
+	r.GET("/ws", server.wsHandler)
+	// 擋掉 WebSocket 的 proxy 改用 SSE 或 long-poll，session 只在建立的節點上，多台時要 sticky routing
+	r.GET("/events", server.sseHandler)
+	r.GET("/poll", server.pollHandler)
+	r.POST("/events/:session", server.streamSendHandler)
+	r.GET("/metrics", gin.WrapH(promhttp.Handler()))
+	r.GET("/presence/:userId", server.getPresenceHandler)
+	r.GET("/presence/:userId/devices", server.getDevicesHandler)
+	r.POST("/presence/online", server.queryOnlineHandler)
+	r.GET("/presence/friends", server.onlineFriendsHandler)
+	r.GET("/presence/channel-online", server.channelOnlineHandler)
+
+	// SIGTERM 時先 drain WebSocket 再關 HTTP server，最多等 DrainWindow + OfflineDelay 再加一點緩衝
+	srv := &http.Server{Addr: ":8080", Handler: r}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	<-ctx.Done()
+	stop()
+
+	log.Println("shutting down")
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.DrainWindow+cfg.OfflineDelay+5*time.Second)
+	defer cancel()
+	if err := server.Drain(ctx); err != nil {
+		log.Println("Drain error:", err)
+	}
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Println("Shutdown error:", err)
+	}
+}
+
+// newPresenceBusFromEnv PRESENCE_BUS=nats / redis，沒設定用單機 in-process bus
+func newPresenceBusFromEnv(rdb *redis.Client) (PresenceBus, error) {
+	switch os.Getenv("PRESENCE_BUS") {
+	case "nats":
+		url := os.Getenv("NATS_URL")
+		if url == "" {
+			url = nats.DefaultURL
+		}
+		return NewNatsPresenceBus(url)
+	case "redis":
+		if rdb == nil {
+			return nil, errors.New("PRESENCE_BUS=redis requires REDIS_ADDR")
+		}
+		return NewRedisPresenceBus(rdb), nil
+	case "":
+		return NewLocalPresenceBus(), nil
+	default:
+		return nil, fmt.Errorf("unknown PRESENCE_BUS %q", os.Getenv("PRESENCE_BUS"))
+	}
+}
+
+// newMongoDatabaseFromEnv 沒設 MONGO_URI 回傳 nil
+func newMongoDatabaseFromEnv() (*mongo.Database, error) {
+	uri := os.Getenv("MONGO_URI")
+	if uri == "" {
+		return nil, nil
+	}
+	client, err := mongo.Connect(context.Background(), options.Client().ApplyURI(uri))
+	if err != nil {
+		return nil, err
+	}
+	return client.Database("testdb"), nil
+}
+
+// newAudienceResolverFromEnv 有設 MONGO_URI 才能訂閱 channel，成員從 subscriptions collection 查
+func newAudienceResolverFromEnv(db *mongo.Database) AudienceResolver {
+	if db == nil {
+		return StaticAudienceResolver{}
+	}
+	return NewMongoAudienceResolver(db.Collection("channels"), db.Collection("subscriptions"))
+}
+
+// newPersisterFromEnv PRESENCE_PERSIST=mongo 時把狀態寫進 presence collection，NODE_ID 預設為 hostname
+func newPersisterFromEnv(db *mongo.Database) (*MongoPresencePersister, error) {
+	if os.Getenv("PRESENCE_PERSIST") != "mongo" {
+		return nil, nil
+	}
+	if db == nil {
+		return nil, errors.New("PRESENCE_PERSIST=mongo requires MONGO_URI")
+	}
+	cfg := DefaultPersistConfig()
+	if node := os.Getenv("NODE_ID"); node != "" {
+		cfg.NodeId = node
+	}
+	if cfg.NodeId == "" {
+		return nil, errors.New("NODE_ID is required")
+	}
+	return NewMongoPresencePersister(db.Collection("presence"), db.Collection("presence_nodes"), cfg), nil
+}
+
+// startPersister 接受連線前先建 index、載入狀態並更新 heartbeat，避免被其他節點當成當機
+func startPersister(persister *MongoPresencePersister, store PresenceStore, service *PresenceService) error {
+	ctx := context.Background()
+	if err := EnsurePresenceIndexes(ctx, persister.records, persister.cfg.RecordTTL); err != nil {
+		return err
+	}
+	n, err := persister.Preload(ctx, store, service)
+	if err != nil {
+		return err
+	}
+	log.Printf("preloaded presence of %d users", n)
+	if err := persister.Flush(ctx); err != nil {
+		return err
+	}
+	persister.Start(service)
+	return nil
 }
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+)
+
+func testConnConfig() ConnConfig {
+	return ConnConfig{
+		PingInterval:     20 * time.Millisecond,
+		PongWait:         60 * time.Millisecond,
+		WriteWait:        50 * time.Millisecond,
+		SendBuffer:       4,
+		SlowConsumer:     SlowConsumerDisconnect,
+		MaxSubscriptions: 3,
+		PresenceDebounce: 30 * time.Millisecond,
+		TypingTTL:        100 * time.Millisecond,
+		TypingThrottle:   50 * time.Millisecond,
+		StreamBuffer:     16,
+		StreamTimeout:    time.Second,
+		PollTimeout:      100 * time.Millisecond,
+		AuthMethods:      []AuthMethod{AuthHeader, AuthQuery},
+		AuthTimeout:      50 * time.Millisecond,
+	}
+}
+
+func newTestServer(t *testing.T, cfg ConnConfig) (*PresenceServer, string) {
+	return newTestNode(t, cfg, NewMemoryPresenceStore(DefaultStoreConfig()), NewLocalPresenceBus())
+}
+
+type testStore interface {
+	PresenceStore
+	PrivacyStore
+	BulkPresenceStore
+}
+
+// newTestNode 多個 node 共用 store 和 bus 就能模擬多台 WS server
+func newTestNode(t *testing.T, cfg ConnConfig, store testStore, bus PresenceBus) (*PresenceServer, string) {
+	gin.SetMode(gin.TestMode)
+	audience := StaticAudienceResolver{"DDA/DA": {"UA", "UB", "UC"}}
+	server := NewPresenceServer(NewPresenceService(store, store, bus), store, NewPresenceQuery(store, audience, time.Minute),
+		&StaticTokenAuthenticator{tokens: map[string]string{"tokenA": "UA", "tokenB": "UB", "tokenC": "UC"}},
+		audience, cfg)
+	t.Cleanup(server.Close)
+	unsubscribe, err := bus.Subscribe(server.forward)
+	require.NoError(t, err)
+	t.Cleanup(unsubscribe)
+
+	r := gin.New()
+	require.NoError(t, r.SetTrustedProxies(cfg.TrustedProxies))
+	r.GET("/ws", server.wsHandler)
+	r.GET("/events", server.sseHandler)
+	r.GET("/poll", server.pollHandler)
+	r.POST("/events/:session", server.streamSendHandler)
+	ts := httptest.NewServer(r)
+	t.Cleanup(ts.Close)
+	return server, "ws" + strings.TrimPrefix(ts.URL, "http") + "/ws"
+}
+
+func statusOf(t *testing.T, server *PresenceServer, userId string) Status {
+	p, err := server.presence.Get(context.Background(), userId)
+	require.NoError(t, err)
+	return p.Status
+}
+
+func dialTest(t *testing.T, url string) *websocket.Conn {
+	return dialAs(t, url, "tokenA")
+}
+
+func dialAs(t *testing.T, url, token string) *websocket.Conn {
+	header := http.Header{"Authorization": []string{"Bearer " + token}}
+	conn, _, err := websocket.DefaultDialer.Dial(url, header)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	var p Presence
+	require.NoError(t, conn.ReadJSON(&p))
+	require.Equal(t, StatusOnline, p.Status)
+	return conn
+}
+
+func TestWsHandler_Unauthorized(t *testing.T) {
+	server, url := newTestServer(t, testConnConfig())
+
+	tests := []struct {
+		name   string
+		url    string
+		header http.Header
+	}{
+		{"missing", url, nil},
+		{"empty bearer", url, http.Header{"Authorization": []string{"Bearer "}}},
+		{"invalid header", url, http.Header{"Authorization": []string{"Bearer wrong"}}},
+		{"invalid query", url + "?token=wrong", nil},
+		// userId 只能來自 token
+		{"user id without token", url + "?userId=UA", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, resp, err := websocket.DefaultDialer.Dial(tt.url, tt.header)
+			require.Error(t, err)
+			require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+		})
+	}
+	require.Equal(t, StatusOffline, statusOf(t, server, "UA"))
+}
+
+// 連上時 Connect、關閉時 Disconnect，身分以 token 為準，不看 query 帶的 userId
+func TestWsHandler_ConnectDisconnect(t *testing.T) {
+	cfg := testConnConfig()
+	cfg.PongWait = time.Second
+	server, url := newTestServer(t, cfg)
+
+	conn := dialAs(t, url+"?userId=UB&device=mobile", "tokenA")
+	devices, err := server.presence.Devices(context.Background(), "UA")
+	require.NoError(t, err)
+	require.Len(t, devices, 1)
+	require.Equal(t, "mobile", devices[0].Device)
+	require.Equal(t, StatusOnline, devices[0].Status)
+	require.Equal(t, StatusOnline, statusOf(t, server, "UA"))
+	require.Equal(t, StatusOffline, statusOf(t, server, "UB"))
+
+	// 狀態變更也是套用在 token 的 user
+	require.NoError(t, conn.WriteJSON(ClientFrame{Status: StatusBusy}))
+	var p Presence
+	require.NoError(t, conn.ReadJSON(&p))
+	require.Equal(t, "UA", p.UserId)
+	require.Equal(t, StatusBusy, statusOf(t, server, "UA"))
+
+	require.NoError(t, conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")))
+	require.Eventually(t, func() bool { return statusOf(t, server, "UA") == StatusOffline }, time.Second, 5*time.Millisecond)
+	devices, err = server.presence.Devices(context.Background(), "UA")
+	require.NoError(t, err)
+	require.Equal(t, StatusOffline, devices[0].Status)
+	require.NotZero(t, devices[0].LastSeen)
+	require.Equal(t, StatusOffline, statusOf(t, server, "UB"))
+}
+
+func TestWsHandler_PongTimeout(t *testing.T) {
+	cfg := testConnConfig()
+	server, url := newTestServer(t, cfg)
+	conn := dialTest(t, url)
+
+	// 假 client 收到 ping 不回 pong
+	conn.SetPingHandler(func(string) error { return nil })
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	require.Equal(t, StatusOnline, statusOf(t, server, "UA"))
+	require.Eventually(t, func() bool {
+		return statusOf(t, server, "UA") == StatusOffline
+	}, 3*cfg.PongWait, 5*time.Millisecond)
+}
+
+func TestWsHandler_KeepAlive(t *testing.T) {
+	cfg := testConnConfig()
+	server, url := newTestServer(t, cfg)
+	conn := dialTest(t, url)
+
+	// 預設 ping handler 會回 pong，讀取迴圈要持續跑才會處理 ping
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	time.Sleep(4 * cfg.PongWait)
+	require.Equal(t, StatusOnline, statusOf(t, server, "UA"))
+}
+
+func TestWsHandler_CloseHandshake(t *testing.T) {
+	cfg := testConnConfig()
+	server, url := newTestServer(t, cfg)
+	conn := dialTest(t, url)
+
+	require.NoError(t, conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, "bye"), time.Now().Add(cfg.WriteWait)))
+
+	// server 要回 close frame
+	conn.SetReadDeadline(time.Now().Add(cfg.PongWait))
+	_, _, err := conn.ReadMessage()
+	require.True(t, websocket.IsCloseError(err, websocket.CloseNormalClosure), err)
+
+	require.Eventually(t, func() bool {
+		return statusOf(t, server, "UA") == StatusOffline
+	}, cfg.PongWait, 5*time.Millisecond)
+}
+
+// slow consumer 斷線時 Send 已經先 Unregister，release 仍要轉 offline；被新連線取代的才不轉
+func TestPresenceServer_ReleaseSlowConsumer(t *testing.T) {
+	ctx := context.Background()
+	cfg := testConnConfig()
+	cfg.SendBuffer = 1
+	server, _ := newTestServer(t, cfg)
+
+	connected := time.Now()
+	_, err := server.presence.connectAt(ctx, "UA", "web", connected)
+	require.NoError(t, err)
+	client := server.hub.RegisterStream("UA", "web", "")
+	require.NoError(t, client.Send([]byte("1")))
+	require.ErrorIs(t, client.Send([]byte("2")), ErrSlowConsumer)
+	require.Equal(t, 0, server.hub.Count())
+
+	server.release(ctx, client, newIdleTracker(server.presence, "UA", "web", 0), connected.UnixMilli())
+	devices, err := server.presence.Devices(ctx, "UA")
+	require.NoError(t, err)
+	require.Equal(t, StatusOffline, devices[0].Status)
+	require.Equal(t, StatusOffline, statusOf(t, server, "UA"))
+
+	_, err = server.presence.connectAt(ctx, "UA", "web", connected)
+	require.NoError(t, err)
+	old := server.hub.RegisterStream("UA", "web", "")
+	server.hub.RegisterStream("UA", "web", "")
+	server.release(ctx, old, newIdleTracker(server.presence, "UA", "web", 0), connected.UnixMilli())
+	require.Equal(t, StatusOnline, statusOf(t, server, "UA"))
+}
+
+func TestConnConfig_Validate(t *testing.T) {
+	require.NoError(t, DefaultConnConfig().Validate())
+	require.Error(t, ConnConfig{PingInterval: time.Second, PongWait: time.Second, WriteWait: time.Second}.Validate())
+	require.Error(t, ConnConfig{PingInterval: time.Second, PongWait: 2 * time.Second}.Validate())
+	cfg := DefaultConnConfig()
+	cfg.SlowConsumer = "block"
+	require.Error(t, cfg.Validate())
+
+	t.Setenv("WS_PONG_WAIT", "5s")
+	_, err := ConnConfigFromEnv()
+	require.Error(t, err)
+
+	t.Setenv("WS_PING_INTERVAL", "1s")
+	cfg, err = ConnConfigFromEnv()
+	require.NoError(t, err)
+	require.Equal(t, time.Second, cfg.PingInterval)
+	require.Equal(t, 5*time.Second, cfg.PongWait)
+
+	t.Setenv("WS_ALLOWED_ORIGINS", "https://a.example.com, https://b.example.com")
+	t.Setenv("WS_AUTH_METHODS", "header,frame")
+	t.Setenv("WS_TRUSTED_PROXIES", "10.0.0.0/8")
+	cfg, err = ConnConfigFromEnv()
+	require.NoError(t, err)
+	require.Equal(t, []string{"https://a.example.com", "https://b.example.com"}, cfg.AllowedOrigins)
+	require.Equal(t, []string{"10.0.0.0/8"}, cfg.TrustedProxies)
+	require.Equal(t, []AuthMethod{AuthHeader, AuthFrame}, cfg.AuthMethods)
+
+	t.Setenv("WS_AUTH_METHODS", "cookie")
+	_, err = ConnConfigFromEnv()
+	require.Error(t, err)
+}
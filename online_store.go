@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// PresenceView 對外的狀態依隱私設定分兩份：所有人看到的 public，和聯絡人看到的 contacts
+// 兩份都在寫入時就依隱私設定算好，直接讀 store 的服務也無法繞過隱私
+type PresenceView string
+
+const (
+	ViewPublic   PresenceView = "public"
+	ViewContacts PresenceView = "contacts"
+)
+
+// PresenceStore 狀態的共享存放位置，多台 WS server 共用時用 Redis
+// 同時存 user 合併後的狀態 (Set/Get，每個 view 各一份) 和每個裝置的真實狀態 (SetDevice/Devices，只給本人看)
+// offline 不另外存狀態，只留有 TTL 的 last_seen，查不到就當 offline
+type PresenceStore interface {
+	// Set 寫入上線中的狀態並重設 TTL
+	Set(ctx context.Context, view PresenceView, p Presence) error
+	// Refresh 只延長 TTL 不改內容，key 已過期或已下線時回傳 false
+	Refresh(ctx context.Context, view PresenceView, userId string) (bool, error)
+	// Remove 下線：移出在線清單並記錄 last_seen
+	Remove(ctx context.Context, view PresenceView, userId string, lastSeen int64) error
+	// Get 查不到回 offline，有 last_seen 的話一起帶回
+	Get(ctx context.Context, view PresenceView, userId string) (Presence, error)
+	// OnlineCount 所有人看得到的在線人數
+	OnlineCount(ctx context.Context) (int64, error)
+
+	// SetDevice 寫入裝置在線中的狀態並重設 TTL
+	SetDevice(ctx context.Context, userId string, d DevicePresence) error
+	// RefreshDevice 只延長裝置的 TTL，已過期或已下線時回傳 false
+	RefreshDevice(ctx context.Context, userId, device string) (bool, error)
+	// RemoveDevice 裝置下線，記錄該裝置的 last_seen
+	RemoveDevice(ctx context.Context, userId, device string, lastSeen int64) error
+	// Devices 未過期的裝置 (含只剩 last_seen 的)，依裝置名稱排序
+	Devices(ctx context.Context, userId string) ([]DevicePresence, error)
+
+	// SetCustomStatus 寫入自訂狀態，到 ExpiresAt 自動失效；nil 表示清除
+	SetCustomStatus(ctx context.Context, userId string, c *CustomStatus) error
+	// CustomStatus 沒設定或已過期回 nil
+	CustomStatus(ctx context.Context, userId string) (*CustomStatus, error)
+}
+
+// StoreConfig TTL 應大於 PongWait，pong 會持續 Refresh；LastSeenTTL 避免 offline 資料永久堆積
+type StoreConfig struct {
+	TTL         time.Duration
+	LastSeenTTL time.Duration
+}
+
+func DefaultStoreConfig() StoreConfig {
+	return StoreConfig{
+		TTL:         60 * time.Second,
+		LastSeenTTL: 7 * 24 * time.Hour,
+	}
+}
+
+type memoryEntry struct {
+	presence  Presence
+	expiresAt time.Time
+}
+
+type memoryDeviceEntry struct {
+	device    DevicePresence
+	expiresAt time.Time
+}
+
+// MemoryPresenceStore 單機用，行為和 Redis 版一致 (含 TTL)
+type MemoryPresenceStore struct {
+	cfg      StoreConfig
+	now      func() time.Time
+	mu       sync.Mutex
+	entries  map[PresenceView]map[string]memoryEntry
+	devices  map[string]map[string]memoryDeviceEntry
+	custom   map[string]CustomStatus
+	settings map[string]Visibility
+	contacts map[string]map[string]bool
+	groups   map[string]memoryGroup
+}
+
+func NewMemoryPresenceStore(cfg StoreConfig) *MemoryPresenceStore {
+	return &MemoryPresenceStore{
+		cfg:      cfg,
+		now:      time.Now,
+		entries:  map[PresenceView]map[string]memoryEntry{ViewPublic: {}, ViewContacts: {}},
+		devices:  make(map[string]map[string]memoryDeviceEntry),
+		custom:   make(map[string]CustomStatus),
+		settings: make(map[string]Visibility),
+		contacts: make(map[string]map[string]bool),
+		groups:   make(map[string]memoryGroup),
+	}
+}
+
+func (s *MemoryPresenceStore) Set(ctx context.Context, view PresenceView, p Presence) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p.LastSeen = 0
+	s.entries[view][p.UserId] = memoryEntry{presence: p, expiresAt: s.now().Add(s.cfg.TTL)}
+	return nil
+}
+
+func (s *MemoryPresenceStore) Refresh(ctx context.Context, view PresenceView, userId string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.lookup(view, userId)
+	if !ok || e.presence.Status == StatusOffline {
+		return false, nil
+	}
+	e.expiresAt = s.now().Add(s.cfg.TTL)
+	s.entries[view][userId] = e
+	return true, nil
+}
+
+func (s *MemoryPresenceStore) Remove(ctx context.Context, view PresenceView, userId string, lastSeen int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries[view][userId] = memoryEntry{
+		presence:  Presence{UserId: userId, Status: StatusOffline, LastSeen: lastSeen},
+		expiresAt: s.now().Add(s.cfg.LastSeenTTL),
+	}
+	return nil
+}
+
+func (s *MemoryPresenceStore) Get(ctx context.Context, view PresenceView, userId string) (Presence, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.lookup(view, userId); ok {
+		return e.presence, nil
+	}
+	return Presence{UserId: userId, Status: StatusOffline}, nil
+}
+
+func (s *MemoryPresenceStore) OnlineCount(ctx context.Context) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var n int64
+	for userId := range s.entries[ViewPublic] {
+		if e, ok := s.lookup(ViewPublic, userId); ok && e.presence.Status != StatusOffline {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// lookup 順便清掉過期的 entry，呼叫端需持有鎖
+func (s *MemoryPresenceStore) lookup(view PresenceView, userId string) (memoryEntry, bool) {
+	e, ok := s.entries[view][userId]
+	if ok && !s.now().Before(e.expiresAt) {
+		delete(s.entries[view], userId)
+		return memoryEntry{}, false
+	}
+	return e, ok
+}
+
+func (s *MemoryPresenceStore) SetDevice(ctx context.Context, userId string, d DevicePresence) error {
+	d.LastSeen = 0
+	s.putDevice(userId, d, s.cfg.TTL)
+	return nil
+}
+
+func (s *MemoryPresenceStore) RefreshDevice(ctx context.Context, userId, device string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.devices[userId][device]
+	if !ok || !s.now().Before(e.expiresAt) || e.device.Status == StatusOffline {
+		return false, nil
+	}
+	e.expiresAt = s.now().Add(s.cfg.TTL)
+	s.devices[userId][device] = e
+	return true, nil
+}
+
+func (s *MemoryPresenceStore) RemoveDevice(ctx context.Context, userId, device string, lastSeen int64) error {
+	s.putDevice(userId, DevicePresence{Device: device, Status: StatusOffline, LastSeen: lastSeen}, s.cfg.LastSeenTTL)
+	return nil
+}
+
+func (s *MemoryPresenceStore) Devices(ctx context.Context, userId string) ([]DevicePresence, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var devices []DevicePresence
+	for name, e := range s.devices[userId] {
+		if !s.now().Before(e.expiresAt) {
+			delete(s.devices[userId], name)
+			continue
+		}
+		devices = append(devices, e.device)
+	}
+	if len(s.devices[userId]) == 0 {
+		delete(s.devices, userId)
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].Device < devices[j].Device })
+	return devices, nil
+}
+
+func (s *MemoryPresenceStore) putDevice(userId string, d DevicePresence, ttl time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.devices[userId] == nil {
+		s.devices[userId] = make(map[string]memoryDeviceEntry)
+	}
+	s.devices[userId][d.Device] = memoryDeviceEntry{device: d, expiresAt: s.now().Add(ttl)}
+}
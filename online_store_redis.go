@@ -0,0 +1,413 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Redis 結構 (見 online_flow 筆記)
+// online_status:{userId} hash: status / since / device (+ custom_text / custom_emoji / custom_expires_at)，下線後改成 status=offline + last_seen
+// online_users set: 目前在線的 userId (所有人看得到的)
+// online_users_expiry zset: online_users 成員的 hash 到期時間 (unix 毫秒)，批次查詢前移除到期的 (節點當機沒跑到 Remove)
+// online_status_contacts:{userId}、online_users_contacts、online_users_contacts_expiry: 同上，聯絡人看到的版本
+// online_device:{userId}:{device} hash: 單一裝置的 status / since / connected_at 或 last_seen
+// online_devices:{userId} set: 這個 user 用過的裝置，TTL 和 last_seen 一樣
+// custom_status:{userId} hash: text / emoji / expires_at，有 expires_at 時用 EXPIREAT 到期刪除
+// presence_settings:{userId} hash: visibility，friends:{userId} set: 聯絡人
+// group_members:{groupId} set: 群組成員快取，有 TTL
+const (
+	onlineDeviceKeyPrefix     = "online_device:"
+	onlineDevicesKeyPrefix    = "online_devices:"
+	customStatusKeyPrefix     = "custom_status:"
+	presenceSettingsKeyPrefix = "presence_settings:"
+	friendsKeyPrefix          = "friends:"
+	groupMembersKeyPrefix     = "group_members:"
+)
+
+// redisViewKeys 每個 view 的 hash 前綴、在線 set 與到期時間 zset
+var redisViewKeys = map[PresenceView]struct{ statusPrefix, onlineSet, expirySet string }{
+	ViewPublic:   {"online_status:", "online_users", "online_users_expiry"},
+	ViewContacts: {"online_status_contacts:", "online_users_contacts", "online_users_contacts_expiry"},
+}
+
+// pruneScript 把到期的 user 移出在線 set，整段在 Redis 裡執行，不會和 Set 重新加入交錯
+// KEYS[1] 在線 set、KEYS[2] 到期時間 zset、ARGV[1] 現在時間 (毫秒)，和 key 的 TTL 一樣時間到就算過期
+var pruneScript = redis.NewScript(`
+local stale = redis.call('ZRANGEBYSCORE', KEYS[2], '-inf', ARGV[1])
+for _, userId in ipairs(stale) do
+	redis.call('SREM', KEYS[1], userId)
+end
+redis.call('ZREMRANGEBYSCORE', KEYS[2], '-inf', ARGV[1])
+return #stale
+`)
+
+// refreshDeviceScript 裝置還在線才延長 TTL，判斷和 EXPIRE 在同一段執行，不會延長到剛寫入的 last_seen
+// KEYS[1] 裝置 hash、ARGV[1] TTL (毫秒)、ARGV[2] offline 的 status，回傳 1 表示有延長
+var refreshDeviceScript = redis.NewScript(`
+local status = redis.call('HGET', KEYS[1], 'status')
+if not status or status == ARGV[2] then
+	return 0
+end
+return redis.call('PEXPIRE', KEYS[1], ARGV[1])
+`)
+
+func onlineStatusKey(view PresenceView, userId string) string {
+	return redisViewKeys[view].statusPrefix + userId
+}
+
+func onlineDeviceKey(userId, device string) string {
+	return onlineDeviceKeyPrefix + userId + ":" + device
+}
+
+func onlineDevicesKey(userId string) string {
+	return onlineDevicesKeyPrefix + userId
+}
+
+type RedisPresenceStore struct {
+	rdb *redis.Client
+	cfg StoreConfig
+	now func() time.Time
+}
+
+func NewRedisPresenceStore(rdb *redis.Client, cfg StoreConfig) *RedisPresenceStore {
+	return &RedisPresenceStore{rdb: rdb, cfg: cfg, now: time.Now}
+}
+
+// expiry 寫入或延長 hash 時同步更新的到期時間
+func (s *RedisPresenceStore) expiry() redis.Z {
+	return redis.Z{Score: float64(s.now().Add(s.cfg.TTL).UnixMilli())}
+}
+
+// prune 批次查詢前呼叫，hash 已經因 TTL 過期的 user 不算在線
+func (s *RedisPresenceStore) prune(ctx context.Context, view PresenceView) error {
+	keys := redisViewKeys[view]
+	return pruneScript.Run(ctx, s.rdb, []string{keys.onlineSet, keys.expirySet}, s.now().UnixMilli()).Err()
+}
+
+// Set 先 DEL 再 HSET，避免留下上次下線的 last_seen 或已清除的自訂狀態
+func (s *RedisPresenceStore) Set(ctx context.Context, view PresenceView, p Presence) error {
+	key := onlineStatusKey(view, p.UserId)
+	values := []interface{}{"status", string(p.Status), "since", p.Since, "device", p.Device}
+	if c := p.Custom; c != nil {
+		values = append(values, "custom_text", c.Text, "custom_emoji", c.Emoji, "custom_expires_at", c.ExpiresAt)
+	}
+	_, err := s.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, key)
+		pipe.HSet(ctx, key, values...)
+		pipe.Expire(ctx, key, s.cfg.TTL)
+		pipe.SAdd(ctx, redisViewKeys[view].onlineSet, p.UserId)
+		z := s.expiry()
+		z.Member = p.UserId
+		pipe.ZAdd(ctx, redisViewKeys[view].expirySet, z)
+		return nil
+	})
+	return err
+}
+
+// Refresh 心跳只做 EXPIRE 並延後到期時間，不重寫 hash
+// 已經是 offline 的 key 不延長 (last_seen 有自己的 TTL)；hash 已過期時回傳 false，由呼叫端重新 Set
+func (s *RedisPresenceStore) Refresh(ctx context.Context, view PresenceView, userId string) (bool, error) {
+	keys := redisViewKeys[view]
+	online, err := s.rdb.SIsMember(ctx, keys.onlineSet, userId).Result()
+	if err != nil || !online {
+		return false, err
+	}
+	ok, err := s.rdb.Expire(ctx, onlineStatusKey(view, userId), s.cfg.TTL).Result()
+	if err != nil || !ok {
+		return false, err
+	}
+	z := s.expiry()
+	z.Member = userId
+	return true, s.rdb.ZAddXX(ctx, keys.expirySet, z).Err()
+}
+
+func (s *RedisPresenceStore) Remove(ctx context.Context, view PresenceView, userId string, lastSeen int64) error {
+	key := onlineStatusKey(view, userId)
+	_, err := s.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, key)
+		pipe.HSet(ctx, key, "status", string(StatusOffline), "last_seen", lastSeen)
+		pipe.Expire(ctx, key, s.cfg.LastSeenTTL)
+		pipe.SRem(ctx, redisViewKeys[view].onlineSet, userId)
+		pipe.ZRem(ctx, redisViewKeys[view].expirySet, userId)
+		return nil
+	})
+	return err
+}
+
+func (s *RedisPresenceStore) Get(ctx context.Context, view PresenceView, userId string) (Presence, error) {
+	fields, err := s.rdb.HGetAll(ctx, onlineStatusKey(view, userId)).Result()
+	if err != nil {
+		return Presence{}, err
+	}
+	p := Presence{UserId: userId, Status: StatusOffline}
+	if status := Status(fields["status"]); status.Valid() {
+		p.Status = status
+	}
+	p.Since, _ = strconv.ParseInt(fields["since"], 10, 64)
+	p.Device = fields["device"]
+	p.LastSeen, _ = strconv.ParseInt(fields["last_seen"], 10, 64)
+	p.Custom = customStatusFromHash(fields, "custom_")
+	return p, nil
+}
+
+// customStatusFromHash 沒有 text 也沒有 emoji 時回傳 nil
+func customStatusFromHash(fields map[string]string, prefix string) *CustomStatus {
+	c := &CustomStatus{Text: fields[prefix+"text"], Emoji: fields[prefix+"emoji"]}
+	if c.empty() {
+		return nil
+	}
+	c.ExpiresAt, _ = strconv.ParseInt(fields[prefix+"expires_at"], 10, 64)
+	return c
+}
+
+// OnlineCount SCARD online_users
+func (s *RedisPresenceStore) OnlineCount(ctx context.Context) (int64, error) {
+	if err := s.prune(ctx, ViewPublic); err != nil {
+		return 0, err
+	}
+	return s.rdb.SCard(ctx, redisViewKeys[ViewPublic].onlineSet).Result()
+}
+
+func (s *RedisPresenceStore) SetDevice(ctx context.Context, userId string, d DevicePresence) error {
+	return s.putDevice(ctx, userId, d.Device, s.cfg.TTL, "status", string(d.Status), "since", d.Since, "connected_at", d.ConnectedAt)
+}
+
+func (s *RedisPresenceStore) RefreshDevice(ctx context.Context, userId, device string) (bool, error) {
+	n, err := refreshDeviceScript.Run(ctx, s.rdb, []string{onlineDeviceKey(userId, device)}, s.cfg.TTL.Milliseconds(), string(StatusOffline)).Int()
+	return n == 1, err
+}
+
+func (s *RedisPresenceStore) RemoveDevice(ctx context.Context, userId, device string, lastSeen int64) error {
+	return s.putDevice(ctx, userId, device, s.cfg.LastSeenTTL, "status", string(StatusOffline), "last_seen", lastSeen)
+}
+
+// Devices 裝置 key 過期後順便從 online_devices 移除
+func (s *RedisPresenceStore) Devices(ctx context.Context, userId string) ([]DevicePresence, error) {
+	names, err := s.rdb.SMembers(ctx, onlineDevicesKey(userId)).Result()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+
+	cmds := make([]*redis.MapStringStringCmd, len(names))
+	_, err = s.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, name := range names {
+			cmds[i] = pipe.HGetAll(ctx, onlineDeviceKey(userId, name))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var devices []DevicePresence
+	var expired []interface{}
+	for i, cmd := range cmds {
+		fields := cmd.Val()
+		status := Status(fields["status"])
+		if !status.Valid() {
+			expired = append(expired, names[i])
+			continue
+		}
+		d := DevicePresence{Device: names[i], Status: status}
+		d.Since, _ = strconv.ParseInt(fields["since"], 10, 64)
+		d.LastSeen, _ = strconv.ParseInt(fields["last_seen"], 10, 64)
+		d.ConnectedAt, _ = strconv.ParseInt(fields["connected_at"], 10, 64)
+		devices = append(devices, d)
+	}
+	if len(expired) > 0 {
+		if err := s.rdb.SRem(ctx, onlineDevicesKey(userId), expired...).Err(); err != nil {
+			return nil, err
+		}
+	}
+	return devices, nil
+}
+
+// putDevice 整個 hash 重寫，online_devices 的 TTL 跟著 last_seen 延長
+func (s *RedisPresenceStore) putDevice(ctx context.Context, userId, device string, ttl time.Duration, values ...interface{}) error {
+	key := onlineDeviceKey(userId, device)
+	_, err := s.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, key)
+		pipe.HSet(ctx, key, values...)
+		pipe.Expire(ctx, key, ttl)
+		pipe.SAdd(ctx, onlineDevicesKey(userId), device)
+		pipe.Expire(ctx, onlineDevicesKey(userId), s.cfg.LastSeenTTL)
+		return nil
+	})
+	return err
+}
+
+// SetCustomStatus 自訂狀態是使用者設定，沒有 expires_at 就不設 TTL
+func (s *RedisPresenceStore) SetCustomStatus(ctx context.Context, userId string, c *CustomStatus) error {
+	key := customStatusKeyPrefix + userId
+	_, err := s.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, key)
+		if c == nil {
+			return nil
+		}
+		pipe.HSet(ctx, key, "text", c.Text, "emoji", c.Emoji, "expires_at", c.ExpiresAt)
+		if c.ExpiresAt != 0 {
+			pipe.ExpireAt(ctx, key, time.Unix(c.ExpiresAt, 0))
+		}
+		return nil
+	})
+	return err
+}
+
+func (s *RedisPresenceStore) CustomStatus(ctx context.Context, userId string) (*CustomStatus, error) {
+	fields, err := s.rdb.HGetAll(ctx, customStatusKeyPrefix+userId).Result()
+	if err != nil {
+		return nil, err
+	}
+	return customStatusFromHash(fields, ""), nil
+}
+
+func (s *RedisPresenceStore) Visibility(ctx context.Context, userId string) (Visibility, error) {
+	v, err := s.rdb.HGet(ctx, presenceSettingsKeyPrefix+userId, "visibility").Result()
+	if err == redis.Nil {
+		return VisibilityEveryone, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return Visibility(v), nil
+}
+
+// SetVisibility 設定是使用者偏好，不設 TTL
+func (s *RedisPresenceStore) SetVisibility(ctx context.Context, userId string, v Visibility) error {
+	return s.rdb.HSet(ctx, presenceSettingsKeyPrefix+userId, "visibility", string(v)).Err()
+}
+
+func (s *RedisPresenceStore) IsContact(ctx context.Context, userId, viewerId string) (bool, error) {
+	return s.rdb.SIsMember(ctx, friendsKeyPrefix+userId, viewerId).Result()
+}
+
+func (s *RedisPresenceStore) SetContacts(ctx context.Context, userId string, contacts []string) error {
+	return s.replaceSet(ctx, friendsKeyPrefix+userId, contacts, 0)
+}
+
+// OnlineAmong SMISMEMBER 一次查完，不用建暫時的 set 再 SINTER
+func (s *RedisPresenceStore) OnlineAmong(ctx context.Context, view PresenceView, userIds []string) ([]string, error) {
+	online := []string{}
+	if len(userIds) == 0 {
+		return online, nil
+	}
+	if err := s.prune(ctx, view); err != nil {
+		return nil, err
+	}
+	hits, err := s.rdb.SMIsMember(ctx, redisViewKeys[view].onlineSet, toInterfaces(userIds)...).Result()
+	if err != nil {
+		return nil, err
+	}
+	for i, hit := range hits {
+		if hit {
+			online = append(online, userIds[i])
+		}
+	}
+	return online, nil
+}
+
+// OnlineFriends 兩個 view 各 SINTER friends:{userId} 一次，再用 SISMEMBER friends:{friend} 查對方有沒有把 userId 列為聯絡人
+func (s *RedisPresenceStore) OnlineFriends(ctx context.Context, userId string) ([]string, error) {
+	for _, view := range []PresenceView{ViewPublic, ViewContacts} {
+		if err := s.prune(ctx, view); err != nil {
+			return nil, err
+		}
+	}
+	var public, contacts *redis.StringSliceCmd
+	_, err := s.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		public = pipe.SInter(ctx, redisViewKeys[ViewPublic].onlineSet, friendsKeyPrefix+userId)
+		contacts = pipe.SInter(ctx, redisViewKeys[ViewContacts].onlineSet, friendsKeyPrefix+userId)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// 任一份在線的好友都要確認對方的聯絡人清單
+	inView := make(map[PresenceView]map[string]bool)
+	seen := make(map[string]bool)
+	var candidates []string
+	for view, cmd := range map[PresenceView]*redis.StringSliceCmd{ViewPublic: public, ViewContacts: contacts} {
+		inView[view] = make(map[string]bool)
+		for _, friend := range cmd.Val() {
+			inView[view][friend] = true
+			if !seen[friend] {
+				seen[friend] = true
+				candidates = append(candidates, friend)
+			}
+		}
+	}
+	online := []string{}
+	if len(candidates) == 0 {
+		return online, nil
+	}
+
+	reverse := make([]*redis.BoolCmd, len(candidates))
+	_, err = s.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, friend := range candidates {
+			reverse[i] = pipe.SIsMember(ctx, friendsKeyPrefix+friend, userId)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i, friend := range candidates {
+		if inView[friendView(reverse[i].Val())][friend] {
+			online = append(online, friend)
+		}
+	}
+	return online, nil
+}
+
+func (s *RedisPresenceStore) SetGroupMembers(ctx context.Context, groupId string, members []string, ttl time.Duration) error {
+	return s.replaceSet(ctx, groupMembersKeyPrefix+groupId, members, ttl)
+}
+
+// CountOnlineInGroup SINTERCARD 只回傳交集數量，不用把上萬個成員傳回來
+// 空群組不會建立 key，所以查不到時也當作沒有快取
+func (s *RedisPresenceStore) CountOnlineInGroup(ctx context.Context, groupId string) (int64, bool, error) {
+	key := groupMembersKeyPrefix + groupId
+	if err := s.prune(ctx, ViewPublic); err != nil {
+		return 0, false, err
+	}
+	var exists *redis.IntCmd
+	var card *redis.IntCmd
+	_, err := s.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		exists = pipe.Exists(ctx, key)
+		card = pipe.SInterCard(ctx, 0, redisViewKeys[ViewPublic].onlineSet, key)
+		return nil
+	})
+	if err != nil {
+		return 0, false, err
+	}
+	return card.Val(), exists.Val() == 1, nil
+}
+
+// replaceSet 整個 set 換掉，ttl 為 0 表示不過期
+func (s *RedisPresenceStore) replaceSet(ctx context.Context, key string, members []string, ttl time.Duration) error {
+	_, err := s.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, key)
+		if len(members) > 0 {
+			pipe.SAdd(ctx, key, toInterfaces(members)...)
+			if ttl > 0 {
+				pipe.Expire(ctx, key, ttl)
+			}
+		}
+		return nil
+	})
+	return err
+}
+
+func toInterfaces(values []string) []interface{} {
+	out := make([]interface{}, len(values))
+	for i, v := range values {
+		out[i] = v
+	}
+	return out
+}
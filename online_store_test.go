@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/require"
+)
+
+// 兩種 store 跑同一組測試，advance 用來模擬時間經過讓 TTL 到期
+func testStores(t *testing.T) map[string]func() (PresenceStore, func(time.Duration)) {
+	return map[string]func() (PresenceStore, func(time.Duration)){
+		"memory": func() (PresenceStore, func(time.Duration)) {
+			now := time.Unix(1695400000, 0)
+			s := NewMemoryPresenceStore(DefaultStoreConfig())
+			s.now = func() time.Time { return now }
+			return s, func(d time.Duration) { now = now.Add(d) }
+		},
+		"redis": func() (PresenceStore, func(time.Duration)) {
+			now := time.Unix(1695400000, 0)
+			mr := miniredis.RunT(t)
+			mr.SetTime(now)
+			rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+			t.Cleanup(func() { rdb.Close() })
+			s := NewRedisPresenceStore(rdb, DefaultStoreConfig())
+			s.now = func() time.Time { return now }
+			return s, func(d time.Duration) {
+				now = now.Add(d)
+				mr.SetTime(now)
+				mr.FastForward(d)
+			}
+		},
+	}
+}
+
+func TestPresenceStore(t *testing.T) {
+	ctx := context.Background()
+	cfg := DefaultStoreConfig()
+
+	for name, newStore := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			store, advance := newStore()
+
+			p := Presence{UserId: "U1", Status: StatusBusy, Since: 1695400000, Device: "web"}
+			require.NoError(t, store.Set(ctx, ViewPublic, p))
+			got, err := store.Get(ctx, ViewPublic, "U1")
+			require.NoError(t, err)
+			require.Equal(t, p, got)
+			n, err := store.OnlineCount(ctx)
+			require.NoError(t, err)
+			require.Equal(t, int64(1), n)
+
+			// Refresh 只延長 TTL
+			advance(cfg.TTL - time.Second)
+			ok, err := store.Refresh(ctx, ViewPublic, "U1")
+			require.NoError(t, err)
+			require.True(t, ok)
+			advance(cfg.TTL - time.Second)
+			got, _ = store.Get(ctx, ViewPublic, "U1")
+			require.Equal(t, StatusBusy, got.Status)
+
+			// 沒有心跳就過期
+			advance(2 * time.Second)
+			got, _ = store.Get(ctx, ViewPublic, "U1")
+			require.Equal(t, StatusOffline, got.Status)
+			ok, err = store.Refresh(ctx, ViewPublic, "U1")
+			require.NoError(t, err)
+			require.False(t, ok)
+
+			// 下線留 last_seen，Refresh 不會把它變回 online，LastSeenTTL 後消失
+			require.NoError(t, store.Set(ctx, ViewPublic, p))
+			require.NoError(t, store.Remove(ctx, ViewPublic, "U1", 1695401000))
+			got, _ = store.Get(ctx, ViewPublic, "U1")
+			require.Equal(t, Presence{UserId: "U1", Status: StatusOffline, LastSeen: 1695401000}, got)
+			n, _ = store.OnlineCount(ctx)
+			require.Equal(t, int64(0), n)
+			ok, _ = store.Refresh(ctx, ViewPublic, "U1")
+			require.False(t, ok)
+
+			advance(cfg.LastSeenTTL)
+			got, _ = store.Get(ctx, ViewPublic, "U1")
+			require.Equal(t, Presence{UserId: "U1", Status: StatusOffline}, got)
+
+			// 再上線時清掉 last_seen
+			require.NoError(t, store.Remove(ctx, ViewPublic, "U1", 1695401000))
+			require.NoError(t, store.Set(ctx, ViewPublic, p))
+			got, _ = store.Get(ctx, ViewPublic, "U1")
+			require.Equal(t, p, got)
+		})
+	}
+}
+
+func TestRedisPresenceStore_Schema(t *testing.T) {
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+	store := NewRedisPresenceStore(rdb, DefaultStoreConfig())
+
+	require.NoError(t, store.Set(ctx, ViewPublic, Presence{UserId: "123", Status: StatusOnline, Since: 1695400000, Device: "web"}))
+	require.Equal(t, "online", mr.HGet("online_status:123", "status"))
+	require.Equal(t, "1695400000", mr.HGet("online_status:123", "since"))
+	require.Equal(t, "web", mr.HGet("online_status:123", "device"))
+	require.Equal(t, DefaultStoreConfig().TTL, mr.TTL("online_status:123"))
+	ok, err := mr.SIsMember("online_users", "123")
+	require.NoError(t, err)
+	require.True(t, ok)
+	_, err = mr.ZScore("online_users_expiry", "123")
+	require.NoError(t, err)
+
+	require.NoError(t, store.Remove(ctx, ViewPublic, "123", 1695401000))
+	require.Equal(t, "offline", mr.HGet("online_status:123", "status"))
+	require.Equal(t, "1695401000", mr.HGet("online_status:123", "last_seen"))
+	require.Empty(t, mr.HGet("online_status:123", "device"))
+	// offline key 一定有 TTL
+	require.Equal(t, DefaultStoreConfig().LastSeenTTL, mr.TTL("online_status:123"))
+	ok, _ = mr.SIsMember("online_users", "123")
+	require.False(t, ok)
+	require.False(t, mr.Exists("online_users_expiry"))
+}
+
+func TestPresenceStore_Devices(t *testing.T) {
+	ctx := context.Background()
+	cfg := DefaultStoreConfig()
+
+	for name, newStore := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			store, advance := newStore()
+
+			require.NoError(t, store.SetDevice(ctx, "U1", DevicePresence{Device: "web", Status: StatusOnline, Since: 100}))
+			require.NoError(t, store.SetDevice(ctx, "U1", DevicePresence{Device: "mobile", Status: StatusBusy, Since: 200, ConnectedAt: 150000}))
+			require.NoError(t, store.RemoveDevice(ctx, "U1", "web", 300))
+
+			devices, err := store.Devices(ctx, "U1")
+			require.NoError(t, err)
+			require.Equal(t, []DevicePresence{
+				{Device: "mobile", Status: StatusBusy, Since: 200, ConnectedAt: 150000},
+				{Device: "web", Status: StatusOffline, LastSeen: 300},
+			}, devices)
+
+			ok, err := store.RefreshDevice(ctx, "U1", "web")
+			require.NoError(t, err)
+			require.False(t, ok)
+			ok, err = store.RefreshDevice(ctx, "U1", "mobile")
+			require.NoError(t, err)
+			require.True(t, ok)
+			ok, err = store.RefreshDevice(ctx, "U1", "desktop")
+			require.NoError(t, err)
+			require.False(t, ok)
+
+			// mobile 沒心跳過期，web 的 last_seen 還在
+			advance(cfg.TTL)
+			devices, err = store.Devices(ctx, "U1")
+			require.NoError(t, err)
+			require.Equal(t, []DevicePresence{{Device: "web", Status: StatusOffline, LastSeen: 300}}, devices)
+
+			advance(cfg.LastSeenTTL)
+			devices, err = store.Devices(ctx, "U1")
+			require.NoError(t, err)
+			require.Empty(t, devices)
+		})
+	}
+}
+
+func TestPresenceStore_CustomStatus(t *testing.T) {
+	ctx := context.Background()
+
+	for name, newStore := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			store, advance := newStore()
+
+			// 自訂狀態跟著 presence hash 一起存取
+			custom := &CustomStatus{Text: "開會中", Emoji: "📅", ExpiresAt: 1695400060}
+			p := Presence{UserId: "U1", Status: StatusBusy, Since: 1695400000, Device: "web", Custom: custom}
+			require.NoError(t, store.Set(ctx, ViewPublic, p))
+			got, err := store.Get(ctx, ViewPublic, "U1")
+			require.NoError(t, err)
+			require.Equal(t, p, got)
+			p.Custom = nil
+			require.NoError(t, store.Set(ctx, ViewPublic, p))
+			got, _ = store.Get(ctx, ViewPublic, "U1")
+			require.Nil(t, got.Custom)
+
+			c, err := store.CustomStatus(ctx, "U1")
+			require.NoError(t, err)
+			require.Nil(t, c)
+			require.NoError(t, store.SetCustomStatus(ctx, "U1", custom))
+			c, err = store.CustomStatus(ctx, "U1")
+			require.NoError(t, err)
+			require.Equal(t, custom, c)
+
+			advance(time.Minute)
+			c, err = store.CustomStatus(ctx, "U1")
+			require.NoError(t, err)
+			require.Nil(t, c)
+
+			// 沒有 ExpiresAt 不會過期，nil 清除
+			require.NoError(t, store.SetCustomStatus(ctx, "U1", &CustomStatus{Emoji: "🌴"}))
+			advance(DefaultStoreConfig().LastSeenTTL)
+			c, _ = store.CustomStatus(ctx, "U1")
+			require.Equal(t, &CustomStatus{Emoji: "🌴"}, c)
+			require.NoError(t, store.SetCustomStatus(ctx, "U1", nil))
+			c, _ = store.CustomStatus(ctx, "U1")
+			require.Nil(t, c)
+		})
+	}
+}
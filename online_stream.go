@@ -0,0 +1,461 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// SSE 與 long-poll：給擋掉 WebSocket upgrade 的 proxy 用，推送的內容和 /ws 一樣 (protocol=presence.v1 時為 Envelope)
+// 每個 stream session 在 hub 註冊一個沒有 conn 的 Client，訂閱、狀態、輸入中與關機流程都和 WebSocket 共用
+// server 推送的訊息依序編號放進 session 的 buffer (最多 StreamBuffer 則)，cursor 為 "{sessionId}:{seq}"：
+// SSE 的 event id 就是 cursor，EventSource 重連時帶 Last-Event-ID 從斷掉的地方接著送；long-poll 每次帶上次回應的 cursor
+// 斷太久、中間的訊息已經被擠出 buffer 時，改送一次所有訂閱對象目前的狀態
+// session 只存在建立它的節點，沒有 reader 超過 StreamTimeout 就結束並轉 offline
+// 找不到 session (逾時或被導到別台) 時建新的，resumed 為 false，client 要重新訂閱
+// 多台部署時 load balancer 必須把 /events、/poll、/events/:session 做 sticky routing (同一個 client 固定到同一台)，
+// 否則每次 poll 都會在另一台建新 session、重送全部狀態，POST 也會找不到 session
+//
+// GET  /events?token=xxx&device=web&protocol=presence.v1  SSE，第一個 event 為 session (StreamInfo)
+// GET  /poll?token=xxx&cursor=abc:12                       long-poll，沒有新訊息時最多等 PollTimeout
+// POST /events/abc {"subscribe": ["U2"]}                   client 送的訊息，格式和 WebSocket 的 frame 一樣，回覆放在 response body
+
+// StreamInfo SSE 的第一個 event，long-poll 的回應也會帶
+type StreamInfo struct {
+	SessionId string `json:"sessionId"`
+	Resumed   bool   `json:"resumed"`
+}
+
+// PollResponse 下一次 long-poll 帶 Cursor
+type PollResponse struct {
+	StreamInfo
+	Cursor string            `json:"cursor"`
+	Events []json.RawMessage `json:"events"`
+}
+
+type streamEvent struct {
+	seq  int64
+	data []byte
+}
+
+type streamSession struct {
+	id            string
+	client        *Client
+	idle          *idleTracker
+	connected     time.Time
+	releaseLimits func()
+
+	mu       sync.Mutex
+	bucket   *tokenBucket
+	events   []streamEvent
+	seq      int64
+	notify   chan struct{} // 有新訊息時 close 再換一個
+	readers  int
+	lastRead time.Time
+	closed   chan struct{}
+}
+
+func (ss *streamSession) push(data []byte, max int) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ss.seq++
+	ss.events = append(ss.events, streamEvent{seq: ss.seq, data: data})
+	if len(ss.events) > max {
+		ss.events = ss.events[len(ss.events)-max:]
+	}
+	close(ss.notify)
+	ss.notify = make(chan struct{})
+}
+
+// after seq 之後的訊息與下一次要等的 notify，gap 表示中間有訊息已經被擠出 buffer
+func (ss *streamSession) after(seq int64) (events []streamEvent, gap bool, notify <-chan struct{}) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if seq > ss.seq {
+		seq = ss.seq
+	}
+	i := sort.Search(len(ss.events), func(i int) bool { return ss.events[i].seq > seq })
+	gap = len(ss.events) > 0 && ss.events[0].seq > seq+1
+	return append([]streamEvent(nil), ss.events[i:]...), gap, ss.notify
+}
+
+func (ss *streamSession) cursor(seq int64) string {
+	return ss.id + ":" + strconv.FormatInt(seq, 10)
+}
+
+func (ss *streamSession) attach() {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ss.readers++
+}
+
+func (ss *streamSession) detach() {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ss.readers--
+	ss.lastRead = time.Now()
+}
+
+func (ss *streamSession) expired(timeout time.Duration) bool {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	return ss.readers == 0 && time.Since(ss.lastRead) > timeout
+}
+
+func (ss *streamSession) allow() bool {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	return ss.bucket.Allow(time.Now())
+}
+
+// streamRegistry 本機的 stream session
+type streamRegistry struct {
+	mu       sync.Mutex
+	sessions map[string]*streamSession
+}
+
+func newStreamRegistry() *streamRegistry {
+	return &streamRegistry{sessions: make(map[string]*streamSession)}
+}
+
+func (r *streamRegistry) get(id string) *streamSession {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.sessions[id]
+}
+
+func (r *streamRegistry) add(ss *streamSession) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sessions[ss.id] = ss
+}
+
+func (r *streamRegistry) remove(ss *streamSession) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.sessions, ss.id)
+}
+
+func parseCursor(cursor string) (id string, seq int64, ok bool) {
+	i := strings.LastIndexByte(cursor, ':')
+	if i <= 0 {
+		return "", 0, false
+	}
+	seq, err := strconv.ParseInt(cursor[i+1:], 10, 64)
+	if err != nil || seq < 0 {
+		return "", 0, false
+	}
+	return cursor[:i], seq, true
+}
+
+// sessionRand 測試時換掉模擬亂數來源失敗
+var sessionRand io.Reader = rand.Reader
+
+// newSessionId session id 就是 cursor 的前綴，拿不到亂數時不能退回可猜的 id
+func newSessionId() (string, error) {
+	b := make([]byte, 16)
+	if _, err := io.ReadFull(sessionRand, b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// newStream 和 wsHandler 一樣計入 Drain 等待的數量、檢查連線數限制並轉 online
+func (s *PresenceServer) newStream(transport, userId, device, protocol, ip string) (*streamSession, error) {
+	if protocol != ProtocolV1 {
+		protocol = ""
+	}
+	id, err := newSessionId()
+	if err != nil {
+		return nil, err
+	}
+	s.active.Add(1)
+	if s.draining.Load() {
+		s.active.Add(-1)
+		return nil, ErrDraining
+	}
+	releaseIP, err := s.limits.AcquireIP(ip)
+	if err != nil {
+		s.active.Add(-1)
+		return nil, err
+	}
+	releaseUser, err := s.limits.AcquireUser(userId)
+	if err != nil {
+		releaseIP()
+		s.active.Add(-1)
+		return nil, err
+	}
+
+	ctx := context.Background()
+	connected := time.Now()
+	p, err := s.presence.connectAt(ctx, userId, device, connected)
+	if err != nil {
+		releaseUser()
+		releaseIP()
+		s.active.Add(-1)
+		return nil, err
+	}
+	log.Printf("%s online (%s, %s)", userId, device, transport)
+	s.metrics.upgrade(transport)
+
+	client := s.hub.RegisterStream(userId, device, protocol)
+	if s.draining.Load() {
+		client.close(websocket.CloseServiceRestart, ErrDraining.Error())
+	}
+	ss := &streamSession{
+		id:        id,
+		client:    client,
+		idle:      newIdleTracker(s.presence, userId, device, s.cfg.IdleTimeout),
+		connected: connected,
+		releaseLimits: func() {
+			releaseUser()
+			releaseIP()
+		},
+		bucket:   newTokenBucket(s.cfg.MessageRate, s.cfg.MessageBurst, time.Now()),
+		notify:   make(chan struct{}),
+		lastRead: time.Now(),
+		closed:   make(chan struct{}),
+	}
+	s.streams.add(ss)
+	go s.runStream(ss)
+	if err := client.SendEvent(MsgPresenceSelf, p); err != nil {
+		log.Println("Send error:", err)
+	}
+	return ss, nil
+}
+
+// runStream 取代 writePump：把 send channel 的訊息搬進 buffer，定期延長 TTL，沒有 reader 太久就結束
+func (s *PresenceServer) runStream(ss *streamSession) {
+	ctx := context.Background()
+	ticker := time.NewTicker(s.cfg.PingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case msg := <-ss.client.send:
+			ss.push(msg, s.cfg.StreamBuffer)
+		case <-ticker.C:
+			if ss.expired(s.cfg.StreamTimeout) {
+				log.Printf("%s (%s) stream %s timed out", ss.client.UserId, ss.client.Device, ss.id)
+				ss.client.close(websocket.CloseGoingAway, "stream timeout")
+				continue
+			}
+			if err := s.presence.heartbeatAt(ctx, ss.client.UserId, ss.client.Device, ss.connected); err != nil {
+				log.Println("Heartbeat error:", err)
+			}
+		case <-ss.client.done:
+			// 關閉前排進來的 (例如關機的 reconnect 通知) 也留給 reader
+			for len(ss.client.send) > 0 {
+				ss.push(<-ss.client.send, s.cfg.StreamBuffer)
+			}
+			s.streams.remove(ss)
+			s.release(ctx, ss.client, ss.idle, ss.connected.UnixMilli())
+			ss.releaseLimits()
+			close(ss.closed)
+			s.active.Add(-1)
+			return
+		}
+	}
+}
+
+// openStream 驗證身分後用 cursor 找回 session，找不到就建新的；失敗時已經回應錯誤，回傳 nil
+func (s *PresenceServer) openStream(c *gin.Context, transport, cursor string) (ss *streamSession, after int64, resumed bool) {
+	userId, err := s.auth.AuthenticateToken(requestToken(c.Request, s.cfg.AuthMethods))
+	if err != nil {
+		s.metrics.reject(transport, RejectUnauthorized)
+		c.JSON(http.StatusUnauthorized, ErrorFrame{Error: err.Error()})
+		return nil, 0, false
+	}
+	if id, seq, ok := parseCursor(cursor); ok {
+		if ss := s.streams.get(id); ss != nil && ss.client.UserId == userId {
+			return ss, seq, true
+		}
+	}
+
+	ss, err = s.newStream(transport, userId, c.DefaultQuery("device", "web"), c.Query("protocol"), c.ClientIP())
+	switch {
+	case errors.Is(err, ErrDraining):
+		s.metrics.reject(transport, RejectDraining)
+		c.JSON(http.StatusServiceUnavailable, ErrorFrame{Error: err.Error()})
+	case errors.Is(err, ErrTooManyConnections):
+		s.metrics.reject(transport, RejectTooMany)
+		c.JSON(http.StatusTooManyRequests, ErrorFrame{Error: err.Error()})
+	case err != nil:
+		log.Println("Connect error:", err)
+		s.metrics.reject(transport, RejectUnavailable)
+		c.JSON(http.StatusInternalServerError, ErrorFrame{Error: "presence unavailable"})
+	}
+	return ss, 0, false
+}
+
+// pending seq 之後的訊息，有漏掉的先補一次目前狀態
+func (s *PresenceServer) pending(ss *streamSession, seq int64) ([]streamEvent, <-chan struct{}) {
+	events, gap, notify := ss.after(seq)
+	if gap {
+		s.resync(ss)
+		events, _, notify = ss.after(seq)
+	}
+	return events, notify
+}
+
+// resync 把所有訂閱對象目前的狀態直接放進 buffer
+func (s *PresenceServer) resync(ss *streamSession) {
+	c := ss.client
+	frame := PresenceBatchFrame{Presence: []PresenceEvent{}}
+	for _, userId := range s.subs.Watching(c) {
+		p, err := s.presence.GetFor(context.Background(), c.UserId, userId)
+		if err != nil {
+			log.Println("Resync error:", err)
+			return
+		}
+		frame.Presence = append(frame.Presence, newStatusChangeEvent(p))
+	}
+	msg, err := c.marshalEvent(MsgPresenceUpdate, frame)
+	if err != nil {
+		log.Println("Resync error:", err)
+		return
+	}
+	ss.push(msg, s.cfg.StreamBuffer)
+}
+
+// GET /events SSE，重連時 EventSource 會自動帶 Last-Event-ID
+func (s *PresenceServer) sseHandler(c *gin.Context) {
+	cursor := c.GetHeader("Last-Event-ID")
+	if cursor == "" {
+		cursor = c.Query("lastEventId")
+	}
+	ss, seq, resumed := s.openStream(c, TransportSSE, cursor)
+	if ss == nil {
+		return
+	}
+	ss.attach()
+	defer ss.detach()
+
+	w := c.Writer
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	// nginx 預設會 buffer response
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	info, _ := json.Marshal(StreamInfo{SessionId: ss.id, Resumed: resumed})
+	fmt.Fprintf(w, "event: session\ndata: %s\n\n", info)
+	w.Flush()
+
+	// 定期送 comment，避免 proxy 把沒有資料的連線切掉
+	ticker := time.NewTicker(s.cfg.PingInterval)
+	defer ticker.Stop()
+	for {
+		events, notify := s.pending(ss, seq)
+		for _, e := range events {
+			fmt.Fprintf(w, "id: %s\ndata: %s\n\n", ss.cursor(e.seq), e.data)
+			seq = e.seq
+		}
+		if len(events) > 0 {
+			w.Flush()
+		}
+		select {
+		case <-notify:
+		case <-ticker.C:
+			io.WriteString(w, ": ping\n\n")
+			w.Flush()
+		case <-ss.closed:
+			// 把關閉前最後的訊息送完再結束
+			events, _ := s.pending(ss, seq)
+			for _, e := range events {
+				fmt.Fprintf(w, "id: %s\ndata: %s\n\n", ss.cursor(e.seq), e.data)
+			}
+			w.Flush()
+			return
+		case <-c.Request.Context().Done():
+			return
+		}
+	}
+}
+
+// GET /poll 有新訊息立即回，沒有就等到 PollTimeout 回空的
+func (s *PresenceServer) pollHandler(c *gin.Context) {
+	ss, seq, resumed := s.openStream(c, TransportPoll, c.Query("cursor"))
+	if ss == nil {
+		return
+	}
+	ss.attach()
+	defer ss.detach()
+
+	timeout := time.NewTimer(s.cfg.PollTimeout)
+	defer timeout.Stop()
+	events, notify := s.pending(ss, seq)
+wait:
+	for len(events) == 0 {
+		select {
+		case <-notify:
+			events, notify = s.pending(ss, seq)
+		case <-ss.closed:
+			events, _ = s.pending(ss, seq)
+			break wait
+		case <-timeout.C:
+			break wait
+		case <-c.Request.Context().Done():
+			return
+		}
+	}
+
+	resp := PollResponse{StreamInfo: StreamInfo{SessionId: ss.id, Resumed: resumed}, Events: []json.RawMessage{}}
+	for _, e := range events {
+		resp.Events = append(resp.Events, e.data)
+		seq = e.seq
+	}
+	resp.Cursor = ss.cursor(seq)
+	c.JSON(http.StatusOK, resp)
+}
+
+// POST /events/:session body 和 WebSocket 的 frame 相同，超過速率回 429
+func (s *PresenceServer) streamSendHandler(c *gin.Context) {
+	userId, err := s.auth.AuthenticateToken(requestToken(c.Request, s.cfg.AuthMethods))
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, ErrorFrame{Error: err.Error()})
+		return
+	}
+	ss := s.streams.get(c.Param("session"))
+	if ss == nil || ss.client.UserId != userId {
+		c.JSON(http.StatusNotFound, ErrorFrame{Error: "session not found"})
+		return
+	}
+	if !ss.allow() {
+		c.JSON(http.StatusTooManyRequests, ErrorFrame{Error: "rate limit exceeded"})
+		return
+	}
+	body := io.Reader(c.Request.Body)
+	if s.cfg.MaxMessageSize > 0 {
+		body = io.LimitReader(body, s.cfg.MaxMessageSize+1)
+	}
+	msg, err := io.ReadAll(body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorFrame{Error: err.Error()})
+		return
+	}
+	if s.cfg.MaxMessageSize > 0 && int64(len(msg)) > s.cfg.MaxMessageSize {
+		c.JSON(http.StatusRequestEntityTooLarge, ErrorFrame{Error: "message too large"})
+		return
+	}
+
+	reply := s.handleMessage(context.Background(), ss.client, ss.idle, msg)
+	if reply == nil {
+		c.Status(http.StatusNoContent)
+		return
+	}
+	c.JSON(http.StatusOK, reply)
+}
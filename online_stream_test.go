@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+)
+
+type sseEvent struct {
+	id, event, data string
+}
+
+// readSSE 讀到下一個 event，略過 comment
+func readSSE(t *testing.T, r *bufio.Reader) sseEvent {
+	var e sseEvent
+	for {
+		line, err := r.ReadString('\n')
+		require.NoError(t, err)
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "" && e.data != "":
+			return e
+		case strings.HasPrefix(line, "id: "):
+			e.id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			e.event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			e.data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+}
+
+func streamBase(url string) string {
+	return "http" + strings.TrimSuffix(strings.TrimPrefix(url, "ws"), "/ws")
+}
+
+func TestParseCursor(t *testing.T) {
+	id, seq, ok := parseCursor("abc:12")
+	require.True(t, ok)
+	require.Equal(t, "abc", id)
+	require.Equal(t, int64(12), seq)
+	for _, cursor := range []string{"", "abc", ":1", "abc:", "abc:-1", "abc:x"} {
+		_, _, ok := parseCursor(cursor)
+		require.False(t, ok, cursor)
+	}
+}
+
+func TestStreamSession_Buffer(t *testing.T) {
+	ss := &streamSession{id: "S", notify: make(chan struct{})}
+	_, gap, notify := ss.after(0)
+	require.False(t, gap)
+	for i := 0; i < 5; i++ {
+		ss.push([]byte{'0' + byte(i)}, 3)
+	}
+	select {
+	case <-notify:
+	default:
+		t.Fatal("push did not notify")
+	}
+
+	events, gap, _ := ss.after(3)
+	require.False(t, gap)
+	require.Equal(t, []streamEvent{{seq: 4, data: []byte("3")}, {seq: 5, data: []byte("4")}}, events)
+	_, gap, _ = ss.after(1)
+	require.True(t, gap)
+	events, gap, _ = ss.after(99)
+	require.False(t, gap)
+	require.Empty(t, events)
+	require.Equal(t, "S:5", ss.cursor(5))
+}
+
+func TestSSEHandler(t *testing.T) {
+	cfg := testConnConfig()
+	cfg.PongWait = time.Second
+	server, url := newTestServer(t, cfg)
+	base := streamBase(url)
+
+	open := func(lastEventId string) (*bufio.Reader, context.CancelFunc) {
+		ctx, cancel := context.WithCancel(context.Background())
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, base+"/events?token=tokenA", nil)
+		require.NoError(t, err)
+		if lastEventId != "" {
+			req.Header.Set("Last-Event-ID", lastEventId)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+		t.Cleanup(func() { resp.Body.Close() })
+		return bufio.NewReader(resp.Body), cancel
+	}
+
+	r, cancel := open("")
+	e := readSSE(t, r)
+	require.Equal(t, "session", e.event)
+	var info StreamInfo
+	require.NoError(t, json.Unmarshal([]byte(e.data), &info))
+	require.False(t, info.Resumed)
+	e = readSSE(t, r)
+	require.Equal(t, info.SessionId+":1", e.id)
+	var p Presence
+	require.NoError(t, json.Unmarshal([]byte(e.data), &p))
+	require.Equal(t, StatusOnline, p.Status)
+	require.Equal(t, StatusOnline, statusOf(t, server, "UA"))
+
+	// 用 POST 送 frame，回覆放在 body
+	send := func(body string) *http.Response {
+		resp, err := http.Post(base+"/events/"+info.SessionId+"?token=tokenA", "application/json", strings.NewReader(body))
+		require.NoError(t, err)
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+	resp := send(`{"subscribe": ["UB"]}`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var snapshot PresenceBatchFrame
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&snapshot))
+	require.Equal(t, StatusOffline, snapshot.Presence[0].Status)
+	require.Equal(t, http.StatusNoContent, send(`{"activity": true}`).StatusCode)
+	resp = send(`{"status": "nope"}`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var errFrame ErrorFrame
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&errFrame))
+	require.NotEmpty(t, errFrame.Error)
+
+	b := dialAs(t, url, "tokenB")
+	e = readSSE(t, r)
+	require.Equal(t, info.SessionId+":2", e.id)
+	var update PresenceBatchFrame
+	require.NoError(t, json.Unmarshal([]byte(e.data), &update))
+	require.Equal(t, StatusOnline, update.Presence[0].Status)
+
+	// 斷線期間的變更，重連帶 Last-Event-ID 接著收
+	cancel()
+	require.NoError(t, b.WriteJSON(ClientFrame{Status: StatusBusy}))
+	time.Sleep(5 * cfg.PresenceDebounce)
+	r, cancel = open(e.id)
+	defer cancel()
+	e = readSSE(t, r)
+	require.NoError(t, json.Unmarshal([]byte(e.data), &info))
+	require.True(t, info.Resumed)
+	e = readSSE(t, r)
+	require.Equal(t, info.SessionId+":3", e.id)
+	require.NoError(t, json.Unmarshal([]byte(e.data), &update))
+	require.Equal(t, StatusBusy, update.Presence[0].Status)
+
+	// 別人的 session 不能用
+	resp, err := http.Post(base+"/events/"+info.SessionId+"?token=tokenB", "application/json", strings.NewReader(`{"activity": true}`))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestPollHandler(t *testing.T) {
+	cfg := testConnConfig()
+	cfg.PongWait = time.Second
+	cfg.StreamBuffer = 2
+	server, url := newTestServer(t, cfg)
+	base := streamBase(url)
+
+	poll := func(cursor string) PollResponse {
+		resp, err := http.Get(base + "/poll?token=tokenA&cursor=" + cursor)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var r PollResponse
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&r))
+		return r
+	}
+
+	r := poll("")
+	require.False(t, r.Resumed)
+	require.Len(t, r.Events, 1)
+	require.Equal(t, r.SessionId+":1", r.Cursor)
+
+	// 沒有新訊息時等到 PollTimeout 回空的
+	start := time.Now()
+	r = poll(r.Cursor)
+	require.True(t, r.Resumed)
+	require.Empty(t, r.Events)
+	require.GreaterOrEqual(t, time.Since(start), cfg.PollTimeout)
+	cursor := r.Cursor
+
+	resp, err := http.Post(base+"/events/"+r.SessionId+"?token=tokenA", "application/json", strings.NewReader(`{"subscribe": ["UB"]}`))
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	// 超過 buffer 的變更被擠掉，改補一次目前狀態
+	b := dialAs(t, url, "tokenB")
+	for _, status := range []Status{StatusBusy, StatusBeRightBack, StatusDoNotDisturb} {
+		require.NoError(t, b.WriteJSON(ClientFrame{Status: status}))
+		time.Sleep(3 * cfg.PresenceDebounce)
+	}
+	r = poll(cursor)
+	require.True(t, r.Resumed)
+	require.Len(t, r.Events, 2)
+	var update PresenceBatchFrame
+	require.NoError(t, json.Unmarshal(r.Events[1], &update))
+	require.Equal(t, "UB", update.Presence[0].UserId)
+	require.Equal(t, StatusDoNotDisturb, update.Presence[0].Status)
+
+	// 沒有人讀超過 StreamTimeout 就結束並轉 offline
+	require.Eventually(t, func() bool { return statusOf(t, server, "UA") == StatusOffline }, 3*cfg.StreamTimeout, 20*time.Millisecond)
+	require.False(t, poll(r.Cursor).Resumed)
+}
+
+func TestPollHandler_SessionIdError(t *testing.T) {
+	server, url := newTestServer(t, testConnConfig())
+	sessionRand = iotest.ErrReader(errors.New("entropy unavailable"))
+	t.Cleanup(func() { sessionRand = rand.Reader })
+
+	// 拿不到亂數時不建 session，也不轉 online
+	resp, err := http.Get(streamBase(url) + "/poll?token=tokenA")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+	require.Equal(t, StatusOffline, statusOf(t, server, "UA"))
+	require.Zero(t, server.active.Load())
+}
+
+func TestStream_Drain(t *testing.T) {
+	cfg := testConnConfig()
+	cfg.PongWait = time.Second
+	server, url := newTestServer(t, cfg)
+
+	resp, err := http.Get(streamBase(url) + "/events?token=tokenA")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	r := bufio.NewReader(resp.Body)
+	readSSE(t, r)
+	readSSE(t, r)
+
+	// 關機時先收到 reconnect 通知，之後 stream 結束
+	require.NoError(t, server.Drain(context.Background()))
+	var frame ReconnectFrame
+	require.NoError(t, json.Unmarshal([]byte(readSSE(t, r).data), &frame))
+	require.True(t, frame.Reconnect)
+	_, err = r.ReadString('\n')
+	require.Error(t, err)
+
+	header := http.Header{"Authorization": []string{"Bearer tokenA"}}
+	_, resp, err = websocket.DefaultDialer.Dial(url, header)
+	require.Error(t, err)
+	require.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+}
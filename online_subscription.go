@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// 狀態變更只送給有訂閱的連線，避免一個人上線就通知所有好友 + 組織成員 (通知風暴)
+
+var ErrTooManySubscriptions = errors.New("too many subscriptions")
+
+// AudienceResolver 把 channel / 組織單位展開成 userId，訂閱 channel 等於訂閱當下的所有成員
+type AudienceResolver interface {
+	Audience(ctx context.Context, channelId string) ([]string, error)
+	// SharesChannel 兩個人是否在同一個 channel，一對一的 typing 用來判斷能不能送
+	SharesChannel(ctx context.Context, userId, otherId string) (bool, error)
+}
+
+// MongoAudienceResolver 用 subscriptions collection 查成員，rollup 的 channel 含子孫 channel
+type MongoAudienceResolver struct {
+	channels *mongo.Collection
+	subs     *mongo.Collection
+}
+
+func NewMongoAudienceResolver(channels, subs *mongo.Collection) *MongoAudienceResolver {
+	return &MongoAudienceResolver{channels: channels, subs: subs}
+}
+
+func (r *MongoAudienceResolver) Audience(ctx context.Context, channelId string) ([]string, error) {
+	return GetAudience(ctx, r.channels, r.subs, channelId)
+}
+
+func (r *MongoAudienceResolver) SharesChannel(ctx context.Context, userId, otherId string) (bool, error) {
+	return SharesChannel(ctx, r.subs, userId, otherId)
+}
+
+// StaticAudienceResolver channelId -> userIds，沒有 MongoDB 時或測試用
+type StaticAudienceResolver map[string][]string
+
+func (r StaticAudienceResolver) Audience(ctx context.Context, channelId string) ([]string, error) {
+	members, ok := r[channelId]
+	if !ok {
+		return nil, ErrChannelNotFound
+	}
+	return members, nil
+}
+
+func (r StaticAudienceResolver) SharesChannel(ctx context.Context, userId, otherId string) (bool, error) {
+	for _, members := range r {
+		if containsString(members, userId) && containsString(members, otherId) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// SubscriptionRegistry 本機連線的訂閱關係：被訂閱的 userId -> 連線，以及每條連線訂了哪些人
+type SubscriptionRegistry struct {
+	max      int
+	mu       sync.RWMutex
+	watchers map[string]map[*Client]struct{}
+	watching map[*Client]map[string]struct{}
+}
+
+func NewSubscriptionRegistry(max int) *SubscriptionRegistry {
+	return &SubscriptionRegistry{
+		max:      max,
+		watchers: make(map[string]map[*Client]struct{}),
+		watching: make(map[*Client]map[string]struct{}),
+	}
+}
+
+// Subscribe 超過上限時整批拒絕，回傳實際新增的 userId
+func (r *SubscriptionRegistry) Subscribe(c *Client, userIds []string) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	current := r.watching[c]
+	var added []string
+	seen := make(map[string]bool)
+	for _, userId := range userIds {
+		if _, ok := current[userId]; ok || seen[userId] || userId == c.UserId {
+			continue
+		}
+		seen[userId] = true
+		added = append(added, userId)
+	}
+	if len(current)+len(added) > r.max {
+		return nil, fmt.Errorf("%w: limit %d", ErrTooManySubscriptions, r.max)
+	}
+
+	if current == nil && len(added) > 0 {
+		current = make(map[string]struct{})
+		r.watching[c] = current
+	}
+	for _, userId := range added {
+		current[userId] = struct{}{}
+		if r.watchers[userId] == nil {
+			r.watchers[userId] = make(map[*Client]struct{})
+		}
+		r.watchers[userId][c] = struct{}{}
+	}
+	return added, nil
+}
+
+func (r *SubscriptionRegistry) Unsubscribe(c *Client, userIds []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, userId := range userIds {
+		r.remove(c, userId)
+	}
+}
+
+// RemoveClient 連線結束時清掉它所有的訂閱
+func (r *SubscriptionRegistry) RemoveClient(c *Client) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for userId := range r.watching[c] {
+		r.remove(c, userId)
+	}
+}
+
+// Count 連線目前訂閱的人數
+func (r *SubscriptionRegistry) Count(c *Client) int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.watching[c])
+}
+
+// Watching 連線目前訂閱的 userId
+func (r *SubscriptionRegistry) Watching(c *Client) []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	userIds := make([]string, 0, len(r.watching[c]))
+	for userId := range r.watching[c] {
+		userIds = append(userIds, userId)
+	}
+	return userIds
+}
+
+// Watchers 訂閱了 userId 的本機連線
+func (r *SubscriptionRegistry) Watchers(userId string) []*Client {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	clients := make([]*Client, 0, len(r.watchers[userId]))
+	for c := range r.watchers[userId] {
+		clients = append(clients, c)
+	}
+	return clients
+}
+
+// remove 呼叫端需持有鎖
+func (r *SubscriptionRegistry) remove(c *Client, userId string) {
+	if watchers, ok := r.watchers[userId]; ok {
+		delete(watchers, c)
+		if len(watchers) == 0 {
+			delete(r.watchers, userId)
+		}
+	}
+	if watching, ok := r.watching[c]; ok {
+		delete(watching, userId)
+		if len(watching) == 0 {
+			delete(r.watching, c)
+		}
+	}
+}
+
+// PresenceBatchFrame server 推給 client 的狀態變更，一個 frame 可能含多個 user
+type PresenceBatchFrame struct {
+	Presence []PresenceEvent `json:"presence"`
+}
+
+// PresenceNotifier 收集一個 debounce 區間內的變更，同一個 user 同一個 view 只留最後一次，
+// 區間結束時每條連線只送一個 PresenceBatchFrame
+// 聯絡人只收 contacts 的變更，其他人只收 public 的變更
+type PresenceNotifier struct {
+	subs      *SubscriptionRegistry
+	isContact func(userId, viewerId string) bool
+	interval  time.Duration
+
+	mu      sync.Mutex
+	pending map[string]map[PresenceView]PresenceEvent
+	order   []string
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func NewPresenceNotifier(subs *SubscriptionRegistry, isContact func(userId, viewerId string) bool, interval time.Duration) *PresenceNotifier {
+	n := &PresenceNotifier{
+		subs:      subs,
+		isContact: isContact,
+		interval:  interval,
+		pending:   make(map[string]map[PresenceView]PresenceEvent),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	go n.run()
+	return n
+}
+
+// Enqueue 不會 block，bus handler 可以直接呼叫
+func (n *PresenceNotifier) Enqueue(e PresenceEvent) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	slots, ok := n.pending[e.UserId]
+	if !ok {
+		slots = make(map[PresenceView]PresenceEvent)
+		n.pending[e.UserId] = slots
+		n.order = append(n.order, e.UserId)
+	}
+	view := e.View
+	e.View = ""
+	if view == "" || view == ViewPublic {
+		slots[ViewPublic] = e
+	}
+	if view == "" || view == ViewContacts {
+		slots[ViewContacts] = e
+	}
+}
+
+// Stop 送出最後一批後停止
+func (n *PresenceNotifier) Stop() {
+	close(n.stop)
+	<-n.done
+}
+
+func (n *PresenceNotifier) run() {
+	defer close(n.done)
+	ticker := time.NewTicker(n.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			n.flush()
+		case <-n.stop:
+			n.flush()
+			return
+		}
+	}
+}
+
+func (n *PresenceNotifier) flush() {
+	n.mu.Lock()
+	pending, order := n.pending, n.order
+	n.pending, n.order = make(map[string]map[PresenceView]PresenceEvent), nil
+	n.mu.Unlock()
+
+	batches := make(map[*Client][]PresenceEvent)
+	for _, userId := range order {
+		slots := pending[userId]
+		public, hasPublic := slots[ViewPublic]
+		contacts, hasContacts := slots[ViewContacts]
+		// 兩份相同就不用逐一查聯絡人
+		same := hasPublic && hasContacts && reflect.DeepEqual(public, contacts)
+		for _, c := range n.subs.Watchers(userId) {
+			e, ok := public, hasPublic
+			if !same && n.isContact(userId, c.UserId) {
+				e, ok = contacts, hasContacts
+			}
+			if ok {
+				batches[c] = append(batches[c], e)
+			}
+		}
+	}
+	for c, events := range batches {
+		if err := c.SendEvent(MsgPresenceUpdate, PresenceBatchFrame{Presence: events}); err != nil {
+			log.Printf("Notify %s (%s) error: %v", c.UserId, c.Device, err)
+		}
+	}
+}
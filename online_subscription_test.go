@@ -0,0 +1,84 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSubscriptionRegistry(t *testing.T) {
+	hub := NewHub(testConnConfig())
+	r := NewSubscriptionRegistry(3)
+	b := hub.newClient(nil, "UB", "web")
+	c := hub.newClient(nil, "UC", "web")
+
+	// 重複的和自己不算
+	added, err := r.Subscribe(b, []string{"UA", "UA", "UB", "UC"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"UA", "UC"}, added)
+
+	// 超過上限整批拒絕
+	_, err = r.Subscribe(b, []string{"UD", "UE"})
+	require.ErrorIs(t, err, ErrTooManySubscriptions)
+	require.Equal(t, 2, r.Count(b))
+
+	_, err = r.Subscribe(c, []string{"UA"})
+	require.NoError(t, err)
+	require.ElementsMatch(t, []*Client{b, c}, r.Watchers("UA"))
+
+	r.Unsubscribe(b, []string{"UC"})
+	added, err = r.Subscribe(b, []string{"UD", "UE"})
+	require.NoError(t, err)
+	require.Len(t, added, 2)
+
+	r.RemoveClient(b)
+	require.Equal(t, 0, r.Count(b))
+	require.Equal(t, []*Client{c}, r.Watchers("UA"))
+	require.Empty(t, r.Watchers("UD"))
+}
+
+func TestPresenceNotifier_Debounce(t *testing.T) {
+	cfg := testConnConfig()
+	cfg.PresenceDebounce = 200 * time.Millisecond
+	server, url := newTestServer(t, cfg)
+	b := dialAs(t, url, "tokenB")
+
+	read := func() PresenceBatchFrame {
+		b.SetReadDeadline(time.Now().Add(time.Second))
+		var frame PresenceBatchFrame
+		require.NoError(t, b.ReadJSON(&frame))
+		return frame
+	}
+
+	// 訂閱 channel 等於訂閱成員 (不含自己)，先收到目前狀態
+	require.NoError(t, b.WriteJSON(ClientFrame{SubscribeChannel: "DDA/DA"}))
+	snapshot := read()
+	require.Len(t, snapshot.Presence, 2)
+
+	// 同一個區間內 UA 變了三次，只送最後一次，且和 UC 合併成一個 frame；UD 沒訂閱不送
+	server.forward(PresenceEvent{Event: EventStatusChange, UserId: "UA", Status: StatusOnline, Timestamp: 1})
+	server.forward(PresenceEvent{Event: EventStatusChange, UserId: "UC", Status: StatusOnline, Timestamp: 1})
+	server.forward(PresenceEvent{Event: EventStatusChange, UserId: "UA", Status: StatusBusy, Timestamp: 2})
+	server.forward(PresenceEvent{Event: EventStatusChange, UserId: "UD", Status: StatusOnline, Timestamp: 2})
+	server.forward(PresenceEvent{Event: EventStatusChange, UserId: "UA", Status: StatusDoNotDisturb, Timestamp: 3})
+
+	frame := read()
+	require.Equal(t, []PresenceEvent{
+		{Event: EventStatusChange, UserId: "UA", Status: StatusDoNotDisturb, Timestamp: 3},
+		{Event: EventStatusChange, UserId: "UC", Status: StatusOnline, Timestamp: 1},
+	}, frame.Presence)
+
+	// 上限 3，已訂 2 人
+	require.NoError(t, b.WriteJSON(ClientFrame{Subscribe: []string{"U1", "U2"}}))
+	b.SetReadDeadline(time.Now().Add(time.Second))
+	var errFrame ErrorFrame
+	require.NoError(t, b.ReadJSON(&errFrame))
+	require.Contains(t, errFrame.Error, ErrTooManySubscriptions.Error())
+
+	// 取消訂閱 channel 後不再收到
+	require.NoError(t, b.WriteJSON(ClientFrame{UnsubscribeChannel: "DDA/DA"}))
+	require.Eventually(t, func() bool {
+		return len(server.subs.Watchers("UA")) == 0
+	}, time.Second, 5*time.Millisecond)
+}
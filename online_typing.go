@@ -0,0 +1,364 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// 輸入中提示：不寫 store，只透過 PresenceBus 即時轉發
+// 發起的節點負責節流與逾時，開始輸入時檢查一次能不能送，輸入中的期間不再檢查
+// 事件只帶 channelId (或一對一的 to)，每個節點自己找出本機連著的成員，成員清單在輸入中的期間快取
+// room 是 channel (channelId) 或一對一 (to)，一對一要對方把自己加為聯絡人或在同一個 channel
+
+const EventTyping = "typing"
+
+var ErrNotRoomMember = errors.New("not a member of this room")
+
+// typingQueueSize 每個節點待轉發的 typing 事件上限，滿了直接丟掉 (提示會在 TTL 後自己消失)
+const typingQueueSize = 256
+
+// TypingEvent 推給 client 的格式，ChannelId 為空表示對方在和你一對一輸入中
+// TTL (秒，無條件進位) 內沒有收到新的 typing 事件，client 應該自己把提示拿掉 (發起的節點當機時不會有 stop)
+type TypingEvent struct {
+	Event     string `json:"event"`
+	UserId    string `json:"userId"`
+	ChannelId string `json:"channelId,omitempty"`
+	Typing    bool   `json:"typing"`
+	TTL       int    `json:"ttl"`
+}
+
+type typingKey struct {
+	userId string
+	room   string // channelId，一對一時為 "@" + 對方 userId
+}
+
+type typingState struct {
+	owner     *Client
+	channelId string
+	to        string
+	// timer 為 nil 表示已停止，throttle 過後才刪掉
+	timer *time.Timer
+	// lastStart 上一次廣播 start 的時間，持續輸入時每 ttl/2 重送一次讓收件端延長
+	lastStart time.Time
+}
+
+// TypingTracker 記錄本節點 client 的輸入中狀態
+// start 在 throttle 內重複送只延長逾時，不再廣播；ttl 內沒有新的 start 自動廣播 stop
+// 事件在持有 mu 時排進 pending，放開 mu 後才 publish (Redis / NATS 的 publish 會 block)，publishMu 保證依序送出
+type TypingTracker struct {
+	ttl      time.Duration
+	throttle time.Duration
+	publish  func(PresenceEvent)
+	now      func() time.Time
+
+	mu      sync.Mutex
+	states  map[typingKey]*typingState
+	pending []PresenceEvent
+
+	publishMu sync.Mutex
+}
+
+func NewTypingTracker(ttl, throttle time.Duration, publish func(PresenceEvent)) *TypingTracker {
+	return &TypingTracker{
+		ttl:      ttl,
+		throttle: throttle,
+		publish:  publish,
+		now:      time.Now,
+		states:   make(map[typingKey]*typingState),
+	}
+}
+
+// Start 剛停止 throttle 內的 start 直接忽略
+func (t *TypingTracker) Start(c *Client, channelId, to string) {
+	defer t.flush()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key := typingKey{userId: c.UserId, room: roomOf(channelId, to)}
+	now := t.now()
+	s, ok := t.states[key]
+	switch {
+	case !ok:
+		s = &typingState{owner: c, channelId: channelId, to: to, lastStart: now}
+		s.timer = time.AfterFunc(t.ttl, func() { t.expire(key, s) })
+		t.states[key] = s
+		t.queueLocked(key, s, true)
+	case s.timer != nil:
+		s.owner = c
+		s.timer.Reset(t.ttl)
+		if now.Sub(s.lastStart) >= t.ttl/2 {
+			s.lastStart = now
+			t.queueLocked(key, s, true)
+		}
+	}
+}
+
+// Stop 沒在輸入中就不廣播
+func (t *TypingTracker) Stop(c *Client, channelId, to string) {
+	defer t.flush()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key := typingKey{userId: c.UserId, room: roomOf(channelId, to)}
+	if s, ok := t.states[key]; ok {
+		t.stopLocked(key, s)
+	}
+}
+
+// Allow 節流：同一個 user 在同一個 room 停止後 throttle 內不能馬上再開始，避免 start/stop 交替洗版
+// 在查 room 成員之前先擋掉
+func (t *TypingTracker) Allow(userId, channelId, to string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s, ok := t.states[typingKey{userId: userId, room: roomOf(channelId, to)}]
+	return !ok || s.timer != nil
+}
+
+// Active 已經在輸入中，延長時不必再檢查權限
+func (t *TypingTracker) Active(userId, channelId, to string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s, ok := t.states[typingKey{userId: userId, room: roomOf(channelId, to)}]
+	return ok && s.timer != nil
+}
+
+// RemoveClient 連線中斷時把它的輸入中狀態都結束
+func (t *TypingTracker) RemoveClient(c *Client) {
+	defer t.flush()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for key, s := range t.states {
+		if s.owner == c {
+			t.stopLocked(key, s)
+		}
+	}
+}
+
+func (t *TypingTracker) expire(key typingKey, s *typingState) {
+	defer t.flush()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	// 已經被 Stop 或換成新的狀態
+	if t.states[key] != s || s.timer == nil {
+		return
+	}
+	t.stopLocked(key, s)
+}
+
+// stopLocked 停止後保留一段時間給 Allow 判斷節流，呼叫端需持有鎖
+func (t *TypingTracker) stopLocked(key typingKey, s *typingState) {
+	if s.timer == nil {
+		return
+	}
+	s.timer.Stop()
+	s.timer = nil
+	t.queueLocked(key, s, false)
+	time.AfterFunc(t.throttle, func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		if t.states[key] == s {
+			delete(t.states, key)
+		}
+	})
+}
+
+// queueLocked 呼叫端需持有鎖，放開鎖之後由 flush 送出
+func (t *TypingTracker) queueLocked(key typingKey, s *typingState, typing bool) {
+	t.pending = append(t.pending, PresenceEvent{
+		Event:     EventTyping,
+		UserId:    key.userId,
+		Timestamp: t.now().Unix(),
+		ChannelId: s.channelId,
+		To:        s.to,
+		Typing:    typing,
+	})
+}
+
+// flush 在放開 mu 之後呼叫，同時只有一個 goroutine 在送，事件順序和排入的順序相同
+func (t *TypingTracker) flush() {
+	t.publishMu.Lock()
+	defer t.publishMu.Unlock()
+	for {
+		t.mu.Lock()
+		events := t.pending
+		t.pending = nil
+		t.mu.Unlock()
+		if len(events) == 0 {
+			return
+		}
+		for _, e := range events {
+			t.publish(e)
+		}
+	}
+}
+
+func roomOf(channelId, to string) string {
+	if channelId != "" {
+		return channelId
+	}
+	return "@" + to
+}
+
+// typingAudiences 本節點 channel 成員的快取，最後一次使用後 ttl 內沿用
+// 輸入中的期間發起端每 TypingTTL/2 會重送 start，ttl 設成 TypingTTL 的兩倍，整段輸入期間只查一次
+type typingAudiences struct {
+	lookup func(ctx context.Context, channelId string) ([]string, error)
+	ttl    time.Duration
+	now    func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]typingAudience
+}
+
+type typingAudience struct {
+	members   map[string]bool
+	expiresAt time.Time
+}
+
+func newTypingAudiences(lookup func(ctx context.Context, channelId string) ([]string, error), ttl time.Duration) *typingAudiences {
+	return &typingAudiences{lookup: lookup, ttl: ttl, now: time.Now, entries: make(map[string]typingAudience)}
+}
+
+// Members 快取過期才重新查，順便清掉其他過期的
+func (a *typingAudiences) Members(ctx context.Context, channelId string) (map[string]bool, error) {
+	a.mu.Lock()
+	now := a.now()
+	if e, ok := a.entries[channelId]; ok && now.Before(e.expiresAt) {
+		e.expiresAt = now.Add(a.ttl)
+		a.entries[channelId] = e
+		a.mu.Unlock()
+		return e.members, nil
+	}
+	for id, e := range a.entries {
+		if !now.Before(e.expiresAt) {
+			delete(a.entries, id)
+		}
+	}
+	a.mu.Unlock()
+
+	list, err := a.lookup(ctx, channelId)
+	if err != nil {
+		return nil, err
+	}
+	members := make(map[string]bool, len(list))
+	for _, uid := range list {
+		members[uid] = true
+	}
+	a.mu.Lock()
+	a.entries[channelId] = typingAudience{members: members, expiresAt: a.now().Add(a.ttl)}
+	a.mu.Unlock()
+	return members, nil
+}
+
+// typing 處理 client 的 typing frame，開始輸入時才檢查能不能送
+func (s *PresenceServer) typing(ctx context.Context, client *Client, p TypingPayload) error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+	if !p.Typing {
+		s.typers.Stop(client, p.ChannelId, p.To)
+		return nil
+	}
+	if !s.typers.Allow(client.UserId, p.ChannelId, p.To) {
+		return nil
+	}
+	if !s.typers.Active(client.UserId, p.ChannelId, p.To) {
+		if err := s.checkTypingRoom(ctx, client.UserId, p); err != nil {
+			return err
+		}
+	}
+	s.typers.Start(client, p.ChannelId, p.To)
+	return nil
+}
+
+// checkTypingRoom channel 要是成員；一對一要對方把自己加為聯絡人 (和 contacts 可見範圍同一個方向，單方面加好友不能騷擾對方) 或在同一個 channel
+func (s *PresenceServer) checkTypingRoom(ctx context.Context, userId string, p TypingPayload) error {
+	if p.ChannelId != "" {
+		members, err := s.typingAudiences.Members(ctx, p.ChannelId)
+		if err != nil {
+			return err
+		}
+		if !members[userId] {
+			return ErrNotRoomMember
+		}
+		return nil
+	}
+	contact, err := s.privacy.IsContact(ctx, p.To, userId)
+	if err != nil || contact {
+		return err
+	}
+	shared, err := s.audience.SharesChannel(ctx, userId, p.To)
+	if err != nil {
+		return err
+	}
+	if !shared {
+		return ErrNotRoomMember
+	}
+	return nil
+}
+
+// enqueueTyping bus 的 handler 不能 block (LocalPresenceBus 會在發起端的 goroutine 裡同步呼叫)，
+// 查成員可能要讀 MongoDB，交給 runTyping 依序處理
+func (s *PresenceServer) enqueueTyping(e PresenceEvent) {
+	select {
+	case s.typingQueue <- e:
+	default:
+		log.Printf("Typing queue full, drop %s", e.UserId)
+	}
+}
+
+func (s *PresenceServer) runTyping() {
+	for {
+		select {
+		case e := <-s.typingQueue:
+			s.deliverTyping(context.Background(), e)
+		case <-s.typingStop:
+			return
+		}
+	}
+}
+
+// deliverTyping 送給本機連著的收件人 (不含本人)，channel 的成員由本節點自己查，
+// 成員可能上千人但大多不在這個節點，走訪本機的連線再比對成員
+func (s *PresenceServer) deliverTyping(ctx context.Context, e PresenceEvent) {
+	ev := TypingEvent{
+		Event:     EventTyping,
+		UserId:    e.UserId,
+		ChannelId: e.ChannelId,
+		Typing:    e.Typing,
+		TTL:       int((s.cfg.TypingTTL + time.Second - 1) / time.Second),
+	}
+	var clients []*Client
+	if e.ChannelId == "" {
+		clients = s.hub.Clients(e.To)
+	} else {
+		members, err := s.typingAudiences.Members(ctx, e.ChannelId)
+		if err != nil {
+			log.Printf("Typing audience %s error: %v", e.ChannelId, err)
+			return
+		}
+		for _, c := range s.hub.All() {
+			if members[c.UserId] {
+				clients = append(clients, c)
+			}
+		}
+	}
+	for _, c := range clients {
+		if c.UserId == e.UserId {
+			continue
+		}
+		if err := c.SendEvent(MsgTyping, ev); err != nil {
+			log.Printf("Typing %s (%s) error: %v", c.UserId, c.Device, err)
+		}
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
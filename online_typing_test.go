@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+)
+
+// countingAudience 記錄查了幾次成員
+type countingAudience struct {
+	StaticAudienceResolver
+	calls atomic.Int32
+}
+
+func (a *countingAudience) Audience(ctx context.Context, channelId string) ([]string, error) {
+	a.calls.Add(1)
+	return a.StaticAudienceResolver.Audience(ctx, channelId)
+}
+
+func TestTypingTracker(t *testing.T) {
+	var mu sync.Mutex
+	var events []PresenceEvent
+	published := func() []PresenceEvent {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]PresenceEvent(nil), events...)
+	}
+	ttl, throttle := 40*time.Millisecond, 40*time.Millisecond
+	tracker := NewTypingTracker(ttl, throttle, func(e PresenceEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, e)
+	})
+	now := time.Unix(1695400000, 0)
+	tracker.now = func() time.Time { return now }
+	c := &Client{UserId: "U1"}
+
+	// 重複 start 只廣播一次，超過 ttl/2 才重送
+	require.False(t, tracker.Active("U1", "DDA/DA", ""))
+	tracker.Start(c, "DDA/DA", "")
+	tracker.Start(c, "DDA/DA", "")
+	require.True(t, tracker.Active("U1", "DDA/DA", ""))
+	require.Len(t, published(), 1)
+	require.Equal(t, PresenceEvent{Event: EventTyping, UserId: "U1", Timestamp: now.Unix(), ChannelId: "DDA/DA", Typing: true}, published()[0])
+	now = now.Add(ttl / 2)
+	tracker.Start(c, "DDA/DA", "")
+	require.Len(t, published(), 2)
+
+	// 沒有新的 start 自動結束，throttle 內不能再開始
+	require.Eventually(t, func() bool { return len(published()) == 3 }, 10*ttl, 5*time.Millisecond)
+	require.False(t, published()[2].Typing)
+	require.False(t, tracker.Active("U1", "DDA/DA", ""))
+	require.False(t, tracker.Allow("U1", "DDA/DA", ""))
+	require.True(t, tracker.Allow("U1", "", "U2"))
+	require.Eventually(t, func() bool { return tracker.Allow("U1", "DDA/DA", "") }, 10*throttle, 5*time.Millisecond)
+
+	// 一對一與 channel 分開計算，斷線時全部結束
+	tracker.Start(c, "", "U2")
+	tracker.Start(c, "DDA/DA", "")
+	tracker.Stop(c, "", "U3")
+	require.Len(t, published(), 5)
+	require.Equal(t, "U2", published()[3].To)
+	tracker.RemoveClient(c)
+	got := published()
+	require.Len(t, got, 7)
+	require.False(t, got[5].Typing)
+	require.False(t, got[6].Typing)
+
+	// 已經停止的不會再送 stop
+	tracker.Stop(c, "DDA/DA", "")
+	time.Sleep(2 * ttl)
+	require.Len(t, published(), 7)
+}
+
+func TestTypingTracker_PublishOutsideLock(t *testing.T) {
+	publishing, release := make(chan struct{}), make(chan struct{})
+	tracker := NewTypingTracker(time.Minute, time.Minute, func(e PresenceEvent) {
+		close(publishing)
+		<-release
+	})
+	started := make(chan struct{})
+	go func() {
+		tracker.Start(&Client{UserId: "U1"}, "DDA/DA", "")
+		close(started)
+	}()
+
+	// publish 卡住 (例如 Redis 慢) 時其他人仍然可以查狀態
+	<-publishing
+	require.Eventually(t, func() bool {
+		return tracker.Active("U1", "DDA/DA", "") && tracker.Allow("U2", "DDA/DA", "")
+	}, time.Second, 5*time.Millisecond)
+	close(release)
+	<-started
+}
+
+func TestWsHandler_Typing(t *testing.T) {
+	cfg := testConnConfig()
+	cfg.PongWait = time.Second
+	store := NewMemoryPresenceStore(DefaultStoreConfig())
+	bus := NewLocalPresenceBus()
+	server1, url1 := newTestNode(t, cfg, store, bus)
+	server2, url2 := newTestNode(t, cfg, store, bus)
+	// 每個節點各自查本機收件人的成員
+	audience1 := &countingAudience{StaticAudienceResolver: StaticAudienceResolver{"DDA/DA": {"UA", "UB", "UC"}, "DDA/DB": {"UB", "UC"}}}
+	audience2 := &countingAudience{StaticAudienceResolver: StaticAudienceResolver{"DDA/DA": {"UA", "UB", "UC"}}}
+	server1.audience = audience1
+	server2.audience = audience2
+
+	a := dialAs(t, url1, "tokenA")
+	b := dialAs(t, url2, "tokenB")
+	c := dialAs(t, url1, "tokenC")
+	read := func(conn *websocket.Conn) TypingEvent {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		var e TypingEvent
+		require.NoError(t, conn.ReadJSON(&e))
+		return e
+	}
+
+	// 同 channel 的成員不論在哪個 node 都收得到
+	require.NoError(t, a.WriteJSON(ClientFrame{Typing: &TypingPayload{ChannelId: "DDA/DA", Typing: true}}))
+	start := TypingEvent{Event: EventTyping, UserId: "UA", ChannelId: "DDA/DA", Typing: true, TTL: 1}
+	require.Equal(t, start, read(b))
+	require.Equal(t, start, read(c))
+
+	// 輸入中的期間不再查成員
+	require.NoError(t, a.WriteJSON(ClientFrame{Typing: &TypingPayload{ChannelId: "DDA/DA", Typing: true}}))
+
+	// 不是成員的 channel 回錯誤，自己也不會收到自己的 typing
+	require.NoError(t, a.WriteJSON(ClientFrame{Typing: &TypingPayload{ChannelId: "DDA/DB", Typing: true}}))
+	a.SetReadDeadline(time.Now().Add(time.Second))
+	var errFrame ErrorFrame
+	require.NoError(t, a.ReadJSON(&errFrame))
+	require.Equal(t, ErrNotRoomMember.Error(), errFrame.Error)
+	require.EqualValues(t, 2, audience1.calls.Load()) // DDA/DA 與 DDA/DB 各一次
+	require.EqualValues(t, 1, audience2.calls.Load())
+
+	// 逾時自動送 stop
+	stop := start
+	stop.Typing = false
+	require.Equal(t, stop, read(b))
+	require.Equal(t, stop, read(c))
+
+	// 一對一只送給對方
+	require.NoError(t, a.WriteJSON(ClientFrame{Typing: &TypingPayload{To: "UB", Typing: true}}))
+	require.Equal(t, TypingEvent{Event: EventTyping, UserId: "UA", Typing: true, TTL: 1}, read(b))
+
+	// 一對一的對象要把自己加為聯絡人或在同一個 channel
+	require.NoError(t, a.WriteJSON(ClientFrame{Typing: &TypingPayload{To: "UX", Typing: true}}))
+	a.SetReadDeadline(time.Now().Add(time.Second))
+	require.NoError(t, a.ReadJSON(&errFrame))
+	require.Equal(t, ErrNotRoomMember.Error(), errFrame.Error)
+	require.False(t, server1.typers.Active("UA", "", "UX"))
+	require.NoError(t, store.SetContacts(context.Background(), "UX", []string{"UA"}))
+	require.NoError(t, a.WriteJSON(ClientFrame{Typing: &TypingPayload{To: "UX", Typing: true}}))
+	require.Eventually(t, func() bool { return server1.typers.Active("UA", "", "UX") }, time.Second, 5*time.Millisecond)
+
+	a.Close()
+	require.Equal(t, TypingEvent{Event: EventTyping, UserId: "UA", TTL: 1}, read(b))
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// WSClient 連線 online_server 的 /ws，斷線後以指數退避 (加 jitter) 自動重連
+// 重連後會重新送出訂閱的 user / channel 與最後一次手動設定的狀態
+// 只依賴 gorilla/websocket，可以和 online_client.go 一起 go run，也可以給 bot 或整合測試用
+
+// TokenProvider 每次連線前呼叫，token 會過期時在這裡換新的
+type TokenProvider func(ctx context.Context) (string, error)
+
+// StaticToken 固定的 token
+func StaticToken(token string) TokenProvider {
+	return func(context.Context) (string, error) { return token, nil }
+}
+
+type WSClientConfig struct {
+	URL    string // ws://localhost:8080/ws
+	Device string
+	Token  TokenProvider
+
+	// 第 n 次重試等 MinBackoff * 2^n，最多 MaxBackoff，再隨機少掉最多 Jitter 比例
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	Jitter     float64
+
+	// PingInterval 送一次 ping，PongWait 內沒收到任何東西視為斷線
+	PingInterval time.Duration
+	PongWait     time.Duration
+	WriteWait    time.Duration
+	SendBuffer   int
+}
+
+func DefaultWSClientConfig(url string, token TokenProvider) WSClientConfig {
+	return WSClientConfig{
+		URL:          url,
+		Device:       "bot",
+		Token:        token,
+		MinBackoff:   500 * time.Millisecond,
+		MaxBackoff:   30 * time.Second,
+		Jitter:       0.5,
+		PingInterval: 10 * time.Second,
+		PongWait:     30 * time.Second,
+		WriteWait:    5 * time.Second,
+		SendBuffer:   64,
+	}
+}
+
+type WSEventType string
+
+const (
+	WSConnected    WSEventType = "connected"
+	WSDisconnected WSEventType = "disconnected"
+	WSMessage      WSEventType = "message"
+	// WSDialError 連線或取得 token 失敗，之後會重試
+	WSDialError WSEventType = "dial_error"
+)
+
+// WSEvent Message 的 Data 是 server 送來的原始 JSON；Disconnected / DialError 的 Err 是原因
+// Attempt 是連續失敗的次數，連上後歸零
+type WSEvent struct {
+	Type    WSEventType
+	Data    []byte
+	Err     error
+	Attempt int
+}
+
+var ErrNotConnected = errors.New("not connected")
+
+type WSClient struct {
+	cfg     WSClientConfig
+	onEvent func(WSEvent)
+
+	mu       sync.Mutex
+	conn     *wsClientConn
+	users    map[string]bool
+	channels map[string]bool
+	status   string
+}
+
+// wsClientConn 一次連線，send 只由 writeLoop 寫出，gorilla/websocket 不允許同時寫
+type wsClientConn struct {
+	ws   *websocket.Conn
+	send chan []byte
+	done chan struct{}
+}
+
+// NewWSClient onEvent 在讀取的 goroutine 呼叫，不能 block 太久
+func NewWSClient(cfg WSClientConfig, onEvent func(WSEvent)) *WSClient {
+	if onEvent == nil {
+		onEvent = func(WSEvent) {}
+	}
+	return &WSClient{cfg: cfg, onEvent: onEvent, users: make(map[string]bool), channels: make(map[string]bool)}
+}
+
+// Run 連線並在斷線後重連，直到 ctx 結束
+func (c *WSClient) Run(ctx context.Context) error {
+	attempt := 0
+	for {
+		connected, err := c.connect(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if connected {
+			attempt = 0
+			c.onEvent(WSEvent{Type: WSDisconnected, Err: err})
+		} else {
+			c.onEvent(WSEvent{Type: WSDialError, Err: err, Attempt: attempt})
+		}
+
+		select {
+		case <-time.After(c.backoff(attempt)):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		attempt++
+	}
+}
+
+func (c *WSClient) backoff(attempt int) time.Duration {
+	d := c.cfg.MinBackoff
+	for i := 0; i < attempt && d < c.cfg.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > c.cfg.MaxBackoff {
+		d = c.cfg.MaxBackoff
+	}
+	return d - time.Duration(rand.Float64()*c.cfg.Jitter*float64(d))
+}
+
+// connect 連上後一直讀到斷線為止，connected 表示這次有成功連上
+func (c *WSClient) connect(ctx context.Context) (connected bool, err error) {
+	token, err := c.cfg.Token(ctx)
+	if err != nil {
+		return false, err
+	}
+	u, err := url.Parse(c.cfg.URL)
+	if err != nil {
+		return false, err
+	}
+	q := u.Query()
+	q.Set("device", c.cfg.Device)
+	u.RawQuery = q.Encode()
+
+	header := http.Header{"Authorization": []string{"Bearer " + token}}
+	ws, _, err := websocket.DefaultDialer.DialContext(ctx, u.String(), header)
+	if err != nil {
+		return false, err
+	}
+	// 先排好要恢復的訂閱與狀態，再開放給 Send 使用，順序才不會亂
+	c.mu.Lock()
+	restore := c.restoreFrames()
+	conn := &wsClientConn{ws: ws, send: make(chan []byte, len(restore)+c.cfg.SendBuffer), done: make(chan struct{})}
+	for _, frame := range restore {
+		conn.send <- frame
+	}
+	c.conn = conn
+	c.mu.Unlock()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		c.writeLoop(ctx, conn)
+	}()
+	c.onEvent(WSEvent{Type: WSConnected})
+
+	err = c.readLoop(conn)
+
+	c.mu.Lock()
+	c.conn = nil
+	c.mu.Unlock()
+	close(conn.done)
+	wg.Wait()
+	ws.Close()
+	return true, err
+}
+
+// restoreFrames 重連後要重送的 frame，呼叫端需持有鎖
+func (c *WSClient) restoreFrames() [][]byte {
+	var frames [][]byte
+	if len(c.users) > 0 {
+		frames = append(frames, mustMarshal(map[string][]string{"subscribe": keys(c.users)}))
+	}
+	for channelId := range c.channels {
+		frames = append(frames, mustMarshal(map[string]string{"subscribeChannel": channelId}))
+	}
+	if c.status != "" && c.status != "online" {
+		frames = append(frames, mustMarshal(map[string]string{"status": c.status}))
+	}
+	return frames
+}
+
+func (c *WSClient) readLoop(conn *wsClientConn) error {
+	ws := conn.ws
+	ws.SetReadDeadline(time.Now().Add(c.cfg.PongWait))
+	ws.SetPongHandler(func(string) error {
+		return ws.SetReadDeadline(time.Now().Add(c.cfg.PongWait))
+	})
+	for {
+		_, msg, err := ws.ReadMessage()
+		if err != nil {
+			return err
+		}
+		ws.SetReadDeadline(time.Now().Add(c.cfg.PongWait))
+		c.onEvent(WSEvent{Type: WSMessage, Data: msg})
+	}
+}
+
+// writeLoop ctx 結束時送 close frame，server 回 close 後 readLoop 就會返回
+func (c *WSClient) writeLoop(ctx context.Context, conn *wsClientConn) {
+	ticker := time.NewTicker(c.cfg.PingInterval)
+	defer ticker.Stop()
+	ws := conn.ws
+	for {
+		var err error
+		select {
+		case msg := <-conn.send:
+			ws.SetWriteDeadline(time.Now().Add(c.cfg.WriteWait))
+			err = ws.WriteMessage(websocket.TextMessage, msg)
+		case <-ticker.C:
+			err = ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(c.cfg.WriteWait))
+		case <-ctx.Done():
+			ws.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(c.cfg.WriteWait))
+			// server 沒回 close 就直接關
+			select {
+			case <-conn.done:
+			case <-time.After(c.cfg.WriteWait):
+				ws.Close()
+			}
+			return
+		case <-conn.done:
+			return
+		}
+		if err != nil {
+			// 讓 readLoop 返回並重連
+			ws.Close()
+			return
+		}
+	}
+}
+
+// Send 送出任意 frame，沒連上時回傳 ErrNotConnected (不會在重連後補送)
+func (c *WSClient) Send(v interface{}) error {
+	msg, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.sendLocked(msg)
+}
+
+func (c *WSClient) sendLocked(msg []byte) error {
+	if c.conn == nil {
+		return ErrNotConnected
+	}
+	select {
+	case c.conn.send <- msg:
+		return nil
+	default:
+		return errors.New("send buffer full")
+	}
+}
+
+// Subscribe 記住訂閱，重連後重新訂閱；沒連上時等連上再送
+func (c *WSClient) Subscribe(userIds ...string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, userId := range userIds {
+		c.users[userId] = true
+	}
+	return c.sendIfConnected(map[string][]string{"subscribe": userIds})
+}
+
+func (c *WSClient) Unsubscribe(userIds ...string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, userId := range userIds {
+		delete(c.users, userId)
+	}
+	return c.sendIfConnected(map[string][]string{"unsubscribe": userIds})
+}
+
+func (c *WSClient) SubscribeChannel(channelId string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.channels[channelId] = true
+	return c.sendIfConnected(map[string]string{"subscribeChannel": channelId})
+}
+
+func (c *WSClient) UnsubscribeChannel(channelId string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.channels, channelId)
+	return c.sendIfConnected(map[string]string{"unsubscribeChannel": channelId})
+}
+
+// SetStatus 記住手動設定的狀態，重連後 (server 會先設成 online) 再設一次
+func (c *WSClient) SetStatus(status string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.status = status
+	return c.sendIfConnected(map[string]string{"status": status})
+}
+
+// Activity 回報使用者有操作，沒連上就略過
+func (c *WSClient) Activity() error {
+	return c.Send(map[string]bool{"activity": true})
+}
+
+// sendIfConnected 會記住的操作沒連上時不算錯誤，呼叫端需持有鎖
+func (c *WSClient) sendIfConnected(v interface{}) error {
+	if c.conn == nil {
+		return nil
+	}
+	return c.sendLocked(mustMarshal(v))
+}
+
+// Connected 目前是否連著
+func (c *WSClient) Connected() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn != nil
+}
+
+func mustMarshal(v interface{}) []byte {
+	b, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func keys(m map[string]bool) []string {
+	out := make([]string, 0, len(m))
+	for k := range m {
+		out = append(out, k)
+	}
+	return out
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWSClient_Reconnect(t *testing.T) {
+	server, url := newTestServer(t, testConnConfig())
+
+	// 第一次拿 token 失敗，之後才成功
+	var tokens int32
+	cfg := DefaultWSClientConfig(url, func(context.Context) (string, error) {
+		if atomic.AddInt32(&tokens, 1) == 1 {
+			return "", errors.New("token service down")
+		}
+		return "tokenB", nil
+	})
+	cfg.MinBackoff = 5 * time.Millisecond
+	cfg.MaxBackoff = 20 * time.Millisecond
+	cfg.PingInterval = 20 * time.Millisecond
+	cfg.PongWait = 100 * time.Millisecond
+
+	events := make(chan WSEvent, 100)
+	client := NewWSClient(cfg, func(e WSEvent) { events <- e })
+	require.NoError(t, client.Subscribe("UA"))
+	require.NoError(t, client.SetStatus(string(StatusBusy)))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- client.Run(ctx) }()
+
+	next := func(typ WSEventType) WSEvent {
+		for {
+			select {
+			case e := <-events:
+				if e.Type == typ {
+					return e
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("no %s event", typ)
+			}
+		}
+	}
+	// 訂閱的 snapshot，跳過其他訊息
+	nextSnapshot := func() PresenceBatchFrame {
+		for {
+			e := next(WSMessage)
+			if strings.Contains(string(e.Data), `"presence"`) {
+				var frame PresenceBatchFrame
+				require.NoError(t, json.Unmarshal(e.Data, &frame))
+				return frame
+			}
+		}
+	}
+
+	require.Error(t, next(WSDialError).Err)
+	next(WSConnected)
+	require.Equal(t, "UA", nextSnapshot().Presence[0].UserId)
+	require.Eventually(t, func() bool { return statusOf(t, server, "UB") == StatusBusy }, time.Second, 5*time.Millisecond)
+
+	// server 踢掉連線後自動重連，並恢復訂閱與狀態
+	for _, c := range server.hub.Clients("UB") {
+		c.close(websocket.CloseGoingAway, "restart")
+	}
+	next(WSDisconnected)
+	next(WSConnected)
+	require.Equal(t, "UA", nextSnapshot().Presence[0].UserId)
+	require.Eventually(t, func() bool { return statusOf(t, server, "UB") == StatusBusy }, time.Second, 5*time.Millisecond)
+	require.Len(t, server.subs.Watchers("UA"), 1)
+
+	// 結束時送 close，server 端轉 offline
+	cancel()
+	require.ErrorIs(t, <-done, context.Canceled)
+	require.False(t, client.Connected())
+	require.Eventually(t, func() bool { return statusOf(t, server, "UB") == StatusOffline }, time.Second, 5*time.Millisecond)
+}
+
+func TestWSClient_Backoff(t *testing.T) {
+	cfg := DefaultWSClientConfig("", StaticToken(""))
+	cfg.MinBackoff = 100 * time.Millisecond
+	cfg.MaxBackoff = time.Second
+	cfg.Jitter = 0.5
+	client := NewWSClient(cfg, nil)
+
+	for attempt, max := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		max *= time.Millisecond
+		d := client.backoff(attempt)
+		require.LessOrEqual(t, d, max)
+		require.GreaterOrEqual(t, d, max/2)
+	}
+}